@@ -3,6 +3,7 @@ package producer
 import (
 	"bytes"
 	"crypto/md5"
+	"hash"
 
 	k "github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/golang/protobuf/proto"
@@ -12,10 +13,60 @@ var (
 	magicNumber = []byte{0xF3, 0x89, 0x9A, 0xC2}
 )
 
+// Aggregator packs user records into a single Kinesis record, in the order they
+// are put in, using the KPL aggregation format. It may be used on its own, apart
+// from the Producer: `Put` the user records, keeping an eye on `Size` and `Count`,
+// and `Drain` them into an aggregated record once it is big enough.
 type Aggregator struct {
-	buf    []*Record
-	pkeys  []string
-	nbytes int
+	buf   []*Record
+	pkeys []string
+	// pkeyIndex maps the partition keys to their index in the keys table.
+	pkeyIndex map[string]uint64
+	nbytes    int
+	// metas of the user records, nil for the ones with nothing to keep.
+	metas []*userMeta
+	// userBytes is the size of the data and partition keys of the user records.
+	userBytes int
+	// minKeyRecords is the minimum number of user records sharing a partition
+	// key for them to be aggregated, unless smaller than smallRecordSize.
+	minKeyRecords   int
+	smallRecordSize int
+	// keyFunc picks the partition key of the aggregated record out of
+	// the partition keys of its user records. Defaults to the first one.
+	keyFunc func(keys []string) string
+	// framing of the aggregated record, and the delimiter
+	// used for joining the user records when delimited.
+	framing   Framing
+	delimiter []byte
+	// checksumScope determines the bytes covered by the checksum.
+	checksumScope ChecksumScope
+	// marshaler used to serialize the aggregated record.
+	// Defaults to the standard `proto.Marshal`.
+	marshaler marshaler
+	// incremental serializes the user records into enc, and their partition keys into
+	// keysEnc, as they are put rather than at drain time, unless ordered. The checksum is
+	// updated with them as well, until a new partition key follows the first record, as
+	// the keys table comes first: stale is then set, and the checksum computed at drain.
+	incremental bool
+	keysEnc     []byte
+	enc         []byte
+	checksum    hash.Hash
+	stale       bool
+	// msgSize is the size of the serialized protobuf message, which `Size`
+	// overestimates for small records but may underestimate for large ones.
+	msgSize int
+	// idFunc generates the IDs of the aggregated records: nextID is the one of the next
+	// aggregated record, so that its size is known ahead, and id the one of the current
+	// aggregated record, stored in a tag of its first user record.
+	idFunc     func() string
+	nextID, id string
+	// ordered is true if any user record was put with an ordering key.
+	ordered bool
+}
+
+// NewAggregator creates a new, empty, Aggregator.
+func NewAggregator() *Aggregator {
+	return &Aggregator{marshaler: fastMarshaler{}, incremental: true}
 }
 
 // Size return how many bytes stored in the aggregator.
@@ -29,25 +80,123 @@ func (a *Aggregator) Count() int {
 	return len(a.buf)
 }
 
-// Put record using `data` and `partitionKey`. This method is thread-safe.
+// Put record using `data` and `partitionKey`. This method is not thread-safe.
 func (a *Aggregator) Put(data []byte, partitionKey string) {
-	// For now, all records in the aggregated record will have
-	// the same partition key.
+	a.put(data, partitionKey, nil, nil)
+}
+
+// put record using `data`, `partitionKey` and the record's `tags`. The `meta`
+// of the record, if any, is carried by the aggregated record.
+func (a *Aggregator) put(data []byte, partitionKey string, tags []*Tag, meta *userMeta) {
+	a.metas = append(a.metas, meta)
+	if meta != nil && meta.orderingKey != "" {
+		a.ordered = true
+	}
+	a.userBytes += len(data) + len(partitionKey)
+	// Every user record keeps its own partition key in the keys table, but
+	// the aggregated record is put using a single one. All records thus end
+	// up in the same shard, picked by the `keyFunc`.
 	// later, we will add shard-mapper same as the KPL use.
 	// see: https://github.com/a8m/kinesis-producer/issues/1
-	if len(a.pkeys) == 0 {
-		a.pkeys = []string{partitionKey}
+	keyIndex, ok := a.pkeyIndex[partitionKey]
+	if !ok {
+		if a.pkeyIndex == nil {
+			a.pkeyIndex = make(map[string]uint64)
+		}
+		keyIndex = uint64(len(a.pkeys))
+		a.pkeyIndex[partitionKey] = keyIndex
+		a.pkeys = append(a.pkeys, partitionKey)
 		a.nbytes += len([]byte(partitionKey))
+		a.msgSize += 1 + proto.SizeVarint(uint64(len(partitionKey))) + len(partitionKey)
 	}
-	keyIndex := uint64(len(a.pkeys) - 1)
 
+	if len(a.buf) == 0 && a.nextID != "" && a.framing != FramingDelimited {
+		a.id = a.nextID
+		tags = append(tags[:len(tags):len(tags)], aggregateIDTag(a.id))
+	}
+	if a.framing == FramingDelimited {
+		a.nbytes += len(a.delimiter) + len(data)
+		a.buf = append(a.buf, &Record{
+			Data:              data,
+			PartitionKeyIndex: &keyIndex,
+		})
+		return
+	}
 	a.nbytes++ // protobuf message index and wire type
 	a.nbytes += partitionKeyIndexSize
-	a.buf = append(a.buf, &Record{
+	record := &Record{
 		Data:              data,
 		PartitionKeyIndex: &keyIndex,
-	})
-	a.nbytes += len(data)
+		Tags:              tags,
+	}
+	a.buf = append(a.buf, record)
+	a.nbytes += len(data) + tagsSize(tags)
+	a.msgSize += recordSize(keyIndex, len(data), tags)
+	if a.incremental && !a.ordered {
+		a.encode(record, !ok)
+	}
+}
+
+// encode appends the user record to the serialized records, and its partition key to the
+// serialized keys table if it is a new one, as `proto.Marshal` lays them out: the keys
+// table first. The checksum is updated with them as long as the layout allows.
+func (a *Aggregator) encode(r *Record, newKey bool) {
+	if a.checksum == nil {
+		a.checksum = md5.New()
+		if a.checksumScope == ChecksumMagicAndMessage {
+			a.checksum.Write(magicNumber)
+		}
+	}
+	keyIndex := r.GetPartitionKeyIndex()
+	if newKey {
+		start := len(a.keysEnc)
+		a.keysEnc = appendBytesField(a.keysEnc, 1, []byte(a.pkeys[keyIndex]))
+		// the hashed records would have to follow the new key
+		a.stale = a.stale || len(a.enc) > 0
+		if !a.stale {
+			a.checksum.Write(a.keysEnc[start:])
+		}
+	}
+	start, enc := len(a.enc), a.enc
+	size := 1 + proto.SizeVarint(keyIndex) + 1 + proto.SizeVarint(uint64(len(r.Data))) + len(r.Data) + tagsSize(r.Tags)
+	enc = appendVarint(enc, 3<<3|proto.WireBytes)
+	enc = appendVarint(enc, uint64(size))
+	enc = appendVarint(enc, 1<<3|proto.WireVarint)
+	enc = appendVarint(enc, keyIndex)
+	enc = appendBytesField(enc, 3, r.Data)
+	for _, t := range r.Tags {
+		key, value := t.GetKey(), t.GetValue()
+		size := 1 + proto.SizeVarint(uint64(len(key))) + len(key)
+		if t.Value != nil {
+			size += 1 + proto.SizeVarint(uint64(len(value))) + len(value)
+		}
+		enc = appendVarint(enc, 4<<3|proto.WireBytes)
+		enc = appendVarint(enc, uint64(size))
+		enc = appendBytesField(enc, 1, []byte(key))
+		if t.Value != nil {
+			enc = appendBytesField(enc, 2, []byte(value))
+		}
+	}
+	if !a.stale {
+		a.checksum.Write(enc[start:])
+	}
+	a.enc = enc
+}
+
+// appendVarint appends the varint encoding of `v` to `b`.
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendBytesField appends the length-delimited field of number `n` holding `v` to `b`.
+func appendBytesField(b []byte, n uint64, v []byte) []byte {
+	b = appendVarint(b, n<<3|proto.WireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
 }
 
 // Drain create an aggregated `kinesis.PutRecordsRequestEntry`
@@ -58,30 +207,308 @@ func (a *Aggregator) Drain() (*k.PutRecordsRequestEntry, error) {
 	if a.nbytes == 0 {
 		return nil, nil
 	}
-	data, err := proto.Marshal(&AggregatedRecord{
+	if a.framing == FramingDelimited {
+		return a.drainDelimited(), nil
+	}
+	if a.incremental && !a.ordered {
+		return a.drainIncremental(), nil
+	}
+	m := a.marshaler
+	if m == nil {
+		m = protoMarshaler{}
+	}
+	scratch := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(scratch)
+	data := append((*scratch)[:0], magicNumber...)
+	data, err := m.appendMarshal(data, &AggregatedRecord{
 		PartitionKeyTable: a.pkeys,
 		Records:           a.buf,
 	})
+	*scratch = data
 	if err != nil {
 		return nil, err
 	}
 	h := md5.New()
-	h.Write(data)
-	checkSum := h.Sum(nil)
-	aggData := append(magicNumber, data...)
-	aggData = append(aggData, checkSum...)
-	entry := &k.PutRecordsRequestEntry{
-		Data:         aggData,
-		PartitionKey: &a.pkeys[0],
+	h.Write(a.checksumScope.covered(data))
+	aggData := make([]byte, len(data), len(data)+md5.Size)
+	copy(aggData, data)
+	return a.entry(h.Sum(aggData)), nil
+}
+
+// drainIncremental create a `kinesis.PutRecordsRequestEntry` out of the keys table and
+// the user records serialized as they were put, finalizing their checksum, or computing
+// it if stale.
+func (a *Aggregator) drainIncremental() *k.PutRecordsRequestEntry {
+	data := make([]byte, 0, len(magicNumber)+len(a.keysEnc)+len(a.enc)+md5.Size)
+	data = append(data, magicNumber...)
+	data = append(data, a.keysEnc...)
+	data = append(data, a.enc...)
+	h := a.checksum
+	if a.stale {
+		h = md5.New()
+		h.Write(a.checksumScope.covered(data))
+	}
+	return a.entry(h.Sum(data))
+}
+
+// entry returns the aggregated record of `data`, put with the partition key picked out of
+// the ones of the user records, and clears the aggregator.
+func (a *Aggregator) entry(data []byte) *k.PutRecordsRequestEntry {
+	partitionKey := a.pkeys[0]
+	if a.keyFunc != nil {
+		// invalid keys would fail the whole PutRecords request
+		if key := a.keyFunc(a.pkeys); key != "" && len(key) <= maxPartitionKeySize {
+			partitionKey = key
+		}
+	}
+	a.clear()
+	return &k.PutRecordsRequestEntry{
+		Data:         data,
+		PartitionKey: &partitionKey,
+	}
+}
+
+// drainDelimited create a `kinesis.PutRecordsRequestEntry` holding
+// the data of the user records joined with the delimiter.
+func (a *Aggregator) drainDelimited() *k.PutRecordsRequestEntry {
+	data := make([][]byte, len(a.buf))
+	for i, r := range a.buf {
+		data[i] = r.Data
+	}
+	return a.entry(bytes.Join(data, a.delimiter))
+}
+
+// overhead returns the number of bytes the framing adds to the user records
+// of an aggregated record, on top of its `Size`, in the worst case.
+func (a *Aggregator) overhead() int {
+	if a.framing == FramingDelimited {
+		return len(a.delimiter)
+	}
+	n := md5.Size + len(magicNumber) + maxRecordFraming
+	if a.nextID != "" {
+		n += tagsSize([]*Tag{aggregateIDTag(a.nextID)})
+	}
+	return n
+}
+
+// wireSize bounds the number of bytes the user records take in the aggregated record,
+// but the ones of `overhead`.
+func (a *Aggregator) wireSize() int {
+	if a.framing == FramingDelimited || a.nbytes > a.msgSize {
+		return a.nbytes
+	}
+	return a.msgSize
+}
+
+// maxRecordFraming bounds the protobuf framing of a user record in an aggregated record
+// of up to 1MiB: the tags and lengths of the record, of its key index and of its data,
+// and the ones of its partition key in the keys table.
+const maxRecordFraming = 1 + 3 + 1 + 5 + 1 + 3 + 1 + 2
+
+// recordSize returns the size of a serialized user record, framing included.
+func recordSize(keyIndex uint64, dataSize int, tags []*Tag) int {
+	n := 1 + proto.SizeVarint(keyIndex) + 1 + proto.SizeVarint(uint64(dataSize)) + dataSize + tagsSize(tags)
+	return 1 + proto.SizeVarint(uint64(n)) + n
+}
+
+// drain the aggregated record along with the futures of its user records.
+// The futures are failed with the error if the drain fails.
+//
+// When aggregating only the partition keys shared by enough user records,
+// the other user records are returned as is, as unaggregated records.
+func (a *Aggregator) drain() ([]*kinesisRecord, error) {
+	if a.nbytes == 0 {
+		return nil, nil
+	}
+	var out []*kinesisRecord
+	if a.minKeyRecords > 1 {
+		out = a.drainUnshared()
+		if a.nbytes == 0 {
+			return out, nil
+		}
+	}
+	a.sortByOrderingKey()
+	record := a.aggregatedRecord()
+	entry, err := a.Drain()
+	if err != nil {
+		record.resolve("", err)
+		a.clear()
+		return out, err
+	}
+	record.PutRecordsRequestEntry = entry
+	return append(out, record), nil
+}
+
+// aggregatedRecord returns the aggregated record of the user records, to be marshaled.
+func (a *Aggregator) aggregatedRecord() *kinesisRecord {
+	record := &kinesisRecord{metas: a.metas, count: a.Count(), aggregated: true, userBytes: a.userBytes, aggregateID: a.id}
+	if a.framing == FramingDelimited {
+		record.users = a.userEntries()
+	}
+	return record
+}
+
+// drainDetached is like drain, but leaves the aggregated record to be marshaled later on,
+// out of the user records moved to the aggregator of the returned job.
+func (a *Aggregator) drainDetached() ([]*kinesisRecord, *marshalJob) {
+	if a.nbytes == 0 {
+		return nil, nil
+	}
+	var out []*kinesisRecord
+	if a.minKeyRecords > 1 {
+		out = a.drainUnshared()
+		if a.nbytes == 0 {
+			return out, nil
+		}
+	}
+	a.sortByOrderingKey()
+	record := a.aggregatedRecord()
+	record.marshaled = make(chan struct{})
+	detached := &Aggregator{
+		buf:           a.buf,
+		pkeys:         a.pkeys,
+		nbytes:        a.nbytes,
+		framing:       a.framing,
+		checksumScope: a.checksumScope,
+		marshaler:     a.marshaler,
+		keyFunc:       a.keyFunc,
 	}
 	a.clear()
-	return entry, nil
+	return append(out, record), &marshalJob{record: record, aggregator: detached}
+}
+
+// userEntries returns the user records of the aggregator, whose boundaries are
+// lost once their data is joined with the delimiter.
+func (a *Aggregator) userEntries() []*k.PutRecordsRequestEntry {
+	out := make([]*k.PutRecordsRequestEntry, len(a.buf))
+	for i, r := range a.buf {
+		partitionKey := a.pkeys[r.GetPartitionKeyIndex()]
+		out[i] = &k.PutRecordsRequestEntry{Data: r.Data, PartitionKey: &partitionKey}
+	}
+	return out
+}
+
+// drainUnshared removes from the aggregator the (big enough) user records
+// of the partition keys not shared by `minKeyRecords` records, and returns
+// them as unaggregated records. The records carrying options stored in their
+// tags stay in the aggregate, see `aggregateOnly`.
+func (a *Aggregator) drainUnshared() (out []*kinesisRecord) {
+	counts := make([]int, len(a.pkeys))
+	for _, r := range a.buf {
+		counts[r.GetPartitionKeyIndex()]++
+	}
+	keep := &Aggregator{
+		framing:       a.framing,
+		delimiter:     a.delimiter,
+		checksumScope: a.checksumScope,
+		marshaler:     a.marshaler,
+		keyFunc:       a.keyFunc,
+		incremental:   a.incremental,
+		idFunc:        a.idFunc,
+		nextID:        a.nextID,
+	}
+	for i, r := range a.buf {
+		partitionKey := a.pkeys[r.GetPartitionKeyIndex()]
+		if counts[r.GetPartitionKeyIndex()] >= a.minKeyRecords || len(r.Data) < a.smallRecordSize || aggregateOnly(r) {
+			keep.put(r.Data, partitionKey, withoutAggregateID(r.Tags), a.metas[i])
+			continue
+		}
+		record := &kinesisRecord{
+			PutRecordsRequestEntry: &k.PutRecordsRequestEntry{
+				Data:         recordData(r),
+				PartitionKey: &partitionKey,
+			},
+			count:     1,
+			userBytes: len(r.Data) + len(partitionKey),
+		}
+		if a.metas[i] != nil {
+			record.metas = []*userMeta{a.metas[i]}
+		}
+		out = append(out, record)
+	}
+	a.buf, a.pkeys, a.pkeyIndex, a.nbytes, a.metas = keep.buf, keep.pkeys, keep.pkeyIndex, keep.nbytes, keep.metas
+	a.userBytes, a.msgSize = keep.userBytes, keep.msgSize
+	a.keysEnc, a.enc, a.checksum, a.stale = keep.keysEnc, keep.enc, keep.checksum, keep.stale
+	a.id = keep.id
+	return out
+}
+
+// aggregateOnly reports whether the user record carries options that are lost
+// if it is sent unaggregated, like its content type, debug flag or route.
+func aggregateOnly(r *Record) bool {
+	for _, t := range r.Tags {
+		switch t.GetKey() {
+		case tagContentType, tagDebug, tagRoute:
+			return true
+		}
+	}
+	return false
 }
 
 func (a *Aggregator) clear() {
 	a.buf = make([]*Record, 0)
 	a.pkeys = make([]string, 0)
+	a.pkeyIndex = nil
+	a.metas = nil
 	a.nbytes = 0
+	a.msgSize = 0
+	a.ordered = false
+	a.id = ""
+	if a.idFunc != nil {
+		a.nextID = a.idFunc()
+	}
+	a.userBytes = 0
+	a.keysEnc, a.enc, a.stale = a.keysEnc[:0], a.enc[:0], false
+	if a.checksum != nil {
+		a.checksum.Reset()
+		if a.checksumScope == ChecksumMagicAndMessage {
+			a.checksum.Write(magicNumber)
+		}
+	}
+}
+
+// ChecksumScope determines the bytes of an aggregated record covered by its MD5 checksum.
+type ChecksumScope int
+
+const (
+	// ChecksumMessage computes the checksum over the serialized protobuf message only,
+	// i.e. all the bytes between the magic number and the checksum. This is the KPL format.
+	ChecksumMessage ChecksumScope = iota
+	// ChecksumMagicAndMessage computes the checksum over the magic number followed by
+	// the serialized protobuf message, i.e. all the bytes before the checksum, as some
+	// third-party deaggregators expect.
+	ChecksumMagicAndMessage
+)
+
+// ChecksumBytes returns the exact bytes of the aggregated record `data` covered by its
+// checksum using `scope`, or nil if `data` is not an aggregated record.
+func ChecksumBytes(data []byte, scope ChecksumScope) []byte {
+	if !bytes.HasPrefix(data, magicNumber) || len(data) < len(magicNumber)+md5.Size {
+		return nil
+	}
+	return scope.covered(data[:len(data)-md5.Size])
+}
+
+// covered returns the bytes covered by the checksum out of `data`,
+// holding the magic number followed by the serialized message.
+func (s ChecksumScope) covered(data []byte) []byte {
+	if s == ChecksumMagicAndMessage {
+		return data
+	}
+	return data[len(magicNumber):]
+}
+
+// tagsSize returns the number of bytes `tags` take in a serialized record.
+func tagsSize(tags []*Tag) (n int) {
+	for _, t := range tags {
+		key, value := t.GetKey(), t.GetValue()
+		size := 1 + proto.SizeVarint(uint64(len(key))) + len(key)
+		if t.Value != nil {
+			size += 1 + proto.SizeVarint(uint64(len(value))) + len(value)
+		}
+		n += 1 + proto.SizeVarint(uint64(size)) + size
+	}
+	return
 }
 
 // Test if a given entry is aggregated record.
@@ -90,6 +517,18 @@ func isAggregated(entry *k.PutRecordsRequestEntry) bool {
 }
 
 func extractRecords(entry *k.PutRecordsRequestEntry) (out []*k.PutRecordsRequestEntry) {
+	for _, u := range extractUserRecords(entry) {
+		out = append(out, &k.PutRecordsRequestEntry{
+			Data:         u.data,
+			PartitionKey: &u.partitionKey,
+		})
+	}
+	return
+}
+
+// extractUserRecords extracts the user records out of an aggregated record, decompressed,
+// along with their timestamp, if any.
+func extractUserRecords(entry *k.PutRecordsRequestEntry) (out []*userRecord) {
 	src := entry.Data[len(magicNumber) : len(entry.Data)-md5.Size]
 	dest := new(AggregatedRecord)
 	err := proto.Unmarshal(src, dest)
@@ -98,10 +537,30 @@ func extractRecords(entry *k.PutRecordsRequestEntry) (out []*k.PutRecordsRequest
 	}
 	for i := range dest.Records {
 		r := dest.Records[i]
-		out = append(out, &k.PutRecordsRequestEntry{
-			Data:         r.GetData(),
-			PartitionKey: &dest.PartitionKeyTable[r.GetPartitionKeyIndex()],
-		})
+		u := &userRecord{
+			data:         recordData(r),
+			partitionKey: dest.PartitionKeyTable[r.GetPartitionKeyIndex()],
+		}
+		for _, t := range r.Tags {
+			if t.GetKey() == tagTimestamp {
+				u.timestamp, _ = parseTimestamp(t.GetValue())
+			}
+		}
+		out = append(out, u)
 	}
 	return
 }
+
+// recordData returns the data of the user record, decompressed if needed.
+// The compressed data is kept if it can't be decompressed.
+func recordData(r *Record) []byte {
+	data := r.GetData()
+	for _, t := range r.Tags {
+		if t.GetKey() == tagCompression {
+			if raw, err := decompress(t.GetValue(), data); err == nil {
+				data = raw
+			}
+		}
+	}
+	return data
+}
@@ -1,8 +1,11 @@
 package producer
 
 import (
+	"bytes"
+	"crypto/md5"
 	"math/rand"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -62,3 +65,185 @@ func TestDrainEmptyAggregator(t *testing.T) {
 	_, err := a.Drain()
 	assert(t, err == nil, "should not return an error")
 }
+
+func benchmarkDrain(b *testing.B, m marshaler) {
+	benchmarkDrainAggregator(b, &Aggregator{marshaler: m}, false)
+}
+
+func BenchmarkDrainDefault(b *testing.B) { benchmarkDrain(b, protoMarshaler{}) }
+
+func BenchmarkDrainFast(b *testing.B) { benchmarkDrain(b, fastMarshaler{}) }
+
+func BenchmarkDrainIncremental(b *testing.B) {
+	benchmarkDrainAggregator(b, &Aggregator{incremental: true}, false)
+}
+
+// the producer drains its aggregator with the lock held, blocking the concurrent
+// puts, so the time spent in `Drain` matters on its own
+func BenchmarkDrainOnlyFast(b *testing.B) {
+	benchmarkDrainAggregator(b, &Aggregator{marshaler: fastMarshaler{}}, true)
+}
+
+func BenchmarkDrainOnlyIncremental(b *testing.B) {
+	benchmarkDrainAggregator(b, &Aggregator{incremental: true}, true)
+}
+
+func benchmarkDrainAggregator(b *testing.B, a *Aggregator, drainOnly bool) {
+	data := []byte(strings.Repeat("hello world", 10))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if drainOnly {
+			b.StopTimer()
+		}
+		for j := 0; j < 100; j++ {
+			a.Put(data, "pkey")
+		}
+		if drainOnly {
+			b.StartTimer()
+		}
+		if _, err := a.Drain(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestIncrementalChecksum(t *testing.T) {
+	for _, scope := range []ChecksumScope{ChecksumMessage, ChecksumMagicAndMessage} {
+		expected, incremental := &Aggregator{checksumScope: scope}, &Aggregator{checksumScope: scope, incremental: true}
+		// drain twice, so that the checksum is reset in between
+		for n := 0; n < 2; n++ {
+			for i := 0; i < 10; i++ {
+				c := strconv.Itoa(i)
+				expected.Put([]byte("hello-"+c), "world-"+strconv.Itoa(i%3))
+				incremental.Put([]byte("hello-"+c), "world-"+strconv.Itoa(i%3))
+			}
+			r1, err := expected.Drain()
+			assert(t, err == nil, "should not return an error")
+			r2, err := incremental.Drain()
+			assert(t, err == nil, "should not return an error")
+			assert(t, *r1.PartitionKey == *r2.PartitionKey, "should use the same partition key")
+			sum := md5.Sum(ChecksumBytes(r2.Data, scope))
+			assert(t, bytes.HasSuffix(r2.Data, sum[:]), "should checksum the serialized records")
+			assert(t, bytes.Equal(r1.Data, r2.Data), "should serialize the records as proto.Marshal does")
+		}
+		// a single partition key keeps the checksum incremental
+		for i := 0; i < 10; i++ {
+			expected.Put([]byte("hello-"+strconv.Itoa(i)), "world")
+			incremental.Put([]byte("hello-"+strconv.Itoa(i)), "world")
+		}
+		assert(t, !incremental.stale, "expect the checksum to be computed as the records are put")
+		r1, _ := expected.Drain()
+		r2, _ := incremental.Drain()
+		assert(t, bytes.Equal(r1.Data, r2.Data), "should serialize the records as proto.Marshal does")
+	}
+}
+
+func TestFastMarshaler(t *testing.T) {
+	expected, fast := new(Aggregator), &Aggregator{marshaler: fastMarshaler{}}
+	for i := 0; i < 10; i++ {
+		c := strconv.Itoa(i)
+		expected.Put([]byte("hello-"+c), "world")
+		fast.Put([]byte("hello-"+c), "world")
+	}
+	r1, err := expected.Drain()
+	assert(t, err == nil, "should not return an error")
+	r2, err := fast.Drain()
+	assert(t, err == nil, "should not return an error")
+	assert(t, string(r1.Data) == string(r2.Data), "fast marshaler should produce the same aggregated record")
+}
+
+func TestAggregateKeyFunc(t *testing.T) {
+	a := &Aggregator{keyFunc: func(keys []string) string {
+		return strings.Join(keys, "-")
+	}}
+	for _, pkey := range []string{"a", "b", "a", "c"} {
+		a.Put([]byte("data-"+pkey), pkey)
+	}
+	record, err := a.Drain()
+	assert(t, err == nil, "should not return an error")
+	assert(t, *record.PartitionKey == "a-b-c", "should use the partition key picked by the key func")
+	for _, r := range extractRecords(record) {
+		assert(t, string(r.Data) == "data-"+*r.PartitionKey, "user records should keep their partition keys")
+	}
+
+	for _, key := range []string{"", strings.Repeat("k", maxPartitionKeySize+1)} {
+		key := key
+		a := &Aggregator{keyFunc: func([]string) string { return key }}
+		a.Put([]byte("hello"), "a")
+		a.Put([]byte("world"), "b")
+		record, err := a.Drain()
+		assert(t, err == nil, "should not return an error")
+		assert(t, *record.PartitionKey == "a", "should fall back to the first key on an invalid key")
+	}
+}
+
+func TestDelimitedFraming(t *testing.T) {
+	a := &Aggregator{framing: FramingDelimited, delimiter: []byte("\n")}
+	for _, data := range []string{`{"a":1}`, `{"b":2}`, `{"c":3}`} {
+		a.Put([]byte(data), "key")
+	}
+	assert(t, a.Size() == 3+3*(7+1), "size should equal to the data, the delimiters and the partition-key")
+	record, err := a.Drain()
+	assert(t, err == nil, "should not return an error")
+	assert(t, !isAggregated(record), "should not return a KPL agregated record")
+	assert(t, string(record.Data) == "{\"a\":1}\n{\"b\":2}\n{\"c\":3}", "should join the records with the delimiter")
+	assert(t, *record.PartitionKey == "key", "should use the partition key of the records")
+}
+
+func TestAggregateMinKeyRecords(t *testing.T) {
+	a := &Aggregator{minKeyRecords: 2, smallRecordSize: 3}
+	a.Put([]byte("hello"), "a")
+	a.Put([]byte("world"), "a")
+	a.Put([]byte("lonely"), "b")
+	a.Put([]byte("ok"), "c")
+	records, err := a.drain()
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(records) == 2, "should return an unaggregated and an aggregated record")
+	assert(t, !records[0].aggregated && string(records[0].Data) == "lonely", "should not aggregate the unshared partition key")
+	assert(t, records[1].aggregated && records[1].count == 3, "should aggregate the shared partition key and the small records")
+	assert(t, a.Size()+a.Count() == 0, "should be empty after drain")
+}
+
+func TestChecksumScope(t *testing.T) {
+	for _, scope := range []ChecksumScope{ChecksumMessage, ChecksumMagicAndMessage} {
+		a := &Aggregator{checksumScope: scope}
+		a.Put([]byte("hello"), "world")
+		record, err := a.Drain()
+		assert(t, err == nil, "should not return an error")
+		data := record.Data
+		sum := md5.Sum(ChecksumBytes(data, scope))
+		assert(t, bytes.Equal(sum[:], data[len(data)-md5.Size:]), "checksum should cover the scope bytes")
+		if scope == ChecksumMessage {
+			assert(t, bytes.Equal(ChecksumBytes(data, scope), data[len(magicNumber):len(data)-md5.Size]), "default scope should cover the message only")
+		}
+		records, err := Deaggregate(data, *record.PartitionKey)
+		assert(t, err == nil && len(records) == 1, "should deaggregate records of any checksum scope")
+	}
+}
+
+func TestRandomAggregateKey(t *testing.T) {
+	a := &Aggregator{keyFunc: RandomAggregateKey}
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		a.Put([]byte("data"), "key")
+		record, err := a.Drain()
+		assert(t, err == nil, "should not return an error")
+		seen[*record.PartitionKey] = true
+		for _, r := range extractRecords(record) {
+			assert(t, *r.PartitionKey == "key", "user records should keep their partition keys")
+		}
+	}
+	assert(t, len(seen) == 10, "should put the aggregated records with random keys")
+}
+
+func TestRoundRobinAggregateKeys(t *testing.T) {
+	a := &Aggregator{keyFunc: RoundRobinAggregateKeys(3)}
+	var keys []string
+	for i := 0; i < 4; i++ {
+		a.Put([]byte("data"), "key")
+		record, err := a.Drain()
+		assert(t, err == nil, "should not return an error")
+		keys = append(keys, *record.PartitionKey)
+	}
+	assert(t, strings.Join(keys, ",") == "0,1,2,0", "should put the aggregated records with the keys in turn")
+}
@@ -0,0 +1,176 @@
+package producer
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// PutWithTimeout `data` using `partitionKey` like `Put`, but waits at most `wait` for
+// the backlog to have room for the records it causes to be sent, and then gives up
+// with `ErrBacklogFull`.
+func (p *Producer) PutWithTimeout(data []byte, partitionKey string, wait time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	return p.PutWithContext(ctx, data, partitionKey)
+}
+
+// PutWithContext `data` using `partitionKey` like `Put`, but gives up waiting for the
+// backlog with `ErrBacklogFull` once `ctx` is done. The values of `Config.ContextFields`
+// in `ctx` are kept along with the record, and handed over with its failure, if any.
+func (p *Producer) PutWithContext(ctx context.Context, data []byte, partitionKey string) error {
+	r := &userRecord{data: data, partitionKey: partitionKey, done: ctx.Done(), ctx: ctx}
+	for _, key := range p.ContextFields {
+		if v := ctx.Value(key); v != nil {
+			if r.values == nil {
+				r.values = make(map[interface{}]interface{}, len(p.ContextFields))
+			}
+			r.values[key] = v
+		}
+	}
+	return p.put(r)
+}
+
+// lockForRoom acquires the lock. A user record that doesn't block on the backlog,
+// because the producer is paused or the record has a deadline, waits until the
+// backlog has room when `send` reports that it causes records to be sent.
+// ErrBacklogFull is returned, without the lock held, if it can't wait any longer.
+func (p *Producer) lockForRoom(r *userRecord, send func() bool) error {
+	for {
+		p.Lock()
+		if !p.paused && r.done == nil || !send() || !p.backlogFull() {
+			return nil
+		}
+		p.Unlock()
+		if r.done == nil {
+			return ErrBacklogFull
+		}
+		select {
+		case <-p.room:
+		case <-r.done:
+			return ErrBacklogFull
+		}
+	}
+}
+
+// signalRoom wakes up a user record waiting for the backlog to have room.
+func (p *Producer) signalRoom() {
+	select {
+	case p.room <- struct{}{}:
+	default:
+	}
+}
+
+// backlogFull reports whether the backlog can't take any more records without blocking.
+// It must be called with the lock held.
+func (p *Producer) backlogFull() bool {
+	return len(p.held) > 0 || len(p.records) == cap(p.records)
+}
+
+// hold pipes the records into the backlog without blocking, and keeps the ones that
+// don't fit aside until the loop takes them, or the producer is resumed.
+// It must be called with the lock held.
+func (p *Producer) hold(records []*kinesisRecord) {
+	defer p.backlogChanged()
+	for i, record := range records {
+		select {
+		case p.records <- record:
+		default:
+			p.held = append(p.held, records[i:]...)
+			atomic.StoreInt32(&p.holding, 1)
+			return
+		}
+	}
+}
+
+// takeHeld returns the held records, and clears them.
+func (p *Producer) takeHeld() []*kinesisRecord {
+	p.Lock()
+	defer p.Unlock()
+	held := p.held
+	p.held = nil
+	atomic.StoreInt32(&p.holding, 0)
+	return held
+}
+
+// enqueue pipes the record into the backlog, blocking until it has room.
+func (p *Producer) enqueue(record *kinesisRecord) {
+	p.records <- record
+	p.backlogChanged()
+}
+
+// BacklogState is the state of the backlog reported to `Config.OnBacklogState`.
+type BacklogState int
+
+const (
+	// BacklogHealthy is the state of a backlog used below `Config.BacklogWarningLevel`.
+	BacklogHealthy BacklogState = iota
+	// BacklogWarning is the state of a backlog used at least at the warning level.
+	BacklogWarning
+	// BacklogFull is the state of a backlog that can't take any more records, blocking
+	// the `Put`s that drain an aggregate.
+	BacklogFull
+)
+
+func (s BacklogState) String() string {
+	switch s {
+	case BacklogHealthy:
+		return "healthy"
+	case BacklogWarning:
+		return "warning"
+	case BacklogFull:
+		return "full"
+	}
+	return fmt.Sprintf("BacklogState(%d)", int(s))
+}
+
+// backlogState returns the current state of the backlog, without the lock.
+func (p *Producer) backlogState() BacklogState {
+	if atomic.LoadInt32(&p.holding) != 0 || len(p.records) == cap(p.records) {
+		return BacklogFull
+	}
+	if float64(len(p.records)) >= p.BacklogWarningLevel*float64(cap(p.records)) {
+		return BacklogWarning
+	}
+	return BacklogHealthy
+}
+
+// backlogChanged updates the state of the backlog once records are enqueued or dequeued,
+// and signals its change, if any, to watchBacklog.
+func (p *Producer) backlogChanged() {
+	if p.OnBacklogState == nil {
+		return
+	}
+	s := int32(p.backlogState())
+	for {
+		old := atomic.LoadInt32(&p.backlog)
+		if old == s {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&p.backlog, old, s) {
+			break
+		}
+	}
+	select {
+	case p.backlogChanges <- struct{}{}:
+	default:
+	}
+}
+
+// watchBacklog hands the changes of the state of the backlog over to
+// `Config.OnBacklogState`, until the loop returns.
+func (p *Producer) watchBacklog() {
+	state := BacklogHealthy
+	for {
+		select {
+		case <-p.backlogChanges:
+			if s := BacklogState(atomic.LoadInt32(&p.backlog)); s != state {
+				state = s
+				p.OnBacklogState(state)
+			}
+		case <-p.exited:
+			return
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPutWithTimeout(t *testing.T) {
+	client := &clientMock{
+		incoming: make(map[int][]string),
+		responses: []responseMock{
+			{
+				Response: &k.PutRecordsOutput{
+					FailedRecordCount: aws.Int64(0),
+					Records: []*k.PutRecordsResultEntry{
+						{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+						{SequenceNumber: aws.String("2"), ShardId: aws.String("1")},
+						{SequenceNumber: aws.String("3"), ShardId: aws.String("1")},
+					},
+				},
+			},
+		},
+	}
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		BacklogCount:        1,
+		AggregateBatchCount: 1,
+		Client:              client,
+	})
+	// the loop is not started yet, so the backlog is not consumed
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	start := time.Now()
+	err := p.PutWithTimeout([]byte("foo"), "foo", 10*time.Millisecond)
+	assert(t, err == ErrBacklogFull, "expect full backlog to reject records after the timeout")
+	assert(t, time.Since(start) >= 10*time.Millisecond, "expect the record to wait for the timeout")
+
+	p.Start()
+	err = p.PutWithTimeout([]byte("bar"), "bar", time.Second)
+	assert(t, err == nil, "expect the record to be put once the backlog has room")
+	p.Stop()
+	assert(t, len(client.incoming[0]) == 3, "expect the records to be flushed")
+}
+
+type contextKey string
+
+func TestPutWithContext(t *testing.T) {
+	var failures []*FailureRecord
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		AggregateBatchCount: 2,
+		ContextFields:       []interface{}{contextKey("request-id")},
+		Client: &clientMock{
+			incoming:  make(map[int][]string),
+			responses: []responseMock{{Error: errors.New("ResourceNotFoundException: Stream foo under account X not found")}},
+		},
+		FailureSink: func(records []*FailureRecord) {
+			failures = append(failures, records...)
+		},
+	})
+	p.Start()
+	ctx := context.WithValue(context.Background(), contextKey("request-id"), "abc")
+	ctx = context.WithValue(ctx, contextKey("other"), "ignored")
+	p.PutWithContext(ctx, []byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	p.Stop()
+
+	assert(t, len(failures) == 2, "expect the records to fail")
+	values := failures[0].ContextValues
+	assert(t, len(values) == 1 && values[contextKey("request-id")] == "abc", "expect the context fields in the failure record")
+	assert(t, failures[1].ContextValues == nil, "expect no context values for records put without a context")
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	client := &clientMock{
+		incoming: make(map[int][]string),
+		responses: []responseMock{
+			{
+				Response: &k.PutRecordsOutput{
+					FailedRecordCount: aws.Int64(0),
+					Records: []*k.PutRecordsResultEntry{
+						{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+					},
+				},
+			},
+			{
+				Response: &k.PutRecordsOutput{
+					FailedRecordCount: aws.Int64(0),
+					Records: []*k.PutRecordsResultEntry{
+						{SequenceNumber: aws.String("2"), ShardId: aws.String("1")},
+					},
+				},
+			},
+		},
+	}
+	p := New(&Config{
+		StreamName:       "foo",
+		MaxConnections:   1,
+		MaxBufferedBytes: 10,
+		FlushInterval:    10 * time.Millisecond,
+		Client:           client,
+	})
+	// the loop is not started yet, so nothing is sent
+	err := p.Put([]byte("hello"), "hello")
+	assert(t, err == nil, "expect the first record to be buffered")
+	err = p.PutWithTimeout([]byte("world"), "world", 10*time.Millisecond)
+	assert(t, err == ErrBacklogFull, "expect records exceeding the buffered bytes to be rejected")
+	assert(t, testutil.ToFloat64(p.metrics.bufferedBytes.WithLabelValues("foo")) == 10, "expect the buffered bytes gauge to hold the first record")
+
+	p.Start()
+	err = p.PutWithTimeout([]byte("world"), "world", time.Second)
+	assert(t, err == nil, "expect the record to be put once the first one is sent")
+	p.Stop()
+	assert(t, len(client.incoming[0]) == 1 && len(client.incoming[1]) == 1, "expect the records to be flushed one at a time")
+	assert(t, testutil.ToFloat64(p.metrics.bufferedBytes.WithLabelValues("foo")) == 0, "expect nothing to be buffered once stopped")
+}
+
+func TestRecordEncoder(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+		RecordEncoder: func(ctx context.Context, data []byte) ([]byte, error) {
+			id, ok := ctx.Value(contextKey("schema-id")).(byte)
+			if !ok {
+				return nil, errors.New("unknown schema")
+			}
+			return append([]byte{0, 0, 0, 0, id}, data...), nil
+		},
+	})
+	err := p.Put([]byte("hello"), "hello")
+	assert(t, err != nil && err.Error() == "unknown schema", "expect the encoder error to reject the record")
+	ctx := context.WithValue(context.Background(), contextKey("schema-id"), byte(7))
+	err = p.PutWithContext(ctx, []byte("world"), "world")
+	assert(t, err == nil, "should not return an error")
+
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1, "expect the encoded record only")
+	out, err := Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil, "should not return an error")
+	assert(t, string(out[0].Data) == "\x00\x00\x00\x00\x07world", "expect the record to be encoded")
+}
+
+func TestOnBacklogState(t *testing.T) {
+	states := make(chan BacklogState, 10)
+	p := New(&Config{
+		StreamName:     "foo",
+		BacklogCount:   5,
+		OnBacklogState: func(s BacklogState) { states <- s },
+		Client:         &clientMock{incoming: make(map[int][]string)},
+	})
+	go p.watchBacklog()
+	defer close(p.exited)
+	expect := func(s BacklogState) {
+		select {
+		case got := <-states:
+			assert(t, got == s, "expect the backlog to be "+s.String()+", got: "+got.String())
+		case <-time.After(time.Second):
+			t.Fatalf("expect the backlog to be %s", s)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		p.enqueue(&kinesisRecord{})
+	}
+	expect(BacklogWarning)
+	p.enqueue(&kinesisRecord{})
+	expect(BacklogFull)
+	p.Lock()
+	p.hold([]*kinesisRecord{{}})
+	p.Unlock()
+	<-p.records
+	p.backlogChanged()
+	time.Sleep(10 * time.Millisecond)
+	assert(t, len(states) == 0, "expect the backlog to stay full while records are held")
+	p.takeHeld()
+	for i := 0; i < 4; i++ {
+		<-p.records
+		p.backlogChanged()
+	}
+	expect(BacklogHealthy)
+	time.Sleep(10 * time.Millisecond)
+	assert(t, len(states) == 0, "expect a single call per transition")
+}
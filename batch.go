@@ -0,0 +1,95 @@
+package producer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// BatchInfo summarizes a batch of records about to be sent in a PutRecords request,
+// without their data.
+type BatchInfo struct {
+	StreamName string
+	// Reason the batch is sent for, e.g. "interval", "batch size" or "retry".
+	Reason string
+	// Records is the number of Kinesis records of the batch, and UserRecords the
+	// number of user records they carry.
+	Records     int
+	UserRecords int
+	// Bytes is the size of the data and partition keys of the Kinesis records.
+	Bytes int
+	// PartitionKeys of the Kinesis records, in order.
+	PartitionKeys []string
+	// entries of the batch, for hashing their data in `ManifestDigest`.
+	entries []*kinesis.PutRecordsRequestEntry
+}
+
+// BatchDigest is a compact summary of a batch, e.g. for audit logs, in place of the
+// partition keys of its Kinesis records.
+type BatchDigest struct {
+	Records     int
+	UserRecords int
+	Bytes       int
+	// Hash is the hex-encoded SHA-256 of the partition keys and data of the Kinesis
+	// records of the batch, in order, each prefixed by its length as a big-endian uint32.
+	Hash string
+}
+
+func (d BatchDigest) String() string {
+	return fmt.Sprintf("records=%d user_records=%d bytes=%d sha256=%s", d.Records, d.UserRecords, d.Bytes, d.Hash)
+}
+
+// ManifestDigest returns the digest of the batch, hashing the data of its Kinesis records
+// along with their partition keys. The data of a BatchInfo not handed over by the producer
+// is left out of the hash, as if empty.
+func (b BatchInfo) ManifestDigest() BatchDigest {
+	h := sha256.New()
+	var n [4]byte
+	write := func(b []byte) {
+		binary.BigEndian.PutUint32(n[:], uint32(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	for i, key := range b.PartitionKeys {
+		write([]byte(key))
+		var data []byte
+		if i < len(b.entries) {
+			data = b.entries[i].Data
+		}
+		write(data)
+	}
+	return BatchDigest{
+		Records:     b.Records,
+		UserRecords: b.UserRecords,
+		Bytes:       b.Bytes,
+		Hash:        hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+// Tracer traces the PutRecords requests of the producer, e.g. see the kpxray package.
+type Tracer interface {
+	// StartPutRecords is called before each PutRecords request, retries included, with
+	// the summary of its batch. It returns the function called once the request is done,
+	// with the number of records that failed, and the error of the request, if any.
+	StartPutRecords(info BatchInfo) (end func(failed int, err error))
+}
+
+// batchInfo returns the summary of the batch of records.
+func (p *Producer) batchInfo(records []*kinesisRecord, reason string) BatchInfo {
+	info := BatchInfo{
+		StreamName:    p.StreamName,
+		Reason:        reason,
+		Records:       len(records),
+		Bytes:         requestSize(records),
+		PartitionKeys: make([]string, len(records)),
+		entries:       entries(records),
+	}
+	for i, r := range records {
+		info.UserRecords += r.count
+		info.PartitionKeys[i] = *r.PartitionKey
+	}
+	return info
+}
@@ -0,0 +1,92 @@
+package producer
+
+import "sync"
+
+// byteBudget bounds the bytes of the user records buffered by the producer,
+// from the moment they are put until their PutRecords request is done.
+type byteBudget struct {
+	sync.Mutex
+	// max bytes buffered, or 0 for no limit.
+	max  int
+	used int
+	// freed is closed, and replaced, whenever some bytes are released.
+	freed chan struct{}
+}
+
+// acquire `n` bytes of the budget, waiting for them to be released if `block`
+// is set, or until `done` is closed. ErrBacklogFull is returned if it gives up.
+// A record is always admitted when nothing is buffered, however big it is.
+func (b *byteBudget) acquire(n int, block bool, done <-chan struct{}) error {
+	for {
+		b.Lock()
+		if b.max == 0 || b.used == 0 || b.used+n <= b.max {
+			b.used += n
+			b.Unlock()
+			return nil
+		}
+		if b.freed == nil {
+			b.freed = make(chan struct{})
+		}
+		freed := b.freed
+		b.Unlock()
+		if !block {
+			return ErrBacklogFull
+		}
+		select {
+		case <-freed:
+		case <-done:
+			return ErrBacklogFull
+		}
+	}
+}
+
+// release `n` bytes of the budget, waking up the records waiting for them.
+func (b *byteBudget) release(n int) {
+	if n == 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.used -= n
+	if b.freed != nil {
+		close(b.freed)
+		b.freed = nil
+	}
+}
+
+// buffered returns the number of bytes currently buffered.
+func (b *byteBudget) buffered() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.used
+}
+
+// acquireBytes acquires the `n` bytes of the user record out of the budget. A record
+// put while the producer is paused, without a deadline, doesn't wait for them.
+func (p *Producer) acquireBytes(r *userRecord, n int) error {
+	p.RLock()
+	block := !p.paused || r.done != nil
+	p.RUnlock()
+	if err := p.buffer.acquire(n, block, r.done); err != nil {
+		return err
+	}
+	p.metrics.bufferedBytes.WithLabelValues(p.MetricStreamLabel).Set(float64(p.buffer.buffered()))
+	return nil
+}
+
+// releaseBytes releases the `n` bytes of user records leaving the producer.
+func (p *Producer) releaseBytes(n int) {
+	if n == 0 {
+		return
+	}
+	p.buffer.release(n)
+	p.metrics.bufferedBytes.WithLabelValues(p.MetricStreamLabel).Set(float64(p.buffer.buffered()))
+}
+
+// userBytes returns the bytes of the user records carried by the records.
+func userBytes(records []*kinesisRecord) (n int) {
+	for _, r := range records {
+		n += r.userBytes
+	}
+	return
+}
@@ -0,0 +1,47 @@
+package producer
+
+import "sync"
+
+// defaultMetricCardinalityLimit is the default `Config.MetricCardinalityLimit`.
+const defaultMetricCardinalityLimit = 1000
+
+// labelTracker tracks the distinct values of the unbounded labels of the metrics,
+// by metric name, to warn once they exceed the cardinality limit.
+type labelTracker struct {
+	mu     sync.RWMutex
+	values map[string]map[string]struct{}
+}
+
+// track the label value of the metric, and warn if it is a new one beyond the limit.
+func (p *Producer) trackLabel(metric, value string) {
+	if p.MetricCardinalityLimit < 0 {
+		return
+	}
+	t := &p.labels
+	t.mu.RLock()
+	_, ok := t.values[metric][value]
+	t.mu.RUnlock()
+	if ok {
+		return
+	}
+	t.mu.Lock()
+	values := t.values[metric]
+	if values == nil {
+		if t.values == nil {
+			t.values = make(map[string]map[string]struct{})
+		}
+		values = make(map[string]struct{})
+		t.values[metric] = values
+	}
+	_, ok = values[value]
+	values[value] = struct{}{}
+	n := len(values)
+	t.mu.Unlock()
+	if ok || n <= p.MetricCardinalityLimit {
+		return
+	}
+	p.metrics.metricCardinalityWarningsCnt.WithLabelValues(p.MetricStreamLabel, metric).Inc()
+	if n == p.MetricCardinalityLimit+1 {
+		p.Logger.Info("metric cardinality limit exceeded", LogValue{"metric", metric}, LogValue{"limit", p.MetricCardinalityLimit})
+	}
+}
@@ -0,0 +1,111 @@
+package producer
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// CloseResult is the outcome of the records handed to a closed producer.
+type CloseResult struct {
+	// Produced and Failed are the numbers of user records produced, and
+	// failed, since the producer started, whoever the failures were handed to.
+	Produced int
+	Failed   int
+	// Failures are the failure records handed neither to `Config.FailureSink`
+	// nor to `NotifyFailures`, up to `Config.BacklogCount` of them. It is thus
+	// always empty when either is set, as the listener got the failures instead.
+	Failures []*FailureRecord
+}
+
+// Close stops the producer like `Stop`, and returns the outcome of all the records
+// handed to it. It gives up waiting for the producer to stop once `ctx` is done, and
+// then returns the outcome so far along with the context error. Closing an already
+// closed producer returns the same outcome right away.
+func (p *Producer) Close(ctx context.Context) (CloseResult, error) {
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return p.closeResult(), nil
+	case <-ctx.Done():
+		return p.closeResult(), ctx.Err()
+	}
+}
+
+// StopContext stops the producer gracefully like `Stop`, flushing the records handed to it
+// until `ctx` is done. It then returns the context error right away, and the records left,
+// or retried, are failed with it rather than sent, and handed over to the `FailureSink` or
+// the `NotifyFailures` channel, which is still closed once they all are. A PutRecords
+// request in flight is not canceled; `Config.RequestTimeout` bounds it.
+func (p *Producer) StopContext(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		p.abort(ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// abort fails the records left to flush with `err`.
+func (p *Producer) abort(err error) {
+	p.abortOnce.Do(func() {
+		p.abortCause = err
+		close(p.aborted)
+	})
+}
+
+// abortErr returns the error the records left to flush are failed with, if aborted.
+func (p *Producer) abortErr() error {
+	select {
+	case <-p.aborted:
+		return p.abortCause
+	default:
+		return nil
+	}
+}
+
+// sleep for the backoff `d` before retrying the records, unless aborted, or
+// until the deadline of the records if it comes first.
+func (p *Producer) sleep(d time.Duration, records []*kinesisRecord) {
+	if deadline := batchDeadline(records); !deadline.IsZero() {
+		if left := time.Until(deadline); left < d {
+			d = left
+		}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-p.aborted:
+	}
+}
+
+func (p *Producer) closeResult() CloseResult {
+	p.RLock()
+	defer p.RUnlock()
+	return CloseResult{
+		Produced: int(atomic.LoadInt64(&p.produced)),
+		Failed:   int(atomic.LoadInt64(&p.failed)),
+		Failures: append([]*FailureRecord(nil), p.kept...),
+	}
+}
+
+// keep the failure records handed to no listener, up to `Config.BacklogCount` of them.
+func (p *Producer) keep(failures []*FailureRecord) {
+	p.Lock()
+	defer p.Unlock()
+	if n := p.BacklogCount - len(p.kept); n < len(failures) {
+		failures = failures[:n]
+	}
+	p.kept = append(p.kept, failures...)
+}
@@ -0,0 +1,114 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestClose(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		AggregateBatchCount: 1,
+		Client: &clientMock{
+			incoming: make(map[int][]string),
+			responses: []responseMock{
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(1),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+							{ErrorCode: aws.String("InvalidArgumentException"), ErrorMessage: aws.String("error")},
+						},
+					},
+				},
+			},
+		},
+	})
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	res, err := p.Close(context.Background())
+	assert(t, err == nil, "should not return an error")
+	assert(t, res.Produced == 1 && res.Failed == 1, "expect the outcome of all the records")
+	assert(t, len(res.Failures) == 1 && res.Failures[0].PartitionKey == "world", "expect the failure records")
+
+	again, err := p.Close(context.Background())
+	assert(t, err == nil && again.Produced == 1 && again.Failed == 1, "expect closing twice to return the same outcome")
+
+	// a record whose user records can't be extracted is reported as a whole
+	p = New(&Config{StreamName: "foo", Client: &clientMock{incoming: make(map[int][]string)}})
+	record := &kinesisRecord{
+		PutRecordsRequestEntry: &k.PutRecordsRequestEntry{Data: []byte("corrupted"), PartitionKey: aws.String("hello")},
+		count:                  3,
+	}
+	p.dispatchFailures([]*kinesisRecord{record}, errors.New("failed"))
+	res = p.closeResult()
+	assert(t, res.Failed == 3 && len(res.Failures) == 1, "expect the failures to be counted in user records")
+}
+
+// throttledClient throttles every PutRecords request.
+type throttledClient struct{}
+
+func (throttledClient) PutRecords(*k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	return nil, awserr.New(k.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+}
+
+func TestStopContext(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		AggregateBatchCount: 1,
+		Client:              throttledClient{},
+	})
+	failures := p.NotifyFailures()
+	p.Start()
+	for _, key := range []string{"a", "b", "c"} {
+		p.Put([]byte("hello"), key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := p.StopContext(ctx)
+	assert(t, err == context.DeadlineExceeded, "should return the error of the context")
+
+	n := 0
+	for r := range failures {
+		assert(t, r.Error == context.DeadlineExceeded, "expect the records left to fail with the context error")
+		n++
+	}
+	assert(t, n == 3, "expect all the records left to be handed over as failures")
+
+	p = New(&Config{StreamName: "foo", Client: &successClient{}})
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	assert(t, p.StopContext(context.Background()) == nil, "should stop gracefully")
+	assert(t, p.Stats().Produced == 1, "expect the records to be flushed")
+}
+
+func TestDiscardOnStop(t *testing.T) {
+	client := &successClient{}
+	p := New(&Config{
+		StreamName:          "foo",
+		AggregateBatchCount: 1,
+		DiscardOnStop:       true,
+		Client:              client,
+	})
+	failures := p.NotifyFailures()
+	p.Start()
+	for _, key := range []string{"a", "b", "c"} {
+		p.Put([]byte("hello"), key)
+	}
+	p.Stop()
+
+	n := 0
+	for r := range failures {
+		assert(t, r.Error == ErrStoppedProducer, "expect the records to be discarded with ErrStoppedProducer")
+		n++
+	}
+	assert(t, n == 3 && len(client.keys) == 0, "expect the records to be discarded rather than sent")
+}
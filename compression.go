@@ -0,0 +1,103 @@
+package producer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/ouzi-dev/kinesis-producer/internal/zstd"
+)
+
+// Compression is the algorithm used for compressing the data of the user records.
+type Compression int
+
+const (
+	// CompressionNone leaves the data of the user records as is.
+	CompressionNone Compression = iota
+	// CompressionGzip compresses the data of the user records with gzip.
+	CompressionGzip
+	// CompressionZstd compresses the data of the user records with zstd.
+	CompressionZstd
+)
+
+// Codec is the compression of a user record put with `PutWithCodec`.
+type Codec = Compression
+
+// String returns the name of the compression, as stored in the record tags.
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// PutWithCodec `data` using `partitionKey` like `Put`, but compresses it with `codec`
+// rather than `Config.Compression`, regardless of `Config.CompressionMinSize`, e.g. to
+// leave already compressed data as is with CompressionNone, or to compress JSON with
+// CompressionZstd. Like with `Config.Compression`, the record is left as is when
+// compressing doesn't make it smaller, or when it is sent unaggregated.
+func (p *Producer) PutWithCodec(data []byte, partitionKey string, codec Codec) error {
+	if !codec.known() {
+		return fmt.Errorf("kinesis: unknown compression %s", codec)
+	}
+	if codec != CompressionNone && p.Framing != FramingKPL {
+		return errors.New("kinesis: Compression requires FramingKPL")
+	}
+	return p.put(&userRecord{data: data, partitionKey: partitionKey, compression: &codec})
+}
+
+// known reports whether the compression is one of the defined ones.
+func (c Compression) known() bool {
+	return c >= CompressionNone && c <= CompressionZstd
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// compress `data`, and return the tag flagging the user record as compressed.
+func compress(c Compression, data []byte) ([]byte, *Tag, error) {
+	var buf bytes.Buffer
+	switch c {
+	case CompressionGzip:
+		w := gzipWriterPool.Get().(*gzip.Writer)
+		defer gzipWriterPool.Put(w)
+		w.Reset(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, nil, err
+		}
+	case CompressionZstd:
+		buf.Write(zstd.Encode(nil, data))
+	default:
+		return nil, nil, fmt.Errorf("kinesis: unknown compression %s", c)
+	}
+	return buf.Bytes(), &Tag{Key: proto.String(tagCompression), Value: proto.String(c.String())}, nil
+}
+
+// decompress `data` compressed with the compression named `name`.
+func decompress(name string, data []byte) ([]byte, error) {
+	switch name {
+	case CompressionGzip.String():
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case CompressionZstd.String():
+		return ioutil.ReadAll(zstd.NewReader(bytes.NewReader(data)))
+	}
+	return nil, fmt.Errorf("kinesis: unknown compression %q", name)
+}
@@ -0,0 +1,120 @@
+package producer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestCompression(t *testing.T) {
+	p := New(&Config{
+		StreamName:         "foo",
+		Compression:        CompressionGzip,
+		CompressionMinSize: 100,
+		Client:             &clientMock{incoming: make(map[int][]string)},
+	})
+	large := bytes.Repeat([]byte("hello"), 100)
+	p.Put(large, "large")
+	p.Put([]byte("small"), "small")
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1, "expect a single aggregated record")
+	assert(t, len(records[0].Data) < len(large), "expect the large record to be compressed")
+
+	out, err := Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(out) == 2, "should return all the user records")
+	assert(t, bytes.Equal(out[0].Data, large), "expect the large record to be decompressed")
+	assert(t, string(out[1].Data) == "small", "expect the small record to be left as is")
+
+	failures := failureRecords(records, nil)
+	assert(t, bytes.Equal(failures[0].Data, large), "expect failure records to be decompressed")
+}
+
+func TestCompressionUnshared(t *testing.T) {
+	p := New(&Config{
+		StreamName:             "foo",
+		Compression:            CompressionGzip,
+		AggregateMinKeyRecords: 2,
+		Client:                 &clientMock{incoming: make(map[int][]string)},
+	})
+	large := bytes.Repeat([]byte("hello"), 100)
+	p.Put(large, "large")
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1 && !records[0].aggregated, "expect the unshared record to be sent unaggregated")
+	assert(t, bytes.Equal(records[0].Data, large), "expect the unaggregated record to be decompressed")
+}
+
+func TestPutWithCodec(t *testing.T) {
+	p := New(&Config{
+		StreamName:         "foo",
+		Compression:        CompressionGzip,
+		CompressionMinSize: 1000,
+		Client:             &clientMock{incoming: make(map[int][]string)},
+	})
+	json := bytes.Repeat([]byte(`{"hello":"world"}`), 10)
+	binary := bytes.Repeat([]byte("binary"), 100)
+	p.PutWithCodec(json, "json", CompressionGzip)
+	p.PutWithCodec(binary, "binary", CompressionNone)
+	err := p.PutWithCodec(binary, "binary", Compression(42))
+	assert(t, err != nil, "expect an unknown compression to be rejected")
+
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1, "expect a single aggregated record")
+	assert(t, len(records[0].Data) < len(json)+len(binary), "expect the json record to be compressed")
+	a := new(AggregatedRecord)
+	err = proto.Unmarshal(records[0].Data[len(magicNumber):len(records[0].Data)-md5.Size], a)
+	assert(t, err == nil, "should decode the aggregated record")
+	compressed := func(r *Record) bool {
+		for _, tag := range r.Tags {
+			if tag.GetKey() == tagCompression {
+				return true
+			}
+		}
+		return false
+	}
+	assert(t, compressed(a.Records[0]), "expect the json record to be flagged as compressed")
+	assert(t, !compressed(a.Records[1]), "expect the binary record to be left as is")
+
+	out, err := Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil, "should not return an error")
+	assert(t, bytes.Equal(out[0].Data, json) && bytes.Equal(out[1].Data, binary), "expect the records to be decompressed")
+}
+
+func TestZstdCompression(t *testing.T) {
+	p := New(&Config{
+		StreamName:  "foo",
+		Compression: CompressionZstd,
+		Client:      &clientMock{incoming: make(map[int][]string)},
+	})
+	json := bytes.Repeat([]byte(`{"hello":"world"}`), 100)
+	binary := bytes.Repeat([]byte("binary"), 100)
+	p.Put(json, "json")
+	p.PutWithCodec(binary, "binary", CompressionGzip)
+	p.PutWithCodec(binary, "none", CompressionNone)
+
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1, "expect a single aggregated record")
+	a := new(AggregatedRecord)
+	err := proto.Unmarshal(records[0].Data[len(magicNumber):len(records[0].Data)-md5.Size], a)
+	assert(t, err == nil, "should decode the aggregated record")
+	codec := func(r *Record) string {
+		for _, tag := range r.Tags {
+			if tag.GetKey() == tagCompression {
+				return tag.GetValue()
+			}
+		}
+		return ""
+	}
+	assert(t, codec(a.Records[0]) == "zstd" && len(a.Records[0].Data) < len(json), "expect the json record to be compressed with zstd")
+	assert(t, codec(a.Records[1]) == "gzip", "expect the codec of the record to override the config")
+	assert(t, codec(a.Records[2]) == "", "expect the record put with CompressionNone to be left as is")
+
+	out, err := Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil, "should not return an error")
+	assert(t, bytes.Equal(out[0].Data, json) && bytes.Equal(out[1].Data, binary) && bytes.Equal(out[2].Data, binary),
+		"expect the records to be decompressed")
+	failures := failureRecords(records, nil)
+	assert(t, bytes.Equal(failures[0].Data, json), "expect failure records to be decompressed")
+}
@@ -1,11 +1,14 @@
 package producer
 
 import (
+	"context"
 	"log"
 	"os"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/request"
 	k "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Constants and default configuration take from:
@@ -19,7 +22,27 @@ const (
 	defaultAggregationSize = 51200 // 50k
 	defaultMaxConnections  = 24
 	defaultFlushInterval   = 5 * time.Second
+	defaultIdleFlushDelay  = 10 * time.Millisecond
 	partitionKeyIndexSize  = 8
+	maxPartitionKeySize    = 256
+	defaultDedupeMaxKeys   = 100000
+	defaultStatsInterval   = 10 * time.Second
+	defaultProbeInterval   = time.Second
+	defaultBacklogWarning  = 0.8
+	defaultTeeStopTimeout  = 5 * time.Second
+)
+
+// Framing is the format used for packing many user records into a single Kinesis record.
+type Framing int
+
+const (
+	// FramingKPL packs the user records using the KPL aggregation format, that
+	// the KCL deaggregates. see: aggregation-format.md
+	FramingKPL Framing = iota
+	// FramingDelimited joins the data of the user records with `Config.Delimiter`,
+	// for consumers that can't deaggregate. The records carry no tags. A failed record
+	// is reported as a `FailureRecord` per user record, like an aggregated one.
+	FramingDelimited
 )
 
 // Putter is the interface that wraps the KinesisAPI.PutRecords method.
@@ -32,15 +55,55 @@ type Config struct {
 	// StreamName is the Kinesis stream.
 	StreamName string
 
+	// MetricStreamLabel is the value of the `stream` label of the metrics, e.g. the stream
+	// ARN to tell apart streams of the same name in different accounts. It does not change
+	// the stream records are put into. Default to `StreamName`.
+	MetricStreamLabel string
+
+	// ShardLabelFunc maps the shard IDs records are put into to the value of the `shard`
+	// label of the metrics, e.g. a logical shard grouping that survives resharding.
+	// Default to the shard ID itself.
+	ShardLabelFunc func(shardID string) string
+
 	// FlushInterval is a regular interval for flushing the buffer. Defaults to 5s.
 	FlushInterval time.Duration
 
+	// MinFlushInterval is the floor the flush interval shrinks toward as the backlog fills up,
+	// linearly with its depth, for the producer to flush more often, and drain the backlog,
+	// during bursts. The interval in use is exposed by the `effective_flush_interval_milliseconds`
+	// gauge. Defaults to 0, flushing at `FlushInterval` whatever the depth of the backlog.
+	MinFlushInterval time.Duration
+
+	// FlushCoalesceWindow rounds the flush intervals up to the boundaries of windows of this
+	// duration, aligned on the clock, so that the producers of many streams sharing the same
+	// window flush together, in fewer scattered requests, rather than on independent timers.
+	// The flushes are delayed by up to a window. Defaults to 0, not coalescing.
+	FlushCoalesceWindow time.Duration
+
 	// BatchCount determine the maximum number of items to pack in batch.
 	// Must not exceed length. Defaults to 500.
 	BatchCount int
 
-	// BatchSize determine the maximum number of bytes to send with a PutRecords request.
-	// Must not exceed 5MiB; Default to 5MiB.
+	// MinBatchCount determine the minimum number of items to gather before sending a batch
+	// on a flush interval. A smaller batch is sent anyway once its oldest item has been waiting
+	// for a whole `FlushInterval`. Must not exceed `BatchCount`. Defaults to 0.
+	MinBatchCount int
+
+	// EagerFlush sends the buffered records as soon as no new record was put for `IdleFlushDelay`,
+	// rather than waiting for the batch to fill up or for the `FlushInterval`. It lowers the
+	// latency of latency-sensitive streams, at the cost of more requests. Defaults to false.
+	EagerFlush bool
+
+	// IdleFlushDelay determine how long the producer waits for new records before an eager
+	// flush, after the last one was put, e.g. for the last partial aggregate of a stream going
+	// quiet not to wait for the `FlushInterval`. Setting it enables EagerFlush. Defaults to 10ms.
+	IdleFlushDelay time.Duration
+
+	// BatchSize determine the maximum number of bytes to send with a PutRecords request, i.e. the
+	// data and partition keys of its records, aggregated or not. It bounds the requests, whereas
+	// `AggregateBatchSize` bounds each of their records.
+	// Must be at least the record size limit, 1MiB (1000KiB with Firehose), and must not exceed
+	// 5MiB (4MiB with Firehose); Default to 5MiB (4MiB with Firehose).
 	BatchSize int
 
 	// AggregateBatchCount determine the maximum number of items to pack into an aggregated record.
@@ -48,22 +111,368 @@ type Config struct {
 
 	// AggregationBatchSize determine the maximum number of bytes to pack into an aggregated record. User records larger
 	// than this will bypass aggregation.
+	// An aggregated record is closed once the next user record would exceed it, so it is also the size the aggregated
+	// records target, e.g. 256KiB for consumers that process fixed-size aggregates.
+	// It bounds the serialized aggregated record, framing included. Must not exceed 1MiB, the record size
+	// limit (1000KiB with Firehose), part of which is kept for the partition key of the aggregated record
+	// when the limit counts it. Default to 50KiB.
 	AggregateBatchSize int
 
+	// AggregateFallbackThreshold is the number of aggregated records failing in a row, as rejected
+	// by Kinesis one by one rather than along with their whole request, after which
+	// the producer stops aggregating, and sends the user records unaggregated, as a safety valve
+	// e.g. against consumers that can't deaggregate. The fallback is signaled by the
+	// `aggregation_fallback_active` gauge, and lasts until `ResumeAggregation` is called.
+	// Defaults to 0, never falling back.
+	AggregateFallbackThreshold int
+
+	// AggregateMinKeyRecords is the minimum number of user records sharing a partition key in
+	// an aggregated record for them to be aggregated. The user records of the other partition
+	// keys are sent unaggregated, in the same batch, as aggregating them brings no benefit,
+	// but the ones put with a content type, debug flag or route, which are kept in the
+	// aggregate only. Default to 0, always aggregating.
+	AggregateMinKeyRecords int
+
+	// MaxKeysPerAggregate drains an aggregated record once its user records have that many
+	// distinct partition keys, bounding how many keys the single partition key of the
+	// aggregated record stands for, as observed by the `aggregate_distinct_keys` histogram.
+	// Default to 0, unlimited.
+	MaxKeysPerAggregate int
+
+	// AggregateSmallRecordSize is the size under which user records are aggregated regardless
+	// of `AggregateMinKeyRecords`, as tiny records are worth aggregating anyway. Default to 0.
+	AggregateSmallRecordSize int
+
+	// Framing is the format of the aggregated records. Default to FramingKPL.
+	Framing Framing
+
+	// Delimiter separates the user records of an aggregated record when using
+	// FramingDelimited. Default to a newline.
+	Delimiter []byte
+
+	// Compression determines the algorithm compressing the data of the user records aggregated
+	// with FramingKPL. Compressed records are flagged in their tags, and decompressed by
+	// `Deaggregate`. Records sent unaggregated are left as is. Default to CompressionNone.
+	Compression Compression
+
+	// CompressionMinSize determines the minimum data size in bytes of a user record to be
+	// compressed. The record is left as is anyway when compressing doesn't make it smaller.
+	// Default to 0.
+	CompressionMinSize int
+
+	// ChecksumScope determines the bytes covered by the MD5 checksum of the aggregated
+	// records. Only change it for third-party deaggregators computing it differently from
+	// the KCL. Default to ChecksumMessage, covering the serialized protobuf message only.
+	ChecksumScope ChecksumScope
+
+	// IncrementalChecksum is kept for compatibility, and has no effect: the user records
+	// aggregated with FramingKPL are always serialized, and their MD5 checksum computed,
+	// as they are put, keeping the partition keys table ahead of the records, unless
+	// MarshalWorkers is set. The aggregates holding records put with `PutWithOrdering`
+	// are serialized once drained, as their records are sorted then.
+	//
+	// Deprecated: the incremental serialization is the default.
+	IncrementalChecksum bool
+
+	// MarshalWorkers is the number of goroutines marshaling the aggregated records with
+	// FramingKPL in parallel, once drained, rather than serializing the user records as
+	// they are put, while the lock of the producer is held. The records are still sent
+	// in the order they were drained. Defaults to 0, serializing the user records as they
+	// are put.
+	MarshalWorkers int
+
+	// AutoPartitionKey gives the user records put with an empty partition key, which Kinesis
+	// rejects, a random one (a UUID), for the call sites that don't care about the key. The
+	// records then spread over the shards. Otherwise, `Put` returns ErrEmptyPartitionKey for
+	// them. Default to false.
+	AutoPartitionKey bool
+
+	// TrackKeyDistribution counts the partition keys the user records are put with, in a
+	// sketch of the 1024 most frequent ones, returned by `TopKeys`, to detect key skew and
+	// diagnose hot shards from the producer. Default to false.
+	TrackKeyDistribution bool
+
+	// AggregateIDFunc generates the unique IDs of the aggregated records, for tracing and
+	// auditing them. An ID is stored in a tag along with the first user record of its
+	// aggregated record, returned by `Deaggregate` as its `AggregateID`, and in the `PutResult`
+	// of the aggregated record. An empty ID is not stored, and IDs are not stored with
+	// FramingDelimited. Default to monotonic ULIDs.
+	AggregateIDFunc func() string
+
+	// AggregateKeyFunc picks the partition key an aggregated record is put with, and thus its
+	// shard, out of the distinct partition keys of its user records, in order of appearance.
+	// It may also derive a new key from them. The user records keep their own partition keys.
+	// See `RandomAggregateKey` and `RoundRobinAggregateKeys` for spreading the aggregated
+	// records evenly over the shards. An empty key, or one longer than 256 bytes, falls back
+	// to the first key. Default to the first key.
+	AggregateKeyFunc func(keys []string) string
+
+	// AggregateKeyGroupFunc maps the partition key of a user record to the group it is
+	// aggregated in, so that each aggregated record only carries the user records of a
+	// single group, e.g. hashing the keys into as many buckets as there are shards. The
+	// records of a partition key keep their order, as they always share their group, but
+	// the groups are drained independently, so records of different groups may be sent
+	// in any order. Default to a single group.
+	AggregateKeyGroupFunc func(partitionKey string) string
+
+	// MaxUserRecordsPerRequest determines the maximum number of user records carried by the
+	// Kinesis records of a PutRecords request, flushing the batch earlier, to bound the memory
+	// of the consumers deaggregating them. A Kinesis record carrying more user records is sent
+	// on its own. Default to 0, unlimited.
+	MaxUserRecordsPerRequest int
+
 	// BacklogCount determines the channel capacity before Put() will begin blocking. Default to `BatchCount`.
 	BacklogCount int
 
+	// MaxBufferedBytes determines the maximum number of bytes of user records, data and
+	// partition keys, buffered by the producer across the aggregators and the backlog until
+	// they are sent. Put blocks, or fails with ErrBacklogFull like on a full backlog, until
+	// enough bytes are sent. Default to 0, unlimited.
+	MaxBufferedBytes int
+
+	// TotalOrder delivers the user records in the exact order they are put, across the Kinesis
+	// records carrying them, for total-order consumers: all Kinesis records are put with the
+	// same explicit hash key, and thus into a single shard, the one of the lowest hash key,
+	// while the user records keep their partition keys. The records are sent one Kinesis
+	// record per PutRecords request, one request at a time, so that a retry never reorders
+	// them, in a single aggregate, whatever their route. This severely limits the throughput,
+	// to a single request in flight, within the limits of a single shard. Records put with
+	// `PutWithPriority`, or flushed with `FlushKey`, may still jump ahead. Default to false.
+	TotalOrder bool
+
+	// MaxRecordsPerSecond bounds the rate of the user records put, e.g. to match the record
+	// rate limit of a downstream, with a token bucket allowing bursts of a second worth of
+	// records. Put blocks, or fails with ErrBacklogFull like on a full backlog, until it is
+	// admitted; the time waited is observed by the `throttle_wait_milliseconds` histogram.
+	// Default to 0, unlimited.
+	MaxRecordsPerSecond int
+
+	// OverflowStore, when set, keeps the user records that don't fit in the backlog, or in
+	// `MaxBufferedBytes`, rather than blocking `Put` or failing it with ErrBacklogFull. They
+	// are replayed, in order, as the backlog frees up, and the records put meanwhile are
+	// spilled after them. The records left in the store when the producer stops are replayed
+	// by the next one started with it, e.g. with a FileOverflowStore. Records with a future,
+	// context values or a compression of their own are never spilled. Default to none.
+	OverflowStore OverflowStore
+
+	// RecordEncoder, when set, encodes the data of each user record when it is put, before
+	// it is validated, e.g. prepending the ID of its schema in a schema registry. It is
+	// called with the context the record is put with, or the background one. An error
+	// rejects the record, and is returned by `Put`. Default to none.
+	RecordEncoder func(ctx context.Context, data []byte) ([]byte, error)
+
+	// DedupeWindow determines how long the dedupe key of a user record is remembered, to
+	// drop the records put with the same key meanwhile. The futures of the dropped records
+	// are resolved without a sequence number. Default to 0, no deduplication.
+	DedupeWindow time.Duration
+
+	// DedupeKeyFunc returns the dedupe key of the data of a user record. Default to the
+	// MD5 checksum of the data, dropping the exact duplicates.
+	DedupeKeyFunc func(data []byte) string
+
+	// DedupeMaxKeys determines the maximum number of dedupe keys remembered, forgetting
+	// the oldest ones first, to bound the memory used. Default to 100000.
+	DedupeMaxKeys int
+
 	// Number of requests to sent concurrently. Default to 24.
 	MaxConnections int
 
 	// Logger is the logger used. Default to producer.Logger.
 	Logger Logger
 
+	// RecordTimestamps stores the time each user record was handed to `Put` in the
+	// aggregated record, as a millisecond timestamp tag read back by `Deaggregate`.
+	// Records that bypass aggregation carry no timestamp. Default to false.
+	RecordTimestamps bool
+
 	// Enabling verbose logging. Default to false.
 	Verbose bool
 
-	// Client is the Putter interface implementation.
+	// MetricBuckets overrides the buckets of the histogram metrics, by metric name
+	// (e.g. "retries_per_record"). Default to the buckets of each metric.
+	MetricBuckets map[string][]float64
+
+	// MetricNamespace and MetricSubsystem prefix the names of the metrics, as in
+	// `namespace_subsystem_user_records_put_total`, e.g. to fit them into an existing naming
+	// scheme. MetricSubsystem defaults to "go_kinesis_producer", and MetricNamespace to none.
+	MetricNamespace string
+	MetricSubsystem string
+
+	// DisabledMetrics are the names of the metrics not registered in Prometheus, e.g.
+	// "request_time_by_code_milliseconds" for keeping the cardinality low. Default to none.
+	DisabledMetrics []string
+
+	// Registerers are the Prometheus registries the metrics are registered in, e.g. both a
+	// local registry and one pushed to a gateway. The metrics are shared: each registry sees
+	// the same values, recorded once. Default to `prometheus.DefaultRegisterer`.
+	Registerers []prometheus.Registerer
+
+	// MetricCardinalityLimit is the number of distinct values of the `shard` label, e.g. on
+	// streams of thousands of shards, beyond which every new one counts in the
+	// `metric_cardinality_warnings_total` counter, and is logged the first time, before the
+	// cardinality overwhelms Prometheus. See `ShardLabelFunc` and `DisabledMetrics` for
+	// lowering it. Defaults to 1000; a negative limit disables the tracking.
+	MetricCardinalityLimit int
+
+	// DiscardOnStop makes `Stop` fast, e.g. on crash recovery or when the stream is known to be
+	// unhealthy: rather than flushing them, the records left in the producer are discarded, and
+	// handed over as failures with ErrStoppedProducer, to the `FailureSink` or the
+	// `NotifyFailures` channel. The PutRecords requests in flight are not canceled, but not
+	// retried. Default to false, draining the records on `Stop`.
+	DiscardOnStop bool
+
+	// RequestTimeout bounds the time a PutRecords request may take, for a hung connection
+	// not to stall a connection slot. A timed out request fails with a retryable "Timeout"
+	// error code, counted in the errors by code. Clients implementing PutRecordsWithContext,
+	// as the SDK ones do, cancel the request; others are left running in the background.
+	// Defaults to 0, no timeout.
+	RequestTimeout time.Duration
+
+	// RequestOptions are applied to each PutRecords request, e.g. adding handlers to it for
+	// custom headers, logging or retries, as the middleware of the SDK. The Client must then
+	// implement PutRecordsWithContext, as the SDK ones do. They are the aws-sdk-go (v1)
+	// counterpart of the `APIOptions` of aws-sdk-go-v2, whose middleware stack this producer
+	// doesn't take, as it has no v2 client adapter: v2 middleware has to be ported to v1
+	// handlers. Default to none.
+	RequestOptions []request.Option
+
+	// Client is the Putter interface implementation. Use a `FirehosePutter` for
+	// delivering to Kinesis Data Firehose.
 	Client Putter
+
+	// Tee, when set, receives a copy of each PutRecords request, without its retries, e.g.
+	// for writing to a second stream during a migration, put into TeeStreamName, which
+	// defaults to StreamName. The copies are sent in the background, one at a time, and
+	// dropped when TeeMaxBufferedBytes of records, data and partition keys, or `BacklogCount`
+	// copies, are waiting, as counted by the `tee_requests_dropped_total` counter, so that
+	// the tee never stalls the producer. Its failures are logged, not reported as failures
+	// of the records. `Stop` waits up to TeeStopTimeout for the copies waiting to be sent,
+	// and drops the ones left. The records handed to a `Dispatcher` are not mirrored.
+	// Default to none. TeeMaxBufferedBytes defaults to BatchSize, and TeeStopTimeout to
+	// `RequestTimeout`, or 5s without it.
+	Tee                 Putter
+	TeeStreamName       string
+	TeeMaxBufferedBytes int
+	TeeStopTimeout      time.Duration
+
+	// RetryableErrorFunc reports whether an error, either of a whole PutRecords request or of
+	// one of its records, is worth retrying. Records failing with other errors are reported as
+	// failures. Default to `IsRetryableError`.
+	RetryableErrorFunc func(error) bool
+
+	// RetryPolicies bound the retries of the records failing with retryable errors, by error
+	// code, e.g. "InternalFailure", or else by class of error code: RetryClassThrottling,
+	// RetryClassInternal or RetryClassOther. Default to none, retrying the records until they
+	// succeed, with a backoff from 100ms up to 10s.
+	RetryPolicies map[string]RetryPolicy
+
+	// OnRetry is called before each retry of the failed records of a batch, once per error
+	// code, with the retry attempt number (starting at 1), the error code and the number of
+	// records retried because of it.
+	OnRetry func(attempt int, code string, records int)
+
+	// OnBatchAssembled is called synchronously before each PutRecords request, retries
+	// included, with the summary of its batch. An error aborts the request, and reports
+	// the records of the batch as failures with it. The batches split to fit BatchSize
+	// or BatchCount are sent with the "batch size" and "batch length" reasons.
+	OnBatchAssembled func(BatchInfo) error
+
+	// OnStats is called with a snapshot of the `Stats` of the producer every StatsInterval,
+	// in its own goroutine, from `Start` until the producer is stopped, e.g. for pushing them
+	// to systems that don't scrape. StatsInterval defaults to 10s.
+	OnStats       func(Stats)
+	StatsInterval time.Duration
+
+	// OnBacklogState is called when the backlog moves between the BacklogHealthy,
+	// BacklogWarning and BacklogFull states, e.g. for driving autoscaling or load shedding.
+	// The backlog is in warning once BacklogWarningLevel of `BacklogCount` is used, and full
+	// when it can't take any more records. Its state is updated as records are enqueued
+	// and dequeued, and the changes are handed over to the callback in its own goroutine,
+	// from `Start` until the producer is stopped, so that the callback never slows down the
+	// producer. Changes happening faster than the callback returns are coalesced into the
+	// latest state. BacklogWarningLevel defaults to 0.8.
+	OnBacklogState      func(BacklogState)
+	BacklogWarningLevel float64
+
+	// Tracer, when set, traces each PutRecords request. Default to none.
+	Tracer Tracer
+
+	// Dispatcher, when set, batches and sends the Kinesis records in place of the built-in
+	// batching, which is the default dispatcher. The producer then only aggregates them, and
+	// hands them over as the aggregators are drained: at every FlushInterval, when idle with
+	// EagerFlush, and on `Flush` and `FlushKey`. BatchSize, BatchCount, MinBatchCount and the
+	// settings of the requests, e.g. MaxConnections, retries and per-request hooks, are the
+	// dispatcher's business. Default to the built-in batching.
+	Dispatcher Dispatcher
+
+	// CredentialRefresher is called when a PutRecords request fails because the credentials
+	// of the client expired (e.g. `ExpiredTokenException` with STS credentials). It returns
+	// the client to use from then on, e.g. one built from a new session, or `Client` itself
+	// once its credentials are re-fetched, e.g. by calling `Expire` on them. The client is
+	// swapped in, and the records are retried instead of being reported as failures, unless
+	// it returns an error. The client should implement the same interfaces as `Client`.
+	CredentialRefresher func() (Putter, error)
+
+	// CreateStreamIfNotExists creates the stream on `Start` if it does not exist, and waits
+	// for it to become ACTIVE before producing. Intended for development and test environments
+	// only; don't use it in production. Requires `Client` to implement `StreamManager`.
+	// Default to false.
+	CreateStreamIfNotExists bool
+
+	// ShardCount is the number of shards of the stream created by `CreateStreamIfNotExists`.
+	// Default to 1.
+	ShardCount int
+
+	// VerifyStreamOnStart checks on `Start` that the stream exists and is ACTIVE, and logs
+	// an error otherwise, for a fast feedback rather than failing on the first flush.
+	// Requires `Client` to implement DescribeStreamSummary. Default to false.
+	VerifyStreamOnStart bool
+
+	// WarmUp issues a DescribeStreamSummary request on `Start` to set up the DNS and TLS
+	// connections of the client before the first records are sent, smoothing the latency
+	// of the first PutRecords request. Skipped when `Client` does not implement
+	// DescribeStreamSummary. Default to false.
+	WarmUp bool
+
+	// ProbePartitionKey, when set, makes `Probe` put a tiny record under this key rather
+	// than describe the stream, for clients without DescribeStreamSummary, or credentials
+	// only allowed to write, and makes `StartAndWait` put it until one succeeds. The consumers
+	// of the stream see these probe records. Default to none, describing the stream.
+	ProbePartitionKey string
+
+	// ProbeInterval is the minimum interval between two requests issued by `Probe`; the
+	// probes in between return the result of the last one. Default to 1s.
+	ProbeInterval time.Duration
+
+	// FailureChannelSize determines the capacity of the channel returned by `NotifyFailures`.
+	// When set, a full channel drops its oldest failure records rather than blocking the
+	// producer, and counts them in the `failures_dropped_total` metric. Default to
+	// `BacklogCount`, blocking the producer until the failures are read.
+	FailureChannelSize int
+
+	// ContextFields are the keys of the context values kept along with the records put with
+	// `PutWithContext`, and handed over in the `ContextValues` of their failure records,
+	// e.g. for correlating a failure with the request it originates from. Default to none.
+	ContextFields []interface{}
+
+	// FailureSink, when set, receives undeliverable records in batches instead of
+	// the channel returned by `NotifyFailures`, which is then never written to.
+	// It is called from the flushing goroutine, so it should hand the records off
+	// quickly (e.g. to a backup store) rather than block the producer.
+	FailureSink func([]*FailureRecord)
+
+	// FailureTransformer, when set, is applied to each undeliverable record before it is
+	// handed over to the `FailureSink` or the `NotifyFailures` channel, e.g. for enriching
+	// or redacting it. The record is dropped if it returns nil. It is called from the
+	// flushing goroutine.
+	FailureTransformer func(*FailureRecord) *FailureRecord
+
+	// recordSizeLimit is the maximum size of a record accepted by the backend,
+	// and keyCounted is true if the partition key counts toward it.
+	recordSizeLimit int
+	keyCounted      bool
+	// requestSizeLimit is the maximum size of a request accepted by the backend.
+	requestSizeLimit int
 }
 
 // defaults for configuration
@@ -71,14 +480,32 @@ func (c *Config) defaults() {
 	if c.Logger == nil {
 		c.Logger = &StdLogger{log.New(os.Stdout, "", log.LstdFlags)}
 	}
+	if c.TotalOrder {
+		falseOrPanic(c.AggregateKeyGroupFunc != nil, "kinesis: AggregateKeyGroupFunc can't be used with TotalOrder")
+		c.BatchCount, c.MaxConnections = 1, 1
+		c.MinBatchCount, c.AggregateMinKeyRecords = 0, 0
+	}
 	if c.BatchCount == 0 {
 		c.BatchCount = maxRecordsPerRequest
 	}
 	falseOrPanic(c.BatchCount > maxRecordsPerRequest, "kinesis: BatchCount exceeds 500")
+	falseOrPanic(c.MinBatchCount > c.BatchCount, "kinesis: MinBatchCount exceeds BatchCount")
+	_, isFirehose := c.Client.(*FirehosePutter)
+	// Kinesis counts the partition key toward the record size, but
+	// Firehose records have no partition key.
+	c.recordSizeLimit, c.keyCounted, c.requestSizeLimit = maxRecordSize, true, maxRequestSize
+	if isFirehose {
+		c.recordSizeLimit, c.keyCounted, c.requestSizeLimit = firehoseMaxRecordSize, false, firehoseMaxRequestSize
+	}
 	if c.BatchSize == 0 {
 		c.BatchSize = maxRequestSize
+		if isFirehose {
+			c.BatchSize = firehoseMaxRequestSize
+		}
 	}
 	falseOrPanic(c.BatchSize > maxRequestSize, "kinesis: BatchSize exceeds 5MiB")
+	falseOrPanic(isFirehose && c.BatchSize > firehoseMaxRequestSize, "kinesis: BatchSize exceeds 4MiB with Firehose")
+	falseOrPanic(c.BatchSize < c.recordSizeLimit, "kinesis: BatchSize is below the record size limit")
 	if c.BacklogCount == 0 {
 		c.BacklogCount = maxRecordsPerRequest
 	}
@@ -89,15 +516,118 @@ func (c *Config) defaults() {
 	if c.AggregateBatchSize == 0 {
 		c.AggregateBatchSize = defaultAggregationSize
 	}
-	falseOrPanic(c.AggregateBatchSize > maxAggregationSize, "kinesis: AggregateBatchSize exceeds 50KB")
+	falseOrPanic(c.AggregateBatchSize > maxAggregationSize, "kinesis: AggregateBatchSize exceeds 1MiB")
+	falseOrPanic(c.AggregateBatchSize > c.recordSizeLimit, "kinesis: AggregateBatchSize exceeds 1000KiB with Firehose")
+	falseOrPanic(c.Framing != FramingKPL && c.Framing != FramingDelimited, "kinesis: Framing is unknown")
+	falseOrPanic(!c.Compression.known(), "kinesis: Compression is unknown")
+	falseOrPanic(c.Compression != CompressionNone && c.Framing != FramingKPL, "kinesis: Compression requires FramingKPL")
+	falseOrPanic(c.CompressionMinSize < 0, "kinesis: CompressionMinSize must not be negative")
+	if c.Framing == FramingDelimited && len(c.Delimiter) == 0 {
+		c.Delimiter = []byte("\n")
+	}
 	if c.MaxConnections == 0 {
 		c.MaxConnections = defaultMaxConnections
 	}
 	falseOrPanic(c.MaxConnections < 1 || c.MaxConnections > 256, "kinesis: MaxConnections must be between 1 and 256")
+	falseOrPanic(c.FailureChannelSize < 0, "kinesis: FailureChannelSize must not be negative")
+	falseOrPanic(c.MaxBufferedBytes < 0, "kinesis: MaxBufferedBytes must not be negative")
+	falseOrPanic(c.MaxUserRecordsPerRequest < 0, "kinesis: MaxUserRecordsPerRequest must not be negative")
+	falseOrPanic(c.DedupeWindow < 0, "kinesis: DedupeWindow must not be negative")
+	if c.DedupeWindow > 0 {
+		if c.DedupeKeyFunc == nil {
+			c.DedupeKeyFunc = dedupeKey
+		}
+		if c.DedupeMaxKeys == 0 {
+			c.DedupeMaxKeys = defaultDedupeMaxKeys
+		}
+		falseOrPanic(c.DedupeMaxKeys < 1, "kinesis: DedupeMaxKeys must be at least 1")
+	}
+	if c.MetricCardinalityLimit == 0 {
+		c.MetricCardinalityLimit = defaultMetricCardinalityLimit
+	}
+	if c.AggregateIDFunc == nil {
+		c.AggregateIDFunc = newULIDFunc()
+	}
+	if c.ShardLabelFunc == nil {
+		c.ShardLabelFunc = func(shardID string) string { return shardID }
+	}
+	if c.RetryableErrorFunc == nil {
+		c.RetryableErrorFunc = IsRetryableError
+	}
 	if c.FlushInterval == 0 {
 		c.FlushInterval = defaultFlushInterval
 	}
+	falseOrPanic(c.AggregateFallbackThreshold < 0, "kinesis: AggregateFallbackThreshold must not be negative")
+	falseOrPanic(c.MaxKeysPerAggregate < 0, "kinesis: MaxKeysPerAggregate must not be negative")
+	falseOrPanic(c.MaxRecordsPerSecond < 0, "kinesis: MaxRecordsPerSecond must not be negative")
+	falseOrPanic(c.MarshalWorkers < 0, "kinesis: MarshalWorkers must not be negative")
+	falseOrPanic(c.RequestTimeout < 0, "kinesis: RequestTimeout must not be negative")
+	falseOrPanic(c.MinFlushInterval < 0, "kinesis: MinFlushInterval must not be negative")
+	falseOrPanic(c.MinFlushInterval > c.FlushInterval, "kinesis: MinFlushInterval must not exceed FlushInterval")
+	falseOrPanic(c.FlushCoalesceWindow < 0, "kinesis: FlushCoalesceWindow must not be negative")
+	if c.EagerFlush && c.IdleFlushDelay == 0 {
+		c.IdleFlushDelay = defaultIdleFlushDelay
+	}
+	if c.IdleFlushDelay > 0 {
+		c.EagerFlush = true
+	}
+	if c.OnStats != nil && c.StatsInterval == 0 {
+		c.StatsInterval = defaultStatsInterval
+	}
+	falseOrPanic(c.StatsInterval < 0, "kinesis: StatsInterval must not be negative")
+	if c.OnBacklogState != nil {
+		if c.BacklogWarningLevel == 0 {
+			c.BacklogWarningLevel = defaultBacklogWarning
+		}
+	}
+	falseOrPanic(c.BacklogWarningLevel < 0 || c.BacklogWarningLevel > 1, "kinesis: BacklogWarningLevel must be between 0 and 1")
+	if c.ProbeInterval == 0 {
+		c.ProbeInterval = defaultProbeInterval
+	}
+	falseOrPanic(c.ProbeInterval < 0, "kinesis: ProbeInterval must not be negative")
+	falseOrPanic(c.IdleFlushDelay < 0, "kinesis: IdleFlushDelay must not be negative")
 	falseOrPanic(len(c.StreamName) == 0, "kinesis: StreamName length must be at least 1")
+	if len(c.Registerers) == 0 {
+		c.Registerers = []prometheus.Registerer{prometheus.DefaultRegisterer}
+	}
+	if c.MetricSubsystem == "" {
+		c.MetricSubsystem = defaultMetricSubsystem
+	}
+	if c.Tee != nil {
+		if c.TeeStreamName == "" {
+			c.TeeStreamName = c.StreamName
+		}
+		if c.TeeMaxBufferedBytes == 0 {
+			c.TeeMaxBufferedBytes = c.BatchSize
+		}
+		if c.TeeStopTimeout == 0 {
+			c.TeeStopTimeout = c.RequestTimeout
+		}
+		if c.TeeStopTimeout == 0 {
+			c.TeeStopTimeout = defaultTeeStopTimeout
+		}
+	}
+	falseOrPanic(c.TeeMaxBufferedBytes < 0, "kinesis: TeeMaxBufferedBytes must not be negative")
+	falseOrPanic(c.TeeStopTimeout < 0, "kinesis: TeeStopTimeout must not be negative")
+	if c.MetricStreamLabel == "" {
+		c.MetricStreamLabel = c.StreamName
+	}
+	if len(c.RequestOptions) > 0 {
+		_, ok := c.Client.(contextPutter)
+		falseOrPanic(!ok, "kinesis: Client must implement PutRecordsWithContext to apply the RequestOptions")
+	}
+	if c.VerifyStreamOnStart {
+		_, ok := c.Client.(streamDescriber)
+		falseOrPanic(!ok, "kinesis: Client must implement DescribeStreamSummary to verify the stream")
+	}
+	if c.CreateStreamIfNotExists {
+		_, ok := c.Client.(StreamManager)
+		falseOrPanic(!ok, "kinesis: Client must implement StreamManager to create the stream")
+		if c.ShardCount == 0 {
+			c.ShardCount = 1
+		}
+		falseOrPanic(c.ShardCount < 1, "kinesis: ShardCount must be at least 1")
+	}
 }
 
 func falseOrPanic(p bool, msg string) {
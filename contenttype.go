@@ -0,0 +1,33 @@
+package producer
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ErrContentTypeUnaggregated is returned for the records put with `PutWithContentType`
+// that would be sent unaggregated, as the content type is stored in the aggregate.
+var ErrContentTypeUnaggregated = errors.New("Unable to Put record. Content type requires the record to be aggregated")
+
+// PutWithContentType `data` using `partitionKey` like `Put`, but stores the content type
+// of the data, e.g. "application/json" or "application/x-protobuf", along with the user
+// record, for the consumers of a stream carrying many formats to tell them apart without
+// sniffing the data. It is returned by `Deaggregate` as `ContentType`, and counts toward
+// the size of the aggregated record. It returns ErrContentTypeUnaggregated, rather than
+// dropping the content type, if the record is too large to be aggregated, or aggregation
+// fell back, see `Config.AggregateFallbackThreshold`.
+func (p *Producer) PutWithContentType(data []byte, partitionKey, contentType string) error {
+	if p.Framing != FramingKPL {
+		return errors.New("kinesis: PutWithContentType requires FramingKPL")
+	}
+	return p.put(&userRecord{data: data, partitionKey: partitionKey, contentType: contentType})
+}
+
+// contentTypeTag returns the tag storing the content type of a user record.
+func contentTypeTag(contentType string) *Tag {
+	return &Tag{
+		Key:   proto.String(tagContentType),
+		Value: proto.String(contentType),
+	}
+}
@@ -0,0 +1,61 @@
+package producer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPutWithContentType(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+	})
+	p.PutWithContentType([]byte(`{"hello":"world"}`), "hello", "application/json")
+	p.Put([]byte("world"), "world")
+	size := p.aggregator.Size()
+	p.PutWithContentType([]byte("\x0a\x05hello"), "hello", "application/x-protobuf")
+	assert(t, p.aggregator.Size()-size > len("\x0a\x05hello")+len("application/x-protobuf"), "expect the content type to count toward the size")
+
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1, "expect a single aggregated record")
+	out, err := Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(out) == 3, "expect the records to be deaggregated")
+	assert(t, out[0].ContentType == "application/json", "expect the content type of the first record")
+	assert(t, out[1].ContentType == "", "expect no content type for the plain record")
+	assert(t, out[2].ContentType == "application/x-protobuf", "expect the content type of the last record")
+
+	p = New(&Config{
+		StreamName: "foo",
+		Framing:    FramingDelimited,
+		Client:     &clientMock{incoming: make(map[int][]string)},
+	})
+	assert(t, p.PutWithContentType([]byte("hello"), "hello", "text/plain") != nil, "expect the content type to require FramingKPL")
+
+	p = New(&Config{
+		StreamName:         "foo",
+		AggregateBatchSize: 100,
+		Client:             &clientMock{incoming: make(map[int][]string)},
+	})
+	err = p.PutWithContentType(bytes.Repeat([]byte("a"), 200), "hello", "text/plain")
+	assert(t, err == ErrContentTypeUnaggregated, "expect a record too large to be aggregated to be rejected")
+	assert(t, len(p.records) == 0, "expect the rejected record not to be sent")
+}
+
+func TestContentTypeUnshared(t *testing.T) {
+	p := New(&Config{
+		StreamName:             "foo",
+		AggregateMinKeyRecords: 2,
+		Client:                 &clientMock{incoming: make(map[int][]string)},
+	})
+	data := bytes.Repeat([]byte("a"), 500)
+	p.PutWithContentType(data, "typed", "text/plain")
+	p.Put(data, "plain")
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 2, "expect an unaggregated and an aggregated record")
+	assert(t, !records[0].aggregated && *records[0].PartitionKey == "plain", "expect the plain record under a single-use key to be sent unaggregated")
+	assert(t, records[1].aggregated, "expect the content-typed record under a single-use key to stay aggregated")
+	out, err := Deaggregate(records[1].Data, *records[1].PartitionKey)
+	assert(t, err == nil && len(out) == 1, "should deaggregate the content-typed record")
+	assert(t, out[0].ContentType == "text/plain" && *records[1].PartitionKey == "typed", "expect the content type to be kept")
+}
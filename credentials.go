@@ -0,0 +1,51 @@
+package producer
+
+import "errors"
+
+// maxCredentialRefreshes is the number of consecutive credential refreshes
+// attempted for a batch before its records are reported as failures.
+const maxCredentialRefreshes = 3
+
+// credentialErrorCodes are the AWS error codes returned when the credentials
+// of the client are expired or no longer valid.
+var credentialErrorCodes = map[string]bool{
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+	"RequestExpired":        true,
+	"NoCredentialProviders": true,
+}
+
+// isCredentialError reports whether `err` was caused by expired credentials.
+func isCredentialError(err error) bool {
+	return credentialErrorCodes[errorCode(err)]
+}
+
+// refreshCredentials calls the `CredentialRefresher`, if any, after the
+// credential error `err`, swaps its client in, and reports whether the request
+// can be retried.
+func (p *Producer) refreshCredentials(err error) bool {
+	p.Logger.Error("credentials expired", err, LogValue{"code", errorCode(err)})
+	if p.CredentialRefresher == nil {
+		return false
+	}
+	client, err := p.CredentialRefresher()
+	if err == nil && client == nil {
+		err = errors.New("kinesis: CredentialRefresher returned no client")
+	}
+	if err != nil {
+		p.Logger.Error("refresh credentials", err)
+		return false
+	}
+	p.clientMu.Lock()
+	p.Client = client
+	p.clientMu.Unlock()
+	return true
+}
+
+// client returns the current client of the producer, as swapped in by
+// `CredentialRefresher`.
+func (p *Producer) client() Putter {
+	p.clientMu.RLock()
+	defer p.clientMu.RUnlock()
+	return p.Client
+}
@@ -0,0 +1,67 @@
+package producer
+
+import (
+	"context"
+	"time"
+)
+
+// PutWithDeadline `data` using `partitionKey` like `Put`, but gives up on the record once
+// `deadline` passes: it waits for the backlog until then, returning `ErrBacklogFull`, and
+// the record is no longer retried past it, but failed with `ErrDeadlineExceeded`. As the
+// user records of an aggregated record are sent together, they are retried until the
+// latest of their deadlines, and as long as any of them has none.
+func (p *Producer) PutWithDeadline(data []byte, partitionKey string, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return p.put(&userRecord{data: data, partitionKey: partitionKey, done: ctx.Done(), ctx: ctx, deadline: deadline})
+}
+
+// deadline returns the time the record can be retried until, or the zero time if none.
+func (r *kinesisRecord) deadline() (deadline time.Time) {
+	if len(r.metas) < r.count {
+		return time.Time{}
+	}
+	for _, m := range r.metas {
+		if m == nil || m.deadline.IsZero() {
+			return time.Time{}
+		}
+		if m.deadline.After(deadline) {
+			deadline = m.deadline
+		}
+	}
+	return deadline
+}
+
+// batchDeadline returns the latest deadline of the records, or the zero time if any has none.
+func batchDeadline(records []*kinesisRecord) (deadline time.Time) {
+	for _, r := range records {
+		d := r.deadline()
+		if d.IsZero() {
+			return time.Time{}
+		}
+		if d.After(deadline) {
+			deadline = d
+		}
+	}
+	return deadline
+}
+
+// expire fails the records past their deadline with `ErrDeadlineExceeded`,
+// and returns the others.
+func (p *Producer) expire(records []*kinesisRecord) []*kinesisRecord {
+	now := time.Now()
+	var expired []*kinesisRecord
+	live := records[:0:0]
+	for _, r := range records {
+		if d := r.deadline(); !d.IsZero() && now.After(d) {
+			expired = append(expired, r)
+		} else {
+			live = append(live, r)
+		}
+	}
+	if len(expired) == 0 {
+		return records
+	}
+	p.dispatchFailures(expired, ErrDeadlineExceeded)
+	return live
+}
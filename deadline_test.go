@@ -0,0 +1,44 @@
+package producer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPutWithDeadline(t *testing.T) {
+	p := New(&Config{
+		StreamName:    "foo",
+		FlushInterval: 10 * time.Millisecond,
+		Client:        throttledClient{},
+	})
+	failures := p.NotifyFailures()
+	p.Start()
+	start := time.Now()
+	err := p.PutWithDeadline([]byte("hello"), "hello", start.Add(100*time.Millisecond))
+	assert(t, err == nil, "should not return an error")
+	select {
+	case r := <-failures:
+		assert(t, r.Error == ErrDeadlineExceeded, "expect the record to fail with ErrDeadlineExceeded")
+		assert(t, time.Since(start) < 2*time.Second, "expect the retries to stop at the deadline")
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the record to fail once its deadline passed")
+	}
+	p.Stop()
+}
+
+func TestRecordDeadline(t *testing.T) {
+	now := time.Now()
+	a := new(Aggregator)
+	a.put([]byte("hello"), "hello", nil, &userMeta{deadline: now})
+	a.put([]byte("world"), "world", nil, &userMeta{deadline: now.Add(time.Second)})
+	records, err := a.drain()
+	assert(t, err == nil, "should not return an error")
+	assert(t, records[0].deadline().Equal(now.Add(time.Second)), "expect the latest deadline of the user records")
+
+	a.put([]byte("hello"), "hello", nil, &userMeta{deadline: now})
+	a.put([]byte("world"), "world", nil, nil)
+	records, err = a.drain()
+	assert(t, err == nil, "should not return an error")
+	assert(t, records[0].deadline().IsZero(), "expect no deadline if a user record has none")
+	assert(t, batchDeadline(records).IsZero(), "expect no deadline for the batch")
+}
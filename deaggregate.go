@@ -0,0 +1,182 @@
+package producer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Tags the producer stores in the aggregated records
+const (
+	tagTimestamp   = "ts"
+	tagCompression = "c"
+	tagRoute       = "r"
+	tagDebug       = "d"
+	tagContentType = "ct"
+	tagAggregateID = "id"
+)
+
+// Errors
+var (
+	ErrChecksumMismatch = errors.New("Invalid aggregated record. MD5 checksum mismatch")
+	ErrInvalidKeyIndex  = errors.New("Invalid aggregated record. Partition key index out of range")
+	ErrUnknownVersion   = errors.New("Invalid aggregated record. Unknown envelope version")
+	errNotAggregated    = errors.New("record is not aggregated")
+)
+
+// UserRecord is a user record extracted from a Kinesis record.
+type UserRecord struct {
+	PartitionKey string
+	Data         []byte
+	// Timestamp is the time the record was handed to the producer, or
+	// the zero time if `Config.RecordTimestamps` was disabled.
+	Timestamp time.Time
+	// Route is the route the record was put with using `PutWithRoute`, if any.
+	Route string
+	// Debug is true if the record was put with `PutWithDebug`.
+	Debug bool
+	// ContentType is the content type the record was put with using `PutWithContentType`,
+	// if any.
+	ContentType string
+	// AggregateID is the ID of the aggregated record the user record was produced in,
+	// generated by `Config.AggregateIDFunc`, if any.
+	AggregateID string
+}
+
+// Deaggregate extracts the user records out of the `data` of a Kinesis record
+// produced with `partitionKey`. A record that is not aggregated is returned
+// as is, as a single user record. The checksum of the record is verified
+// whatever its `ChecksumScope`, and compressed user records are decompressed.
+// The user records of an aggregated record carry their own partition keys,
+// whatever the one the aggregated record was put with, e.g. by the
+// `Config.AggregateKeyFunc` of the producer.
+func Deaggregate(data []byte, partitionKey string) ([]*UserRecord, error) {
+	msg, err := aggregatedMessage(data)
+	if err == errNotAggregated {
+		return []*UserRecord{{PartitionKey: partitionKey, Data: data}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	agg := new(AggregatedRecord)
+	if err := proto.Unmarshal(msg, agg); err != nil {
+		return nil, err
+	}
+	out := make([]*UserRecord, len(agg.Records))
+	// id is the ID of the aggregated record, stored along with one of its user records
+	var id string
+	for i, r := range agg.Records {
+		keyIndex := r.GetPartitionKeyIndex()
+		if keyIndex >= uint64(len(agg.PartitionKeyTable)) {
+			return nil, ErrInvalidKeyIndex
+		}
+		ur := &UserRecord{
+			PartitionKey: agg.PartitionKeyTable[keyIndex],
+			Data:         r.GetData(),
+		}
+		for _, t := range r.Tags {
+			switch t.GetKey() {
+			case tagTimestamp:
+				if ts, ok := parseTimestamp(t.GetValue()); ok {
+					ur.Timestamp = ts
+				}
+			case tagRoute:
+				ur.Route = t.GetValue()
+			case tagDebug:
+				ur.Debug = true
+			case tagContentType:
+				ur.ContentType = t.GetValue()
+			case tagAggregateID:
+				id = t.GetValue()
+			case tagCompression:
+				if ur.Data, err = decompress(t.GetValue(), ur.Data); err != nil {
+					return nil, err
+				}
+			}
+		}
+		out[i] = ur
+	}
+	for _, ur := range out {
+		ur.AggregateID = id
+	}
+	return out, nil
+}
+
+// aggregateIDTag returns the tag storing the ID of an aggregated record.
+func aggregateIDTag(id string) *Tag {
+	return &Tag{
+		Key:   proto.String(tagAggregateID),
+		Value: proto.String(id),
+	}
+}
+
+// withoutAggregateID returns the tags of a user record, but the ID of its aggregated record.
+func withoutAggregateID(tags []*Tag) []*Tag {
+	for i, t := range tags {
+		if t.GetKey() == tagAggregateID {
+			return append(tags[:i:i], tags[i+1:]...)
+		}
+	}
+	return tags
+}
+
+// EnvelopeVersion is the version of the envelope of the aggregated records the producer
+// writes: version 0 is the KPL format, which carries no version byte for the KCL to
+// deaggregate it. A later version is flagged by a byte right after the magic number,
+// which can't be mistaken for the first byte of the protobuf message, as it is below
+// the tag of its first field. see: aggregation-format.md
+const EnvelopeVersion = 0
+
+// maxVersionByte is the greatest byte read as an envelope version rather than as the
+// tag of a protobuf field, whose field number starts at 1.
+const maxVersionByte = 0x07
+
+// envelopeVersion splits the envelope version out of the message of an aggregated record.
+func envelopeVersion(msg []byte) (int, []byte) {
+	if len(msg) > 0 && msg[0] <= maxVersionByte {
+		return int(msg[0]), msg[1:]
+	}
+	return 0, msg
+}
+
+// aggregatedMessage validates the envelope of an aggregated record, and returns
+// the serialized protobuf message it contains. The checksum may use any scope,
+// and the version must be a known one.
+func aggregatedMessage(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, magicNumber) || len(data) < len(magicNumber)+md5.Size {
+		return nil, errNotAggregated
+	}
+	checksum := data[len(data)-md5.Size:]
+	for _, scope := range []ChecksumScope{ChecksumMessage, ChecksumMagicAndMessage} {
+		if sum := md5.Sum(ChecksumBytes(data, scope)); bytes.Equal(sum[:], checksum) {
+			version, msg := envelopeVersion(data[len(magicNumber) : len(data)-md5.Size])
+			if version != EnvelopeVersion {
+				return nil, ErrUnknownVersion
+			}
+			return msg, nil
+		}
+	}
+	return nil, ErrChecksumMismatch
+}
+
+// parseTimestamp parses the millisecond timestamp of a timestamp tag.
+func parseTimestamp(value string) (time.Time, bool) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+// timestampTag returns the tag holding the millisecond timestamp of `t`.
+func timestampTag(t time.Time) *Tag {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	return &Tag{
+		Key:   proto.String(tagTimestamp),
+		Value: proto.String(strconv.FormatInt(ms, 10)),
+	}
+}
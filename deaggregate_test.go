@@ -0,0 +1,58 @@
+package producer
+
+import (
+	"crypto/md5"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeaggregate(t *testing.T) {
+	a := new(Aggregator)
+	now := time.Now()
+	n := 10
+	for i := 0; i < n; i++ {
+		a.put([]byte("hello-"+strconv.Itoa(i)), "world", []*Tag{timestampTag(now)}, nil)
+	}
+	size := a.Size()
+	record, err := a.Drain()
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(record.Data) <= size+len(magicNumber)+16, "size should account for the record tags")
+
+	records, err := Deaggregate(record.Data, *record.PartitionKey)
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(records) == n, "should return all the user records")
+	for i, r := range records {
+		assert(t, string(r.Data) == "hello-"+strconv.Itoa(i), "`Data` field contains invalid value")
+		assert(t, r.PartitionKey == "world", "`PartitionKey` field contains invalid value")
+		assert(t, r.Timestamp.Equal(now.Truncate(time.Millisecond)), "`Timestamp` field contains invalid value")
+	}
+
+	record.Data[len(record.Data)-1]++
+	_, err = Deaggregate(record.Data, *record.PartitionKey)
+	assert(t, err == ErrChecksumMismatch, "should detect a corrupted record")
+
+	records, err = Deaggregate([]byte("raw"), "key")
+	assert(t, err == nil && len(records) == 1 && string(records[0].Data) == "raw", "should return a raw record as is")
+}
+
+func TestDeaggregateVersion(t *testing.T) {
+	a := new(Aggregator)
+	a.put([]byte("hello"), "world", nil, nil)
+	record, err := a.Drain()
+	assert(t, err == nil, "should not return an error")
+	msg := record.Data[len(magicNumber) : len(record.Data)-md5.Size]
+	assert(t, msg[0] > maxVersionByte, "should write the KPL format, without a version byte")
+
+	versioned := func(version byte) []byte {
+		data := append(append(append([]byte{}, magicNumber...), version), msg...)
+		sum := md5.Sum(data[len(magicNumber):])
+		return append(data, sum[:]...)
+	}
+	records, err := Deaggregate(versioned(0), "world")
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(records) == 1 && string(records[0].Data) == "hello", "should read an explicit version 0")
+
+	_, err = Deaggregate(versioned(1), "world")
+	assert(t, err == ErrUnknownVersion, "should reject an unknown version")
+}
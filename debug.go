@@ -0,0 +1,27 @@
+package producer
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ErrDebugUnaggregated is returned for the records put with `PutWithDebug` that would
+// be sent unaggregated, as the debug flag is stored in the aggregate.
+var ErrDebugUnaggregated = errors.New("Unable to Put record. Debug flag requires the record to be aggregated")
+
+// PutWithDebug `data` using `partitionKey` like `Put`, but flags the record for the
+// consumers to handle verbosely, e.g. to trace the records of a tenant end-to-end,
+// without adding markers to the data. The flag is stored along with the user record,
+// and returned by `Deaggregate` as `Debug`. It returns ErrDebugUnaggregated, rather
+// than dropping the flag, if the record is too large to be aggregated, or aggregation
+// fell back, see `Config.AggregateFallbackThreshold`.
+func (p *Producer) PutWithDebug(data []byte, partitionKey string) error {
+	if p.Framing != FramingKPL {
+		return errors.New("kinesis: PutWithDebug requires FramingKPL")
+	}
+	return p.put(&userRecord{data: data, partitionKey: partitionKey, debug: true})
+}
+
+// debugTag is the tag flagging a user record put with `PutWithDebug`.
+var debugTag = &Tag{Key: proto.String(tagDebug)}
@@ -0,0 +1,48 @@
+package producer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPutWithDebug(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+	})
+	p.PutWithDebug([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1, "expect a single aggregated record")
+	out, err := Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(out) == 2 && out[0].Debug && !out[1].Debug, "expect only the debug record to be flagged")
+
+	p = New(&Config{
+		StreamName: "foo",
+		Framing:    FramingDelimited,
+		Client:     &clientMock{incoming: make(map[int][]string)},
+	})
+	assert(t, p.PutWithDebug([]byte("hello"), "hello") != nil, "expect the flag to require FramingKPL")
+
+	p = New(&Config{
+		StreamName:         "foo",
+		AggregateBatchSize: 100,
+		Client:             &clientMock{incoming: make(map[int][]string)},
+	})
+	err = p.PutWithDebug(bytes.Repeat([]byte("a"), 200), "hello")
+	assert(t, err == ErrDebugUnaggregated, "expect a record too large to be aggregated to be rejected")
+	assert(t, len(p.records) == 0, "expect the rejected record not to be sent")
+
+	p = New(&Config{
+		StreamName:             "foo",
+		AggregateMinKeyRecords: 2,
+		Client:                 &clientMock{incoming: make(map[int][]string)},
+	})
+	p.PutWithDebug(bytes.Repeat([]byte("a"), 500), "single")
+	records = p.drainIfNeed("explicit")
+	assert(t, len(records) == 1 && records[0].aggregated, "expect the debug record under a single-use key to stay aggregated")
+	out, err = Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil && len(out) == 1 && out[0].Debug, "expect the flag to be kept")
+}
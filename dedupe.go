@@ -0,0 +1,70 @@
+package producer
+
+import (
+	"crypto/md5"
+	"sync"
+	"time"
+)
+
+// dedupeKey returns the MD5 checksum of the data.
+func dedupeKey(data []byte) string {
+	sum := md5.Sum(data)
+	return string(sum[:])
+}
+
+// dedupeSet remembers the dedupe keys seen within the window, up to max of them.
+type dedupeSet struct {
+	sync.Mutex
+	window time.Duration
+	max    int
+	// keys maps the keys to the time they were first seen, and queue holds
+	// them in the same order, for forgetting the oldest ones first.
+	keys  map[string]time.Time
+	queue []dedupeEntry
+}
+
+type dedupeEntry struct {
+	key  string
+	time time.Time
+}
+
+// seen reports whether the key was seen within the window, and remembers it otherwise.
+func (s *dedupeSet) seen(key string, now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.keys == nil {
+		s.keys = make(map[string]time.Time)
+	}
+	for len(s.queue) > 0 && (now.Sub(s.queue[0].time) >= s.window || len(s.keys) >= s.max) {
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		if t, ok := s.keys[e.key]; ok && t.Equal(e.time) {
+			delete(s.keys, e.key)
+		}
+	}
+	if t, ok := s.keys[key]; ok && now.Sub(t) < s.window {
+		return true
+	}
+	s.keys[key] = now
+	s.queue = append(s.queue, dedupeEntry{key, now})
+	return false
+}
+
+// forget the key, e.g. once the record it was seen for could not be put. Its entry is
+// removed from the queue too, searched from the end as the key is usually a recent one,
+// for the queue to stay bounded by max.
+func (s *dedupeSet) forget(key string) {
+	s.Lock()
+	defer s.Unlock()
+	t, ok := s.keys[key]
+	if !ok {
+		return
+	}
+	delete(s.keys, key)
+	for i := len(s.queue) - 1; i >= 0; i-- {
+		if e := s.queue[i]; e.key == key && e.time.Equal(t) {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package producer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDedupeSet(t *testing.T) {
+	s := &dedupeSet{window: time.Second, max: 2}
+	now := time.Now()
+	assert(t, !s.seen("a", now), "expect a new key not to be seen")
+	assert(t, s.seen("a", now.Add(time.Millisecond)), "expect the key to be seen within the window")
+	assert(t, !s.seen("a", now.Add(time.Second)), "expect the key to be forgotten after the window")
+	assert(t, !s.seen("b", now.Add(time.Second)) && !s.seen("c", now.Add(time.Second)), "expect new keys not to be seen")
+	assert(t, len(s.keys) == 2, "expect the keys to be bounded")
+	assert(t, !s.seen("a", now.Add(time.Second)), "expect the oldest key to be forgotten first")
+}
+
+func TestDedupeSetForget(t *testing.T) {
+	s := &dedupeSet{window: time.Minute, max: 2}
+	now := time.Now()
+	s.seen("a", now)
+	for i := 0; i < 10; i++ {
+		s.seen("b", now)
+		s.forget("b")
+	}
+	assert(t, len(s.queue) == 1 && len(s.keys) == 1, "expect the forgotten keys to leave the queue")
+	assert(t, s.seen("a", now), "expect the remembered key to be kept")
+	s.forget("c")
+	assert(t, len(s.queue) == 1, "expect forgetting an unknown key to be a no-op")
+}
+
+func TestDedupeWindow(t *testing.T) {
+	p := New(&Config{
+		StreamName:   "foo",
+		DedupeWindow: time.Minute,
+		Client:       &clientMock{incoming: make(map[int][]string)},
+	})
+	p.Put([]byte("hello"), "a")
+	p.Put([]byte("hello"), "b")
+	p.Put([]byte("world"), "a")
+	assert(t, p.aggregator.Count() == 2, "expect the duplicates to be dropped")
+	dropped := testutil.ToFloat64(p.metrics.recordsDroppedCnt.WithLabelValues("foo", "dup"))
+	assert(t, dropped == 1, "expect the duplicates to be counted")
+}
+
+func TestDedupeFailedPut(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		DedupeWindow:        time.Minute,
+		MaxRecordsPerSecond: 1,
+		Client:              &clientMock{incoming: make(map[int][]string)},
+	})
+	p.Put([]byte("hello"), "a")
+	assert(t, p.PutWithTimeout([]byte("world"), "a", 10*time.Millisecond) == ErrBacklogFull, "expect the put to be throttled")
+	assert(t, !p.dedupe.seen(dedupeKey([]byte("world")), time.Now()), "expect the key of the failed put to be forgotten")
+	assert(t, p.dedupe.seen(dedupeKey([]byte("hello")), time.Now()), "expect the key of the put record to be kept")
+}
+
+func TestDedupePriority(t *testing.T) {
+	p := New(&Config{
+		StreamName:   "foo",
+		DedupeWindow: time.Minute,
+		Client:       &clientMock{incoming: make(map[int][]string)},
+	})
+	go p.drainPriority()
+	p.Put([]byte("hello"), "a")
+	p.PutWithPriority([]byte("hello"), "b", 1)
+	p.PutWithPriority([]byte("world"), "b", 1)
+	p.priority.close()
+	<-p.priorityDone
+	assert(t, p.aggregator.Count() == 2, "expect the prioritized duplicates to be dropped")
+}
@@ -0,0 +1,45 @@
+package producer
+
+import "sync"
+
+var (
+	defaultMu       sync.RWMutex
+	defaultProducer *Producer
+)
+
+// InitDefault creates and starts the default producer with the given config, for the
+// package-level `Put` and `Stop` of small applications; the ones with more than one
+// producer, or stream, should use `New`. It panics if the default producer is already
+// initialized and not stopped.
+func InitDefault(config *Config) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	falseOrPanic(defaultProducer != nil, "kinesis: InitDefault called with the default producer initialized")
+	defaultProducer = New(config)
+	defaultProducer.Start()
+}
+
+// Put `data` using `partitionKey` with the default producer, like `Producer.Put`.
+// It panics if the default producer is not initialized with `InitDefault`.
+func Put(data []byte, partitionKey string) error {
+	return getDefault("Put").Put(data, partitionKey)
+}
+
+// Stop the default producer gracefully, like `Producer.Stop`, after which it may be
+// initialized again. It panics if the default producer is not initialized with `InitDefault`.
+func Stop() {
+	defaultMu.Lock()
+	p := defaultProducer
+	defaultProducer = nil
+	defaultMu.Unlock()
+	falseOrPanic(p == nil, "kinesis: Stop called before InitDefault")
+	p.Stop()
+}
+
+// getDefault returns the default producer, panicking if not initialized for `name`.
+func getDefault(name string) *Producer {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	falseOrPanic(defaultProducer == nil, "kinesis: "+name+" called before InitDefault")
+	return defaultProducer
+}
@@ -0,0 +1,41 @@
+package producer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// panicOf returns the value `f` panics with, if any.
+func panicOf(f func()) (v interface{}) {
+	defer func() { v = recover() }()
+	f()
+	return nil
+}
+
+func TestDefaultProducer(t *testing.T) {
+	v := panicOf(func() { Put([]byte("hello"), "hello") })
+	assert(t, v != nil && strings.Contains(v.(string), "before InitDefault"), "expect Put to panic before InitDefault")
+	assert(t, panicOf(Stop) != nil, "expect Stop to panic before InitDefault")
+
+	client := &successClient{}
+	InitDefault(&Config{StreamName: "foo", Client: client})
+	v = panicOf(func() { InitDefault(&Config{StreamName: "foo", Client: client}) })
+	assert(t, v != nil, "expect InitDefault to panic once initialized")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert(t, Put([]byte("hello"), fmt.Sprint(i)) == nil, "should put the record")
+		}(i)
+	}
+	wg.Wait()
+	Stop()
+	assert(t, len(client.keys) == 1, "expect the records to be flushed on Stop")
+	assert(t, panicOf(func() { Put([]byte("hello"), "hello") }) != nil, "expect Put to panic once stopped")
+
+	InitDefault(&Config{StreamName: "foo", Client: client})
+	Stop()
+}
@@ -0,0 +1,156 @@
+package producer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Dispatcher batches and sends the Kinesis records drained from the aggregators, in place
+// of the built-in batching, e.g. to hand them over to an existing request scheduler.
+type Dispatcher interface {
+	// Run dispatches the records received from `records`, in order, until it is closed,
+	// once the producer is stopped. Each record must be completed with `Done` before Run
+	// returns.
+	Run(records <-chan *DispatchRecord)
+}
+
+// DispatchRecord is a Kinesis record ready to be sent, aggregated or not.
+type DispatchRecord struct {
+	*kinesis.PutRecordsRequestEntry
+	// UserRecords is the number of user records carried by the record.
+	UserRecords int
+	done        func(shardID, sequenceNumber string, err error)
+	// record is the Kinesis record, for the built-in batcher. A record without it is a
+	// signal of the loop to the batcher, to flush its buffer for the `flush` reason,
+	// counting its records in the tally, if any.
+	record   *kinesisRecord
+	flush    string
+	interval time.Duration
+	tally    *flushTally
+}
+
+// Done completes the record with its shard and sequence number once put, or with the
+// error it failed with, which reports its user records as failures. The futures and
+// results of the record are handled like with the built-in batching. Only the first
+// call has an effect.
+func (r *DispatchRecord) Done(shardID, sequenceNumber string, err error) {
+	r.done(shardID, sequenceNumber, err)
+}
+
+// dispatchRecord returns the record to hand over to the dispatcher.
+func (p *Producer) dispatchRecord(record *kinesisRecord) *DispatchRecord {
+	var once sync.Once
+	return &DispatchRecord{
+		PutRecordsRequestEntry: record.PutRecordsRequestEntry,
+		UserRecords:            record.count,
+		record:                 record,
+		done: func(shardID, sequenceNumber string, err error) {
+			once.Do(func() {
+				defer p.releaseBytes(record.userBytes)
+				if err != nil {
+					p.dispatchFailures([]*kinesisRecord{record}, err)
+					return
+				}
+				p.flushed(time.Now())
+				p.RLock()
+				notifyResults := p.notifyResults
+				p.RUnlock()
+				p.produce(record, shardID, sequenceNumber, notifyResults)
+			})
+		},
+	}
+}
+
+// batcher is the default Dispatcher: it batches the records into PutRecords requests of up
+// to BatchCount records and BatchSize bytes, sent by up to MaxConnections at a time, and
+// retried as needed. The records are completed by the requests, rather than `Done`. It also
+// gets the flush signals of the loop, records without an entry, for flushing its buffer.
+type batcher struct {
+	p *Producer
+}
+
+func (b *batcher) Run(records <-chan *DispatchRecord) {
+	p := b.p
+	start := time.Now()
+	// first is the time the oldest record in the buffer was appended
+	first := start
+	size := 0
+	// users is the number of user records carried by the buffer
+	users := 0
+	buf := make([]*kinesisRecord, 0, p.BatchCount)
+	// full is whether the last request was cut at BatchCount, the batch only splitting
+	// if another record follows before the next flush signal
+	full := false
+
+	flush := func(msg string) {
+		p.semaphore.acquire()
+		elapsed := float64(time.Since(start)) / float64(time.Millisecond)
+		p.metrics.bufferingTimeDur.WithLabelValues(p.MetricStreamLabel).Observe(elapsed)
+		go p.flush(buf, msg)
+		buf = nil
+		size = 0
+		users = 0
+		start = time.Now()
+	}
+
+	bufAppend := func(record *kinesisRecord) {
+		dataSize := len(record.Data)
+		p.metrics.kinesisRecordsDataPutSz.WithLabelValues(p.MetricStreamLabel).Observe(float64(dataSize))
+		// the record size limit applies to the total size of the
+		// partition key and data blob.
+		rsize := dataSize + len([]byte(*record.PartitionKey))
+		if full {
+			full = false
+			p.metrics.batchSplitsCnt.WithLabelValues(p.MetricStreamLabel).Inc()
+		}
+		if len(buf) > 0 && size+rsize > int(atomic.LoadInt64(&p.batchSize)) {
+			p.metrics.batchSplitsCnt.WithLabelValues(p.MetricStreamLabel).Inc()
+			flush("batch size")
+		}
+		if max := p.MaxUserRecordsPerRequest; max > 0 && len(buf) > 0 && users+record.count > max {
+			flush("user records")
+		}
+		size += rsize
+		users += record.count
+		if len(buf) == 0 {
+			first = time.Now()
+		}
+		buf = append(buf, record)
+		if len(buf) >= int(atomic.LoadInt64(&p.batchCount)) {
+			flush("batch length")
+			full = true
+		}
+	}
+
+	for r := range records {
+		if r.record != nil {
+			bufAppend(r.record)
+			continue
+		}
+		full = false
+		switch {
+		case r.flush == "interval":
+			// if the buffer holds enough records, or the oldest one
+			// has been waiting for a whole interval
+			if size > 0 && (len(buf) >= p.MinBatchCount || time.Since(first) >= r.interval) {
+				flush("interval")
+			}
+		case r.tally != nil:
+			for _, record := range buf {
+				r.tally.add(record)
+			}
+			if size > 0 {
+				flush(r.flush)
+			}
+			r.tally.seal()
+		case size > 0:
+			flush(r.flush)
+		}
+	}
+	if size > 0 {
+		flush("drain")
+	}
+}
@@ -0,0 +1,74 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// dispatcherMock completes the records in order, failing the ones of the "fail" key.
+type dispatcherMock struct {
+	keys []string
+}
+
+func (d *dispatcherMock) Run(records <-chan *DispatchRecord) {
+	for r := range records {
+		d.keys = append(d.keys, *r.PartitionKey)
+		if *r.PartitionKey == "fail" {
+			r.Done("", "", errors.New("scheduler unavailable"))
+			continue
+		}
+		r.Done("shard-1", "1", nil)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	dispatcher := &dispatcherMock{}
+	p := New(&Config{
+		StreamName:          "foo",
+		AggregateBatchCount: 1,
+		FlushInterval:       10 * time.Millisecond,
+		Dispatcher:          dispatcher,
+		Client:              &clientMock{incoming: make(map[int][]string)},
+	})
+	failures := p.NotifyFailures()
+	p.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	seq, err := p.PutAsync([]byte("hello"), "hello").Wait(ctx)
+	assert(t, err == nil && seq == "1", "expect the future to be resolved by the dispatcher")
+	p.Put([]byte("fail"), "fail")
+	p.Put([]byte("world"), "world")
+	p.Stop()
+
+	assert(t, len(dispatcher.keys) == 3, "expect the records to be dispatched")
+	assert(t, dispatcher.keys[1] == "fail" && dispatcher.keys[2] == "world", "expect the records to be dispatched in order")
+	n := 0
+	for r := range failures {
+		assert(t, r.PartitionKey == "fail", "expect the failed records to be reported")
+		n++
+	}
+	assert(t, n == 1, "expect the failed records to be reported")
+	result := p.closeResult()
+	assert(t, result.Produced == 2 && result.Failed == 1, "expect the outcome of the records to be counted")
+}
+
+func TestDispatcherFlushKey(t *testing.T) {
+	dispatcher := &dispatcherMock{}
+	p := New(&Config{
+		StreamName:    "foo",
+		FlushInterval: time.Hour,
+		Dispatcher:    dispatcher,
+		Client:        &clientMock{incoming: make(map[int][]string)},
+	})
+	p.Start()
+	p.PutWithRoute([]byte("hello"), "session", "alerts")
+	p.Put([]byte("world"), "other")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert(t, p.FlushKey(ctx, "session") == nil, "should flush the key")
+	assert(t, len(dispatcher.keys) == 1 && dispatcher.keys[0] == "session", "expect the aggregate of the key to be dispatched")
+	p.Stop()
+	assert(t, len(dispatcher.keys) == 2, "expect the other aggregates to be dispatched on stop")
+}
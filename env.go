@@ -0,0 +1,51 @@
+package producer
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Option configures the Producer created by `NewFromEnv`.
+type Option func(*Config)
+
+// NewFromEnv creates a new producer of `streamName`, with a Kinesis client built from the
+// default AWS configuration: the region, credentials and profile of the environment, and
+// of the shared config files. The options are applied to the Config, e.g. for overriding
+// the defaults, before the producer is created. An invalid Config is returned as an error
+// rather than panicking like `New`.
+func NewFromEnv(streamName string, opts ...Option) (*Producer, error) {
+	if streamName == "" {
+		return nil, errors.New("kinesis: StreamName length must be at least 1")
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{
+		StreamName: streamName,
+		Client:     kinesis.New(sess),
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return newOrError(config)
+}
+
+// newOrError creates a new producer like `New`, but returns the validation panic of the
+// Config as an error.
+func newOrError(config *Config) (p *Producer, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg, ok := r.(string)
+			if !ok {
+				panic(r)
+			}
+			p, err = nil, errors.New(msg)
+		}
+	}()
+	return New(config), nil
+}
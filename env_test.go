@@ -0,0 +1,21 @@
+package producer
+
+import (
+	"os"
+	"testing"
+)
+
+func TestNewFromEnv(t *testing.T) {
+	_, err := NewFromEnv("")
+	assert(t, err != nil, "expect an empty stream name to be rejected")
+
+	os.Setenv("AWS_REGION", "eu-west-1")
+	defer os.Unsetenv("AWS_REGION")
+	p, err := NewFromEnv("foo", func(c *Config) { c.BatchCount = 10 })
+	assert(t, err == nil, "should not return an error")
+	assert(t, p.StreamName == "foo" && p.BatchCount == 10, "expect the options to be applied")
+	assert(t, p.Client != nil, "expect a Kinesis client")
+
+	_, err = NewFromEnv("foo", func(c *Config) { c.BatchCount = 1000 })
+	assert(t, err != nil && err.Error() == "kinesis: BatchCount exceeds 500", "expect an invalid config to be returned as an error")
+}
@@ -0,0 +1,91 @@
+package producer
+
+import (
+	"fmt"
+	"time"
+
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// EventType is the type of a producer lifecycle event.
+type EventType int
+
+const (
+	// EventStarted is emitted once the producer is started.
+	EventStarted EventType = iota
+	// EventFlushed is emitted once a PutRecords request is done, with the number of
+	// records it put.
+	EventFlushed
+	// EventThrottled is emitted when records are retried because the stream, or its keys,
+	// throttled them, with the number of records throttled.
+	EventThrottled
+	// EventPaused and EventResumed are emitted when the producer is paused and resumed.
+	EventPaused
+	EventResumed
+	// EventStopped is emitted once the producer is stopped, right before the channel
+	// of the events is closed.
+	EventStopped
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventStarted:
+		return "started"
+	case EventFlushed:
+		return "flushed"
+	case EventThrottled:
+		return "throttled"
+	case EventPaused:
+		return "paused"
+	case EventResumed:
+		return "resumed"
+	case EventStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a producer lifecycle event.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Records is the number of records flushed, or throttled.
+	Records int
+	// Reason of the flush, or error code of the throttling.
+	Reason string
+}
+
+// Events registers and return listener to observe the lifecycle events of the producer.
+// Like the results, events are dropped rather than blocking the producer when the channel
+// is full.
+func (p *Producer) Events() <-chan Event {
+	p.Lock()
+	defer p.Unlock()
+	if !p.notifyEvents {
+		p.notifyEvents = true
+		p.events = make(chan Event, p.BacklogCount)
+	}
+	return p.events
+}
+
+// emit the event if we notify, or drop it if the channel is full.
+func (p *Producer) emit(t EventType, records int, reason string) {
+	p.RLock()
+	defer p.RUnlock()
+	if !p.notifyEvents {
+		return
+	}
+	select {
+	case p.events <- Event{Type: t, Time: time.Now(), Records: records, Reason: reason}:
+	default:
+	}
+}
+
+// throttlingErrorCodes are the error codes of the records throttled by the stream.
+var throttlingErrorCodes = map[string]bool{
+	k.ErrCodeProvisionedThroughputExceededException: true,
+	k.ErrCodeKMSThrottlingException:                 true,
+	"ThrottlingException":                           true,
+	"Throttling":                                    true,
+}
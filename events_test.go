@@ -0,0 +1,62 @@
+package producer
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestEvents(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		AggregateBatchCount: 1,
+		Client: &clientMock{
+			incoming: make(map[int][]string),
+			responses: []responseMock{
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(1),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+							{ErrorCode: aws.String("ProvisionedThroughputExceededException"), ErrorMessage: aws.String("error")},
+						},
+					},
+				},
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(0),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("2"), ShardId: aws.String("1")},
+						},
+					},
+				},
+			},
+		},
+	})
+	events := p.Events()
+	p.Start()
+	p.Pause()
+	p.Resume()
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	p.Stop()
+
+	var types []EventType
+	var flushed, throttled int
+	for e := range events {
+		types = append(types, e.Type)
+		switch e.Type {
+		case EventFlushed:
+			flushed += e.Records
+		case EventThrottled:
+			throttled += e.Records
+			assert(t, e.Reason == "ProvisionedThroughputExceededException", "expect the throttling error code")
+		}
+	}
+	assert(t, len(types) > 0 && types[0] == EventStarted, "expect the producer to be started first")
+	assert(t, types[1] == EventPaused && types[2] == EventResumed, "expect the producer to be paused and resumed")
+	assert(t, types[len(types)-1] == EventStopped, "expect the producer to be stopped last")
+	assert(t, flushed == 2 && throttled == 1, "expect the flushed and throttled records")
+}
@@ -1,6 +1,7 @@
 package producer
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"time"
@@ -10,7 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/kinesis"
 )
 
-func ExampleSimple() {
+func Example_simple() {
 	logger := &StdLogger{log.New(os.Stdout, "", log.LstdFlags)}
 	client := kinesis.New(session.New(aws.NewConfig()))
 	pr := New(&Config{
@@ -26,7 +27,7 @@ func ExampleSimple() {
 	go func() {
 		for r := range pr.NotifyFailures() {
 			// r contains `Data`, `PartitionKey` and `Error()`
-			logger.Error("detected put failure", r.error)
+			logger.Error("detected put failure", r.Error)
 		}
 	}()
 
@@ -42,3 +43,17 @@ func ExampleSimple() {
 	time.Sleep(3 * time.Second)
 	pr.Stop()
 }
+
+func ExampleAggregator() {
+	a := NewAggregator()
+	for _, key := range []string{"foo", "bar", "baz"} {
+		a.Put([]byte("hello "+key), key)
+	}
+	record, err := a.Drain()
+	if err != nil {
+		panic(err)
+	}
+	records, _ := Deaggregate(record.Data, *record.PartitionKey)
+	fmt.Println(*record.PartitionKey, len(records), string(records[2].Data))
+	// Output: foo 3 hello baz
+}
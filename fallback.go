@@ -0,0 +1,47 @@
+package producer
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// errAggregateFallback is logged when the producer falls back to unaggregated records.
+var errAggregateFallback = errors.New("kinesis: aggregated records failed repeatedly")
+
+// aggregateFailed counts a permanent failure of an aggregated record, falling back to
+// unaggregated records once `Config.AggregateFallbackThreshold` failures in a row are seen.
+// Only the failures Kinesis reports for the record itself count: not the ones of a whole
+// request, e.g. of a missing stream, nor the records aborted on stop or expired.
+func (p *Producer) aggregateFailed() {
+	if p.AggregateFallbackThreshold == 0 {
+		return
+	}
+	n := atomic.AddInt64(&p.aggregateFailures, 1)
+	if n >= int64(p.AggregateFallbackThreshold) && atomic.CompareAndSwapInt32(&p.fallback, 0, 1) {
+		p.metrics.aggregationFallbackActive.WithLabelValues(p.MetricStreamLabel).Set(1)
+		p.Logger.Error("falling back to unaggregated records", errAggregateFallback, LogValue{"failures", n})
+	}
+}
+
+// aggregateProduced resets the count of failures of aggregated records in a row.
+func (p *Producer) aggregateProduced() {
+	if p.AggregateFallbackThreshold != 0 {
+		atomic.StoreInt64(&p.aggregateFailures, 0)
+	}
+}
+
+// fellBack reports whether the producer fell back to unaggregated records.
+func (p *Producer) fellBack() bool {
+	return atomic.LoadInt32(&p.fallback) == 1
+}
+
+// ResumeAggregation aggregates the user records again, once the producer fell back to
+// unaggregated records after `Config.AggregateFallbackThreshold` failures in a row, e.g.
+// once the consumers were fixed. It does nothing otherwise.
+func (p *Producer) ResumeAggregation() {
+	atomic.StoreInt64(&p.aggregateFailures, 0)
+	if atomic.CompareAndSwapInt32(&p.fallback, 1, 0) {
+		p.metrics.aggregationFallbackActive.WithLabelValues(p.MetricStreamLabel).Set(0)
+		p.Logger.Info("resuming aggregation")
+	}
+}
@@ -0,0 +1,89 @@
+package producer
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// aggregateRejectingClient fails the aggregated records permanently, and succeeds the others.
+type aggregateRejectingClient struct {
+	sync.Mutex
+	unaggregated int
+}
+
+func (c *aggregateRejectingClient) PutRecords(input *k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	c.Lock()
+	defer c.Unlock()
+	out := &k.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, r := range input.Records {
+		if isAggregated(r) {
+			*out.FailedRecordCount++
+			out.Records = append(out.Records, &k.PutRecordsResultEntry{
+				ErrorCode:    aws.String("ValidationException"),
+				ErrorMessage: aws.String("rejected"),
+			})
+			continue
+		}
+		c.unaggregated++
+		out.Records = append(out.Records, &k.PutRecordsResultEntry{SequenceNumber: aws.String("1"), ShardId: aws.String("1")})
+	}
+	return out, nil
+}
+
+func TestAggregateFallbackThreshold(t *testing.T) {
+	client := &aggregateRejectingClient{}
+	p := New(&Config{
+		StreamName:                 "fallback",
+		AggregateFallbackThreshold: 2,
+		Client:                     client,
+	})
+	// flush sends the records put so far, synchronously
+	flush := func() {
+		p.semaphore.acquire()
+		p.flush(p.drainIfNeed("explicit"), "explicit")
+	}
+	active := func() float64 {
+		return testutil.ToFloat64(p.metrics.aggregationFallbackActive.WithLabelValues("fallback"))
+	}
+	for i := 0; i < 2; i++ {
+		assert(t, !p.fellBack(), "should not fall back before the threshold")
+		p.Put([]byte("hello"), "hello")
+		p.Put([]byte("world"), "world")
+		flush()
+	}
+	assert(t, p.fellBack() && active() == 1, "expect the producer to fall back after 2 failures")
+	assert(t, !p.WouldFit([]byte("hello"), "hello"), "expect the records not to be aggregated")
+
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	for n := len(p.records); n > 0; n-- {
+		p.semaphore.acquire()
+		p.flush([]*kinesisRecord{<-p.records}, "explicit")
+	}
+	assert(t, client.unaggregated == 2, "expect the records to be sent unaggregated")
+
+	p.ResumeAggregation()
+	assert(t, !p.fellBack() && active() == 0, "expect the aggregation to resume")
+}
+
+func TestAggregateFallbackRequestFailures(t *testing.T) {
+	p := New(&Config{
+		StreamName:                 "fallback-request",
+		AggregateFallbackThreshold: 1,
+		Client:                     &failingClient{code: k.ErrCodeResourceNotFoundException, request: true},
+	})
+	for i := 0; i < 3; i++ {
+		p.Put([]byte("hello"), "hello")
+		p.Put([]byte("world"), "world")
+		p.semaphore.acquire()
+		p.flush(p.drainIfNeed("explicit"), "explicit")
+	}
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	p.dispatchFailures(p.drainIfNeed("explicit"), ErrStoppedProducer)
+	assert(t, !p.fellBack(), "expect the failures of whole requests and aborts not to count")
+}
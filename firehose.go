@@ -0,0 +1,63 @@
+package producer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Kinesis Data Firehose limits, see:
+// https://docs.aws.amazon.com/firehose/latest/APIReference/API_PutRecordBatch.html
+const (
+	firehoseMaxRecordSize  = 1000 << 10 // 1000KiB
+	firehoseMaxRequestSize = 4 << 20    // 4MiB
+)
+
+// RecordBatchPutter is the interface that wraps the FirehoseAPI.PutRecordBatch method.
+type RecordBatchPutter interface {
+	PutRecordBatch(*firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error)
+}
+
+// FirehosePutter is a Putter delivering the records to the Kinesis Data Firehose
+// delivery stream named by `Config.StreamName`. The producer respects the Firehose
+// limits when using it as `Config.Client`.
+//
+// Note that Firehose doesn't deaggregate KPL records by itself; you probably want to
+// use it along with `FramingDelimited`.
+type FirehosePutter struct {
+	Client RecordBatchPutter
+}
+
+// PutRecords puts the records using a PutRecordBatch request, and translates its response.
+// The record IDs returned by Firehose are used as sequence numbers, and shard IDs are empty.
+func (f *FirehosePutter) PutRecords(input *k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	records := make([]*firehose.Record, len(input.Records))
+	for i, r := range input.Records {
+		records[i] = &firehose.Record{Data: r.Data}
+	}
+	out, err := f.Client.PutRecordBatch(&firehose.PutRecordBatchInput{
+		DeliveryStreamName: input.StreamName,
+		Records:            records,
+	})
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*k.PutRecordsResultEntry, len(out.RequestResponses))
+	for i, r := range out.RequestResponses {
+		if r.ErrorCode != nil {
+			results[i] = &k.PutRecordsResultEntry{
+				ErrorCode:    r.ErrorCode,
+				ErrorMessage: r.ErrorMessage,
+			}
+		} else {
+			results[i] = &k.PutRecordsResultEntry{
+				ShardId:        aws.String(""),
+				SequenceNumber: r.RecordId,
+			}
+		}
+	}
+	return &k.PutRecordsOutput{
+		FailedRecordCount: out.FailedPutCount,
+		Records:           results,
+	}, nil
+}
@@ -0,0 +1,48 @@
+package producer
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+type firehoseMock struct {
+	input *firehose.PutRecordBatchInput
+}
+
+func (f *firehoseMock) PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+	f.input = input
+	return &firehose.PutRecordBatchOutput{
+		FailedPutCount: aws.Int64(1),
+		RequestResponses: []*firehose.PutRecordBatchResponseEntry{
+			{RecordId: aws.String("1")},
+			{ErrorCode: aws.String("ServiceUnavailableException"), ErrorMessage: aws.String("error")},
+		},
+	}, nil
+}
+
+func TestFirehosePutter(t *testing.T) {
+	client := &firehoseMock{}
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &FirehosePutter{Client: client},
+	})
+	assert(t, p.BatchSize == firehoseMaxRequestSize, "should default to the Firehose request size limit")
+	assert(t, p.Put(make([]byte, firehoseMaxRecordSize+1), "foo") == ErrRecordSizeExceeded, "should respect the Firehose record size limit")
+
+	out, err := p.Client.PutRecords(&k.PutRecordsInput{
+		StreamName: aws.String("foo"),
+		Records: []*k.PutRecordsRequestEntry{
+			{Data: []byte("hello"), PartitionKey: aws.String("a")},
+			{Data: []byte("world"), PartitionKey: aws.String("b")},
+		},
+	})
+	assert(t, err == nil, "should not return an error")
+	assert(t, aws.StringValue(client.input.DeliveryStreamName) == "foo", "should put to the delivery stream")
+	assert(t, len(client.input.Records) == 2 && string(client.input.Records[1].Data) == "world", "should put all the records")
+	assert(t, aws.Int64Value(out.FailedRecordCount) == 1, "should translate the failed count")
+	assert(t, aws.StringValue(out.Records[0].SequenceNumber) == "1", "should use the record IDs as sequence numbers")
+	assert(t, aws.StringValue(out.Records[1].ErrorCode) == "ServiceUnavailableException", "should translate the errors")
+}
@@ -0,0 +1,199 @@
+package producer
+
+import (
+	"context"
+	"sync"
+)
+
+// FlushResult is the outcome of the records flushed by `Flush`.
+type FlushResult struct {
+	// Records and Failed are the numbers of user records sent, and failed.
+	Records int
+	Failed  int
+	// Bytes is the size of the data and partition keys of the Kinesis records sent.
+	Bytes int
+	// Requests is the number of PutRecords requests made for the records, retries included.
+	Requests int
+}
+
+// Flush sends the records buffered by the producer right away, without waiting for the
+// flush interval: the ones in the backlog, and the aggregates drained. It returns once
+// they are all sent or failed, with their outcome, which leaves out the records put
+// meanwhile and the PutRecords requests already in flight. With a `Config.Dispatcher`,
+// the records are dispatched, and no requests are counted.
+//
+// It gives up waiting once `ctx` is done, and then returns the outcome so far along with
+// the context error. A producer not started yet is waited for. While the producer is
+// paused, nothing is flushed.
+func (p *Producer) Flush(ctx context.Context) (FlushResult, error) {
+	p.RLock()
+	stopped := p.stopped
+	p.RUnlock()
+	if stopped {
+		return FlushResult{}, ErrStoppedProducer
+	}
+	t := &flushTally{done: make(chan struct{})}
+	select {
+	case p.flushes <- t:
+	case <-p.exited:
+		return FlushResult{}, ErrStoppedProducer
+	case <-ctx.Done():
+		return FlushResult{}, ctx.Err()
+	}
+	select {
+	case <-t.done:
+		return t.result(), nil
+	case <-ctx.Done():
+		return t.result(), ctx.Err()
+	}
+}
+
+// flushTally counts the outcome of the Kinesis records flushed by `Flush`.
+type flushTally struct {
+	sync.Mutex
+	res FlushResult
+	// pending is the number of records not completed yet, and done is closed once
+	// they all are, after the tally is sealed.
+	pending int
+	sealed  bool
+	done    chan struct{}
+	// records are the ones drained by `FlushKey`, flushed rather than the
+	// whole producer, if any.
+	records []*kinesisRecord
+}
+
+// add the record to the tally, unless flushed by an earlier one.
+func (t *flushTally) add(r *kinesisRecord) {
+	if r.tally != nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	r.tally = t
+	t.pending++
+}
+
+// seal the tally once all its records are added.
+func (t *flushTally) seal() {
+	t.Lock()
+	defer t.Unlock()
+	t.sealed = true
+	t.check()
+}
+
+// request counts a PutRecords request made for some of the records.
+func (t *flushTally) request() {
+	t.Lock()
+	defer t.Unlock()
+	t.res.Requests++
+}
+
+// complete counts the outcome of the record.
+func (t *flushTally) complete(r *kinesisRecord, failed bool) {
+	t.Lock()
+	defer t.Unlock()
+	if failed {
+		t.res.Failed += r.count
+	} else {
+		t.res.Records += r.count
+		t.res.Bytes += len(r.Data) + len(*r.PartitionKey)
+	}
+	t.pending--
+	t.check()
+}
+
+// check closes the done channel once the sealed tally has no records pending.
+// It must be called with the lock held.
+func (t *flushTally) check() {
+	if t.sealed && t.pending == 0 {
+		close(t.done)
+	}
+}
+
+func (t *flushTally) result() FlushResult {
+	t.Lock()
+	defer t.Unlock()
+	return t.res
+}
+
+// countRequest counts the PutRecords request made for the records in their tallies.
+func countRequest(records []*kinesisRecord) {
+	var counted []*flushTally
+next:
+	for _, r := range records {
+		if r.tally == nil {
+			continue
+		}
+		for _, t := range counted {
+			if t == r.tally {
+				continue next
+			}
+		}
+		counted = append(counted, r.tally)
+		r.tally.request()
+	}
+}
+
+// FlushKey drains the aggregates holding records of `partitionKey`, and sends them right
+// away, through the dispatcher, without waiting for the flush interval, e.g. at the end of
+// the session of a user. The drained aggregates may hold records of other keys as well,
+// which are sent along, as are the records already buffered by the built-in batching.
+// Records of the key already handed to the backlog are sent as usual.
+//
+// It returns once the aggregates are sent, or once `ctx` is done, along with the context
+// error, leaving them to the backlog if they were not handed to the dispatcher yet. A
+// producer not started yet is waited for. While the producer is paused, they are left
+// to the backlog right away.
+func (p *Producer) FlushKey(ctx context.Context, partitionKey string) error {
+	p.Lock()
+	if p.stopped {
+		p.Unlock()
+		return ErrStoppedProducer
+	}
+	var records []*kinesisRecord
+	if _, ok := p.aggregator.pkeyIndex[partitionKey]; ok {
+		records = p.drainAggregator(p.aggregator, "key")
+	}
+	for g, a := range p.groups {
+		if _, ok := a.pkeyIndex[partitionKey]; ok {
+			records = append(records, p.drainAggregator(a, "key")...)
+			delete(p.groups, g)
+		}
+	}
+	if len(records) == 0 {
+		p.Unlock()
+		return nil
+	}
+	if p.paused {
+		p.hold(records)
+		p.Unlock()
+		return nil
+	}
+	p.Unlock()
+
+	t := &flushTally{done: make(chan struct{}), records: records}
+	select {
+	case p.flushes <- t:
+	case <-p.exited:
+		// the backlog is closed already
+		p.dispatchFailures(records, ErrStoppedProducer)
+		return ErrStoppedProducer
+	case <-ctx.Done():
+		p.Lock()
+		stopped := p.stopped
+		if !stopped {
+			p.hold(records)
+		}
+		p.Unlock()
+		if stopped {
+			p.dispatchFailures(records, ErrStoppedProducer)
+		}
+		return ctx.Err()
+	}
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,129 @@
+package producer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestFlushKey(t *testing.T) {
+	client := &clientMock{
+		incoming: make(map[int][]string),
+		responses: []responseMock{
+			{
+				Response: &k.PutRecordsOutput{
+					FailedRecordCount: aws.Int64(0),
+					Records: []*k.PutRecordsResultEntry{
+						{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+					},
+				},
+			},
+			{
+				Response: &k.PutRecordsOutput{
+					FailedRecordCount: aws.Int64(0),
+					Records: []*k.PutRecordsResultEntry{
+						{SequenceNumber: aws.String("2"), ShardId: aws.String("1")},
+					},
+				},
+			},
+		},
+	}
+	p := New(&Config{
+		StreamName:     "foo",
+		MaxConnections: 1,
+		Client:         client,
+	})
+	p.Start()
+	p.PutWithRoute([]byte("hello"), "session", "alerts")
+	p.Put([]byte("world"), "other")
+
+	err := p.FlushKey(context.Background(), "session")
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(client.incoming[0]) == 1, "expect the aggregate of the key to be sent right away")
+	p.RLock()
+	assert(t, len(p.groups) == 0, "expect the aggregate of the key to be drained")
+	assert(t, p.aggregator.Count() == 1, "expect the other aggregates to be left as is")
+	p.RUnlock()
+
+	err = p.FlushKey(context.Background(), "unknown")
+	assert(t, err == nil && len(client.incoming) == 1, "expect nothing to be sent for an unknown key")
+	p.Stop()
+	assert(t, len(client.incoming[1]) == 1, "expect the other aggregates to be sent on stop")
+	err = p.FlushKey(context.Background(), "other")
+	assert(t, err == ErrStoppedProducer, "expect a stopped producer to reject flushes")
+}
+
+func TestFlush(t *testing.T) {
+	client := &dataClient{}
+	p := New(&Config{
+		StreamName:          "foo",
+		AggregateBatchCount: 2,
+		FlushInterval:       time.Hour,
+		Client:              client,
+	})
+	p.Start()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		p.Put([]byte("data-"+key), key)
+	}
+	res, err := p.Flush(context.Background())
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(client.records) == 3, "expect the backlog and the aggregate to be sent")
+	assert(t, res.Records == 5 && res.Failed == 0, fmt.Sprintf("expect the user records to be counted, got: %+v", res))
+	assert(t, res.Requests == 1, "expect the requests to be counted")
+	bytes := 0
+	for _, r := range client.records {
+		bytes += len(r.Data) + len(*r.PartitionKey)
+	}
+	assert(t, res.Bytes == bytes, "expect the bytes sent to be counted")
+
+	res, err = p.Flush(context.Background())
+	assert(t, err == nil && res == FlushResult{}, "expect nothing to be flushed")
+	p.Stop()
+	_, err = p.Flush(context.Background())
+	assert(t, err == ErrStoppedProducer, "expect a stopped producer to reject flushes")
+}
+
+func TestFlushFailures(t *testing.T) {
+	client := &clientMock{
+		incoming: make(map[int][]string),
+		responses: []responseMock{
+			{
+				Response: &k.PutRecordsOutput{
+					FailedRecordCount: aws.Int64(1),
+					Records: []*k.PutRecordsResultEntry{
+						{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+						{ErrorCode: aws.String("AccessDeniedException"), ErrorMessage: aws.String("denied")},
+					},
+				},
+			},
+		},
+	}
+	p := New(&Config{
+		StreamName:    "foo",
+		FlushInterval: time.Hour,
+		Client:        client,
+		FailureSink:   func([]*FailureRecord) {},
+	})
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Put(make([]byte, 1<<20-len("world")), "world")
+	res, err := p.Flush(context.Background())
+	assert(t, err == nil, "should not return an error")
+	assert(t, res.Records == 1 && res.Failed == 1 && res.Requests == 1, fmt.Sprintf("expect the failures to be counted, got: %+v", res))
+	p.Stop()
+}
+
+func TestFlushContext(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := p.Flush(ctx)
+	assert(t, err == context.DeadlineExceeded, "expect a producer not started to be waited for")
+}
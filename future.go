@@ -0,0 +1,46 @@
+package producer
+
+import "context"
+
+// Future is the eventual outcome of a record put with `PutAsync`.
+type Future struct {
+	done           chan struct{}
+	sequenceNumber string
+	err            error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// Wait blocks until the Kinesis record carrying the user record is produced,
+// and returns its sequence number, or until it permanently fails, and returns
+// the error. It returns the context error if `ctx` is done first.
+//
+// Note that the user records aggregated together share the sequence number
+// of the aggregated record.
+func (f *Future) Wait(ctx context.Context) (string, error) {
+	select {
+	case <-f.done:
+		return f.sequenceNumber, f.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// resolve the future. It must be called exactly once.
+func (f *Future) resolve(sequenceNumber string, err error) {
+	f.sequenceNumber = sequenceNumber
+	f.err = err
+	close(f.done)
+}
+
+// PutAsync puts `data` using `partitionKey` asynchronously like `Put`, and returns
+// a future for the outcome of the record. This method is thread-safe.
+func (p *Producer) PutAsync(data []byte, partitionKey string) *Future {
+	f := newFuture()
+	if err := p.put(&userRecord{data: data, partitionKey: partitionKey, future: f}); err != nil {
+		f.resolve("", err)
+	}
+	return f
+}
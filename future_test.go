@@ -0,0 +1,60 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestPutAsync(t *testing.T) {
+	kError := errors.New("ResourceNotFoundException: Stream foo under account X not found")
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		BatchCount:          1,
+		AggregateBatchCount: 2,
+		Client: &clientMock{
+			incoming: make(map[int][]string),
+			responses: []responseMock{
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(0),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("3"), ShardId: aws.String("1")},
+						},
+					},
+				},
+				{Error: kError},
+			}},
+	})
+	p.Start()
+	futures := []*Future{
+		p.PutAsync([]byte("hello"), "foo"),
+		p.PutAsync([]byte("world"), "foo"),
+		p.PutAsync([]byte("!"), "bar"),
+	}
+	invalid := p.PutAsync([]byte("hello"), "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, f := range futures[:2] {
+		seq, err := f.Wait(ctx)
+		assert(t, err == nil && seq == "3", "should return the sequence number of the aggregated record")
+	}
+	_, err := invalid.Wait(ctx)
+	assert(t, err == ErrIllegalPartitionKey, "should return the validation error")
+
+	// not flushed until the producer is stopped
+	short, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+	_, err = futures[2].Wait(short)
+	assert(t, err == context.DeadlineExceeded, "should return the context error")
+
+	p.Stop()
+	_, err = futures[2].Wait(ctx)
+	assert(t, err == kError, "should return the error of the failed record")
+}
@@ -7,6 +7,7 @@ require (
 	github.com/golang/protobuf v1.3.4
 	github.com/jpillora/backoff v1.0.0
 	github.com/prometheus/client_golang v1.5.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/sirupsen/logrus v1.4.2
 	go.uber.org/multierr v1.5.0 // indirect
 	go.uber.org/zap v1.14.0
@@ -0,0 +1,144 @@
+package producer
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Health is a snapshot of the state of the producer.
+type Health struct {
+	// Stopped is true once the producer was stopped.
+	Stopped bool
+	// LastSuccessfulFlush is the time of the last successful PutRecords request,
+	// or the zero time if none succeeded yet.
+	LastSuccessfulFlush time.Time
+}
+
+// Health returns the current health of the producer. A stale `LastSuccessfulFlush`
+// on a running producer means the writes stopped, for lack of traffic or not.
+func (p *Producer) Health() Health {
+	p.RLock()
+	stopped := p.stopped
+	p.RUnlock()
+	var last time.Time
+	if ns := atomic.LoadInt64(&p.lastFlush); ns != 0 {
+		last = time.Unix(0, ns)
+	}
+	return Health{
+		Stopped:             stopped,
+		LastSuccessfulFlush: last,
+	}
+}
+
+// Stats are the counters and the effective limits of the producer.
+type Stats struct {
+	// Produced and Failed are the numbers of user records produced, and
+	// failed, since the producer started.
+	Produced int
+	Failed   int
+	// Backlog is the number of Kinesis records waiting in the backlog, and
+	// BufferedBytes the bytes of the user records counted by MaxBufferedBytes.
+	Backlog       int
+	BufferedBytes int
+	// BatchSize, BatchCount and MaxUserRecordsPerRequest are the limits of the
+	// PutRecords requests, as changed at runtime. MaxUserRecordsPerRequest is 0
+	// when unlimited.
+	BatchSize                int
+	BatchCount               int
+	MaxUserRecordsPerRequest int
+}
+
+// Stats returns the current stats of the producer.
+func (p *Producer) Stats() Stats {
+	return Stats{
+		Produced:                 int(atomic.LoadInt64(&p.produced)),
+		Failed:                   int(atomic.LoadInt64(&p.failed)),
+		Backlog:                  len(p.records),
+		BufferedBytes:            p.buffer.buffered(),
+		BatchSize:                int(atomic.LoadInt64(&p.batchSize)),
+		BatchCount:               int(atomic.LoadInt64(&p.batchCount)),
+		MaxUserRecordsPerRequest: p.MaxUserRecordsPerRequest,
+	}
+}
+
+// TotalRecordsSent returns the number of Kinesis records put since the producer started,
+// aggregated or not. Unlike `Stats`, it counts Kinesis records rather than user records.
+func (p *Producer) TotalRecordsSent() uint64 {
+	return atomic.LoadUint64(&p.recordsSent)
+}
+
+// TotalBytesSent returns the size of the data and partition keys of the Kinesis records
+// put since the producer started.
+func (p *Producer) TotalBytesSent() uint64 {
+	return atomic.LoadUint64(&p.bytesSent)
+}
+
+// reportStats hands the stats over to `Config.OnStats` at the stats interval,
+// until the loop returns.
+func (p *Producer) reportStats() {
+	tick := time.NewTicker(p.StatsInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			p.OnStats(p.Stats())
+		case <-p.exited:
+			return
+		}
+	}
+}
+
+// StartAndWait starts the producer, like `Start`, and blocks until it proved it can write,
+// for readiness gating: until a PutRecords request succeeds, either of records or, when
+// `Config.ProbePartitionKey` is set, of the probe record put every `Config.ProbeInterval`
+// until one succeeds. It returns the error of the context if it gives up first, leaving
+// the producer running.
+func (p *Producer) StartAndWait(ctx context.Context) error {
+	p.Start()
+	if p.ProbePartitionKey != "" {
+		go p.probeUntilReady(ctx)
+	}
+	select {
+	case <-p.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// probeUntilReady puts the probe record every probe interval, until the producer is ready,
+// stopped, or `ctx` is done.
+func (p *Producer) probeUntilReady(ctx context.Context) {
+	tick := time.NewTicker(p.ProbeInterval)
+	defer tick.Stop()
+	for {
+		if err := p.probePut(ctx); err == nil {
+			p.markReady()
+			return
+		} else if ctx.Err() == nil {
+			p.Logger.Error("probe put", err, LogValue{"stream", p.StreamName})
+		}
+		select {
+		case <-tick.C:
+		case <-p.ready:
+			return
+		case <-p.exited:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// markReady unblocks `StartAndWait`.
+func (p *Producer) markReady() {
+	p.readyOnce.Do(func() { close(p.ready) })
+}
+
+// flushed records the time of a successful PutRecords request.
+func (p *Producer) flushed(t time.Time) {
+	p.markReady()
+	atomic.StoreInt64(&p.lastFlush, t.UnixNano())
+	p.metrics.lastSuccessfulFlushTs.WithLabelValues(p.MetricStreamLabel).Set(float64(t.UnixNano()) / float64(time.Second))
+}
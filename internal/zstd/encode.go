@@ -0,0 +1,394 @@
+package zstd
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// The compressor finds matches with a single hash table, writes the literals
+// raw, and encodes the sequences with the predefined FSE tables. It trades
+// ratio for simplicity, which is fine for the small records it compresses.
+// Blocks that don't get smaller are stored raw. RFC 3.1.1.
+
+const (
+	maxBlockSize = 128 << 10
+	minMatch     = 4
+	hashLog      = 14
+
+	// maxOffset keeps the offset codes within the predefined offset table.
+	maxOffset = 1<<28 - 1
+
+	blockRaw        = 0
+	blockCompressed = 2
+)
+
+// Predefined distributions. RFC 3.1.1.3.2.2.
+var (
+	literalEncTable = newFSEEncTable([]int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}, 6)
+	offsetEncTable = newFSEEncTable([]int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}, 5)
+	matchEncTable = newFSEEncTable([]int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}, 6)
+)
+
+var encoderPool = sync.Pool{
+	New: func() interface{} { return new(encoder) },
+}
+
+// Encode appends a zstd frame holding src to dst, and returns it.
+func Encode(dst, src []byte) []byte {
+	e := encoderPool.Get().(*encoder)
+	defer encoderPool.Put(e)
+	e.table = [1 << hashLog]int32{}
+
+	dst = appendFrameHeader(dst, len(src))
+	for start := 0; ; {
+		end := start + maxBlockSize
+		if end > len(src) {
+			end = len(src)
+		}
+		last := end == len(src)
+		dst = e.appendBlock(dst, src, start, end, last)
+		if last {
+			break
+		}
+		start = end
+	}
+
+	var xh xxhash64
+	xh.reset()
+	xh.update(src)
+	sum := uint32(xh.digest())
+	return append(dst, byte(sum), byte(sum>>8), byte(sum>>16), byte(sum>>24))
+}
+
+// appendFrameHeader appends the header of a single segment frame of size
+// bytes, with a checksum. RFC 3.1.1.1.
+func appendFrameHeader(dst []byte, size int) []byte {
+	dst = append(dst, 0x28, 0xb5, 0x2f, 0xfd)
+	const descriptor = 1<<5 | 1<<2
+	n := uint64(size)
+	switch {
+	case n < 256:
+		return append(dst, descriptor, byte(n))
+	case n < 1<<16+256:
+		n -= 256
+		return append(dst, 1<<6|descriptor, byte(n), byte(n>>8))
+	case n < 1<<32:
+		return append(dst, 2<<6|descriptor, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	dst = append(dst, 3<<6|descriptor)
+	for i := uint(0); i < 64; i += 8 {
+		dst = append(dst, byte(n>>i))
+	}
+	return dst
+}
+
+// sequence is a run of literals followed by a match. RFC 3.1.1.3.2.
+type sequence struct {
+	litLen, matchLen, offset uint32
+}
+
+// encoder holds the state of the compressor across the blocks of a frame.
+type encoder struct {
+	// table maps the hash of 4 bytes to the position after their last
+	// occurrence, 0 if none.
+	table [1 << hashLog]int32
+	seqs  []sequence
+	lits  []byte
+}
+
+// appendBlock appends the block of src[start:end], compressed if it gets
+// smaller. RFC 3.1.1.2.
+func (e *encoder) appendBlock(dst, src []byte, start, end int, last bool) []byte {
+	hdr := len(dst)
+	dst = append(dst, 0, 0, 0)
+	if out, ok := e.appendCompressed(dst, src, start, end); ok && len(out)-hdr-3 < end-start {
+		putBlockHeader(out[hdr:], blockCompressed, len(out)-hdr-3, last)
+		return out
+	}
+	dst = append(dst, src[start:end]...)
+	putBlockHeader(dst[hdr:], blockRaw, end-start, last)
+	return dst
+}
+
+func putBlockHeader(b []byte, typ, size int, last bool) {
+	h := typ<<1 | size<<3
+	if last {
+		h |= 1
+	}
+	b[0], b[1], b[2] = byte(h), byte(h>>8), byte(h>>16)
+}
+
+// appendCompressed appends the content of the compressed block of
+// src[start:end], returning false if it found no match. The matches may
+// reach back into the previous blocks, the whole frame being the window.
+func (e *encoder) appendCompressed(dst, src []byte, start, end int) ([]byte, bool) {
+	e.seqs, e.lits = e.seqs[:0], e.lits[:0]
+	anchor := start
+	for i := start; i+minMatch <= end; {
+		v := load32(src, i)
+		h := (v * 2654435761) >> (32 - hashLog)
+		cand := int(e.table[h]) - 1
+		e.table[h] = int32(i + 1)
+		if cand < 0 || i-cand > maxOffset || load32(src, cand) != v {
+			i++
+			continue
+		}
+		n := minMatch
+		for i+n < end && src[cand+n] == src[i+n] {
+			n++
+		}
+		for i > anchor && cand > 0 && src[i-1] == src[cand-1] {
+			i, cand, n = i-1, cand-1, n+1
+		}
+		e.lits = append(e.lits, src[anchor:i]...)
+		e.seqs = append(e.seqs, sequence{litLen: uint32(i - anchor), matchLen: uint32(n), offset: uint32(i - cand)})
+		i += n
+		anchor = i
+	}
+	if len(e.seqs) == 0 {
+		return dst, false
+	}
+	e.lits = append(e.lits, src[anchor:end]...)
+	dst = appendLiterals(dst, e.lits)
+	return appendSequences(dst, e.seqs), true
+}
+
+func load32(b []byte, i int) uint32 {
+	return uint32(b[i]) | uint32(b[i+1])<<8 | uint32(b[i+2])<<16 | uint32(b[i+3])<<24
+}
+
+// appendLiterals appends a raw literals section. RFC 3.1.1.3.1.
+func appendLiterals(dst, lits []byte) []byte {
+	n := len(lits)
+	switch {
+	case n < 1<<5:
+		dst = append(dst, byte(n<<3))
+	case n < 1<<12:
+		dst = append(dst, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		dst = append(dst, byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	return append(dst, lits...)
+}
+
+// appendSequences appends the sequences section, using the predefined
+// tables. The sequences are encoded backwards, the decoder reading the
+// bitstream from its end. RFC 3.1.1.3.2.
+func appendSequences(dst []byte, seqs []sequence) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		dst = append(dst, byte(n))
+	case n < 0x7f00:
+		dst = append(dst, byte(n>>8)+128, byte(n))
+	default:
+		n -= 0x7f00
+		dst = append(dst, 0xff, byte(n), byte(n>>8))
+	}
+	// Predefined_Mode for the three tables
+	dst = append(dst, 0)
+
+	w := bitWriter{out: dst}
+	last := seqs[len(seqs)-1]
+	llCode, llBits, llExtra := literalLengthCode(last.litLen)
+	mlCode, mlBits, mlExtra := matchLengthCode(last.matchLen)
+	ofCode, ofExtra := offsetCode(last.offset)
+	var ll, ml, of fseEncState
+	ll.init(literalEncTable, llCode)
+	ml.init(matchEncTable, mlCode)
+	of.init(offsetEncTable, ofCode)
+	w.addBits(llExtra, llBits)
+	w.addBits(mlExtra, mlBits)
+	w.addBits(ofExtra, uint(ofCode))
+	for i := len(seqs) - 2; i >= 0; i-- {
+		s := seqs[i]
+		llCode, llBits, llExtra = literalLengthCode(s.litLen)
+		mlCode, mlBits, mlExtra = matchLengthCode(s.matchLen)
+		ofCode, ofExtra = offsetCode(s.offset)
+		of.encode(&w, ofCode)
+		ml.encode(&w, mlCode)
+		ll.encode(&w, llCode)
+		w.addBits(llExtra, llBits)
+		w.addBits(mlExtra, mlBits)
+		w.addBits(ofExtra, uint(ofCode))
+	}
+	ml.flush(&w)
+	of.flush(&w)
+	ll.flush(&w)
+	return w.close()
+}
+
+// literalLengthCode returns the code of a literal length, and its extra
+// bits. RFC 3.1.1.3.2.1.1.
+func literalLengthCode(n uint32) (code uint8, nbits uint, extra uint32) {
+	if n < literalLengthOffset {
+		return uint8(n), 0, 0
+	}
+	i := len(literalLengthBase) - 1
+	for literalLengthBase[i]&0xffffff > n {
+		i--
+	}
+	base := literalLengthBase[i]
+	return uint8(literalLengthOffset + i), uint(base >> 24), n - base&0xffffff
+}
+
+// matchLengthCode returns the code of a match length, and its extra bits.
+// RFC 3.1.1.3.2.1.1.
+func matchLengthCode(n uint32) (code uint8, nbits uint, extra uint32) {
+	if n < matchLengthOffset+3 {
+		return uint8(n - 3), 0, 0
+	}
+	i := len(matchLengthBase) - 1
+	for matchLengthBase[i]&0xffffff > n {
+		i--
+	}
+	base := matchLengthBase[i]
+	return uint8(matchLengthOffset + i), uint(base >> 24), n - base&0xffffff
+}
+
+// offsetCode returns the code of an offset, also its number of extra bits,
+// and the extra bits. Offsets are stored plus 3, the lower values being the
+// repeated offsets. RFC 3.1.1.3.2.1.1.
+func offsetCode(offset uint32) (code uint8, extra uint32) {
+	v := offset + 3
+	code = uint8(bits.Len32(v) - 1)
+	return code, v - 1<<code
+}
+
+// fseEncTable is the encoding table of an FSE distribution, spread like
+// the decoding table of the distribution. RFC 4.1.1.
+type fseEncTable struct {
+	log        uint
+	stateTable []uint16
+	symbols    []fseSymbolTransform
+}
+
+// fseSymbolTransform gives the number of bits to write, and the next state,
+// when encoding a symbol.
+type fseSymbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+func newFSEEncTable(norm []int16, log uint) *fseEncTable {
+	size := 1 << log
+	mask := size - 1
+	spread := make([]uint8, size)
+	cumul := make([]int, len(norm)+1)
+	high := size - 1
+	for s, c := range norm {
+		if c == -1 {
+			cumul[s+1] = cumul[s] + 1
+			spread[high] = uint8(s)
+			high--
+		} else {
+			cumul[s+1] = cumul[s] + int(c)
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			spread[pos] = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+
+	t := &fseEncTable{
+		log:        log,
+		stateTable: make([]uint16, size),
+		symbols:    make([]fseSymbolTransform, len(norm)),
+	}
+	for u, s := range spread {
+		t.stateTable[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+	total := 0
+	for s, c := range norm {
+		switch c {
+		case 0:
+			t.symbols[s].deltaNbBits = uint32(log+1)<<16 - uint32(size)
+		case -1, 1:
+			t.symbols[s] = fseSymbolTransform{
+				deltaNbBits:    uint32(log)<<16 - uint32(size),
+				deltaFindState: int32(total - 1),
+			}
+			total++
+		default:
+			maxBitsOut := uint32(log) - uint32(bits.Len32(uint32(c-1))-1)
+			t.symbols[s] = fseSymbolTransform{
+				deltaNbBits:    maxBitsOut<<16 - uint32(c)<<maxBitsOut,
+				deltaFindState: int32(total - int(c)),
+			}
+			total += int(c)
+		}
+	}
+	return t
+}
+
+// fseEncState is the state of an FSE encoder, the table size plus the
+// state of the decoder.
+type fseEncState struct {
+	t     *fseEncTable
+	value uint32
+}
+
+func (s *fseEncState) init(t *fseEncTable, sym uint8) {
+	tt := t.symbols[sym]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	v := nbBitsOut<<16 - tt.deltaNbBits
+	s.t = t
+	s.value = uint32(t.stateTable[int32(v>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (s *fseEncState) encode(w *bitWriter, sym uint8) {
+	tt := s.t.symbols[sym]
+	nbBitsOut := (s.value + tt.deltaNbBits) >> 16
+	w.addBits(s.value, uint(nbBitsOut))
+	s.value = uint32(s.t.stateTable[int32(s.value>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (s *fseEncState) flush(w *bitWriter) {
+	w.addBits(s.value, s.t.log)
+}
+
+// bitWriter writes the bits forwards, for the decoder to read them back.
+type bitWriter struct {
+	out  []byte
+	bits uint64
+	n    uint
+}
+
+func (w *bitWriter) addBits(v uint32, n uint) {
+	w.bits |= (uint64(v) & (1<<n - 1)) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits >>= 8
+		w.n -= 8
+	}
+}
+
+// close writes the end mark, and returns the bitstream.
+func (w *bitWriter) close() []byte {
+	w.addBits(1, 1)
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.bits))
+	}
+	return w.out
+}
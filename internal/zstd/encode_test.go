@@ -0,0 +1,73 @@
+package zstd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func decode(t *testing.T, frame []byte) []byte {
+	t.Helper()
+	data, err := ioutil.ReadAll(NewReader(bytes.NewReader(frame)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncode(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 200000)
+	r.Read(random)
+	var numbers []byte
+	for i := 0; i < 20000; i++ {
+		numbers = strconv.AppendInt(numbers, int64(r.Intn(1000)), 10)
+		numbers = append(numbers, ',')
+	}
+	tests := map[string][]byte{
+		"empty":   {},
+		"byte":    []byte("a"),
+		"short":   []byte("hello hello hello hello"),
+		"json":    bytes.Repeat([]byte(`{"hello":"world","n":1}`), 1000),
+		"run":     bytes.Repeat([]byte("x"), 3*maxBlockSize),
+		"random":  random,
+		"numbers": numbers,
+		// matches reaching back into the previous block
+		"repeated": append(append([]byte{}, random[:70000]...), random[:90000]...),
+	}
+	for name, data := range tests {
+		frame := Encode(nil, data)
+		if !bytes.Equal(decode(t, frame), data) {
+			t.Errorf("%s: expect the data to round trip", name)
+		}
+		if name == "json" && len(frame) > len(data)/10 {
+			t.Errorf("%s: expect the data to be compressed, got %d bytes", name, len(frame))
+		}
+		if name == "random" && len(frame) > len(data)+32 {
+			t.Errorf("%s: expect incompressible data to be stored raw, got %d bytes", name, len(frame))
+		}
+	}
+}
+
+func TestEncodeAppend(t *testing.T) {
+	prefix := []byte("prefix")
+	frame := Encode(prefix, []byte("hello"))
+	if !bytes.HasPrefix(frame, prefix) || string(decode(t, frame[len(prefix):])) != "hello" {
+		t.Error("expect the frame to be appended")
+	}
+}
+
+func TestDecodeReference(t *testing.T) {
+	// `zstd -19` of the data
+	frame := []byte{
+		0x28, 0xb5, 0x2f, 0xfd, 0x04, 0x68, 0xf5, 0x00, 0x00, 0xc0, 0x7b, 0x22, 0x68, 0x65,
+		0x6c, 0x6c, 0x6f, 0x22, 0x3a, 0x22, 0x77, 0x6f, 0x72, 0x6c, 0x64, 0x22, 0x7d, 0x2c,
+		0x7a, 0x73, 0x74, 0x64, 0x22, 0x7d, 0x01, 0x00, 0x8a, 0x99, 0x61, 0xbe, 0x0f, 0xf0,
+		0xa1,
+	}
+	if got := string(decode(t, frame)); got != `{"hello":"world"},{"hello":"world"},{"hello":"zstd"}` {
+		t.Errorf("unexpected data %q", got)
+	}
+}
@@ -0,0 +1,55 @@
+package producer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mrand "math/rand"
+	"strconv"
+	"sync/atomic"
+)
+
+// RandomAggregateKey is an AggregateKeyFunc putting each aggregated record with a random
+// partition key, decoupled from the keys of its user records, so that the aggregated
+// records spread evenly over the shards. The user records keep their own partition keys
+// in the aggregated record, and consumers should rely on them, e.g. as returned by
+// `Deaggregate`, rather than on the Kinesis-level key. With FramingDelimited the keys of
+// the user records are not kept, so it should only be used with FramingKPL.
+func RandomAggregateKey(keys []string) string {
+	return strconv.FormatUint(mrand.Uint64(), 36)
+}
+
+// RoundRobinAggregateKeys returns an AggregateKeyFunc putting the aggregated records with
+// `n` partition keys in turn, decoupled from the keys of their user records, like
+// `RandomAggregateKey`. Note that the keys are hashed to their shards, so `n` should be
+// well above the number of shards for the records to spread evenly.
+func RoundRobinAggregateKeys(n int) func(keys []string) string {
+	falseOrPanic(n < 1, "kinesis: RoundRobinAggregateKeys requires at least 1 key")
+	var next uint64
+	return func(keys []string) string {
+		i := (atomic.AddUint64(&next, 1) - 1) % uint64(n)
+		return strconv.FormatUint(i, 10)
+	}
+}
+
+// randomPartitionKey returns a random UUID, the partition key of the user records put
+// without any when `Config.AutoPartitionKey` is set.
+func randomPartitionKey() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		// fall back to a pseudo-random key, which spreads the records as well
+		mrand.Read(u[:])
+	}
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // variant 10
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
@@ -0,0 +1,178 @@
+// Package kinesistest provides an in-memory Kinesis fake, for testing the code using
+// the producer end-to-end, e.g. its retries and aggregation, deterministically.
+package kinesistest
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+	producer "github.com/ouzi-dev/kinesis-producer"
+)
+
+// Record is a Kinesis record accepted by the fake.
+type Record struct {
+	PartitionKey   string
+	Data           []byte
+	ShardID        string
+	SequenceNumber string
+}
+
+// FakeStore holds the records accepted by the fake, and the faults to inject.
+// Its methods may be called concurrently with the producer.
+type FakeStore struct {
+	mu       sync.Mutex
+	shards   int
+	seq      int64
+	records  []Record
+	requests int
+	// errs are the errors of the next requests, and throttled the number
+	// of the next records to throttle.
+	errs      []error
+	throttled int
+}
+
+// NewFakeKinesis returns a Putter accepting the records into the returned store,
+// as a stream of a single shard.
+func NewFakeKinesis() (producer.Putter, *FakeStore) {
+	s := &FakeStore{shards: 1}
+	return &fakeKinesis{s}, s
+}
+
+// SetShardCount spreads the next records over `n` shards, by their explicit hash key,
+// or the MD5 hash of their partition key, like Kinesis does with uniform hash key
+// ranges.
+func (s *FakeStore) SetShardCount(n int) {
+	if n < 1 {
+		panic("kinesistest: the shard count must be at least 1")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shards = n
+}
+
+// FailRequests fails the next PutRecords requests with the errors, one per request,
+// e.g. an `awserr.Error` of a Kinesis error code.
+func (s *FakeStore) FailRequests(errs ...error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, errs...)
+}
+
+// ThrottleRecords throttles the next `n` records, which are reported as failed with
+// ProvisionedThroughputExceededException in the response of their request.
+func (s *FakeStore) ThrottleRecords(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.throttled += n
+}
+
+// Records returns the records accepted so far, in order.
+func (s *FakeStore) Records() []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Record(nil), s.records...)
+}
+
+// UserRecords returns the user records of the records accepted so far, in order,
+// deaggregated.
+func (s *FakeStore) UserRecords() ([]*producer.UserRecord, error) {
+	var out []*producer.UserRecord
+	for _, r := range s.Records() {
+		users, err := producer.Deaggregate(r.Data, r.PartitionKey)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, users...)
+	}
+	return out, nil
+}
+
+// Requests returns the number of PutRecords requests received so far, failed or not.
+func (s *FakeStore) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Reset drops the records accepted so far, and the faults left to inject.
+func (s *FakeStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records, s.requests, s.errs, s.throttled = nil, 0, nil, 0
+}
+
+// maxHashKey is the upper bound of the hash key ranges, 2^128.
+var maxHashKey = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// hashKeyOf returns the hash key of the record: its explicit hash key if set, or the
+// MD5 of its partition key. It reports false for an explicit hash key out of range.
+func hashKeyOf(entry *k.PutRecordsRequestEntry) (*big.Int, bool) {
+	if entry.ExplicitHashKey != nil {
+		hashKey, ok := new(big.Int).SetString(*entry.ExplicitHashKey, 10)
+		return hashKey, ok && hashKey.Sign() >= 0 && hashKey.Cmp(maxHashKey) < 0
+	}
+	sum := md5.Sum([]byte(aws.StringValue(entry.PartitionKey)))
+	return new(big.Int).SetBytes(sum[:]), true
+}
+
+// shardOf returns the ID of the shard of the hash key, the shards splitting the hash
+// key range evenly.
+func (s *FakeStore) shardOf(hashKey *big.Int) string {
+	shard := new(big.Int).Mul(hashKey, big.NewInt(int64(s.shards)))
+	shard.Div(shard, maxHashKey)
+	return fmt.Sprintf("shardId-%012d", shard.Int64())
+}
+
+type fakeKinesis struct {
+	store *FakeStore
+}
+
+// PutRecords accepts the records, but the throttled ones, or fails the request.
+func (f *fakeKinesis) PutRecords(input *k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	s := f.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return nil, err
+	}
+	hashKeys := make([]*big.Int, len(input.Records))
+	for i, entry := range input.Records {
+		var ok bool
+		if hashKeys[i], ok = hashKeyOf(entry); !ok {
+			return nil, awserr.New(k.ErrCodeInvalidArgumentException, "Invalid ExplicitHashKey", nil)
+		}
+	}
+	out := &k.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for i, entry := range input.Records {
+		if s.throttled > 0 {
+			s.throttled--
+			*out.FailedRecordCount++
+			out.Records = append(out.Records, &k.PutRecordsResultEntry{
+				ErrorCode:    aws.String(k.ErrCodeProvisionedThroughputExceededException),
+				ErrorMessage: aws.String("Rate exceeded for shard"),
+			})
+			continue
+		}
+		s.seq++
+		r := Record{
+			PartitionKey:   aws.StringValue(entry.PartitionKey),
+			Data:           append([]byte(nil), entry.Data...),
+			ShardID:        s.shardOf(hashKeys[i]),
+			SequenceNumber: fmt.Sprintf("%056d", s.seq),
+		}
+		s.records = append(s.records, r)
+		out.Records = append(out.Records, &k.PutRecordsResultEntry{
+			ShardId:        aws.String(r.ShardID),
+			SequenceNumber: aws.String(r.SequenceNumber),
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,101 @@
+package kinesistest
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+	producer "github.com/ouzi-dev/kinesis-producer"
+)
+
+func TestFakeKinesis(t *testing.T) {
+	client, store := NewFakeKinesis()
+	store.SetShardCount(4)
+	store.FailRequests(awserr.New(k.ErrCodeProvisionedThroughputExceededException, "throttled", nil))
+	store.ThrottleRecords(1)
+	p := producer.New(&producer.Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		AggregateBatchCount: 10,
+		FlushInterval:       10 * time.Millisecond,
+		Client:              client,
+	})
+	p.Start()
+	for i := 0; i < 25; i++ {
+		if err := p.Put([]byte(strconv.Itoa(i)), "key-"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Stop()
+
+	if n := store.Requests(); n < 3 {
+		t.Errorf("expect the failed request and the throttled record to be retried, got %d requests", n)
+	}
+	records := store.Records()
+	shards := make(map[string]bool)
+	for i, r := range records {
+		shards[r.ShardID] = true
+		if i > 0 && r.SequenceNumber <= records[i-1].SequenceNumber {
+			t.Error("expect the sequence numbers to increase")
+		}
+	}
+	if len(shards) < 2 {
+		t.Error("expect the records to spread over the shards")
+	}
+	users, err := store.UserRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 25 {
+		t.Errorf("expect all the user records to be accepted once, got %d", len(users))
+	}
+
+	store.Reset()
+	if len(store.Records()) != 0 || store.Requests() != 0 {
+		t.Error("expect the store to be reset")
+	}
+}
+
+func TestFakeKinesisErrors(t *testing.T) {
+	client, store := NewFakeKinesis()
+	kError := errors.New("boom")
+	store.FailRequests(kError)
+	_, err := client.PutRecords(&k.PutRecordsInput{})
+	if err != kError {
+		t.Errorf("expect the injected error, got %v", err)
+	}
+}
+
+func TestFakeKinesisExplicitHashKey(t *testing.T) {
+	client, store := NewFakeKinesis()
+	store.SetShardCount(4)
+	out, err := client.PutRecords(&k.PutRecordsInput{
+		Records: []*k.PutRecordsRequestEntry{
+			{PartitionKey: aws.String("a"), ExplicitHashKey: aws.String("0"), Data: []byte("first")},
+			{PartitionKey: aws.String("a"), ExplicitHashKey: aws.String("340282366920938463463374607431768211455"), Data: []byte("last")},
+			{PartitionKey: aws.String("a"), ExplicitHashKey: aws.String("170141183460469231731687303715884105728"), Data: []byte("middle")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := []string{"shardId-000000000000", "shardId-000000000003", "shardId-000000000002"}
+	for i, r := range out.Records {
+		if aws.StringValue(r.ShardId) != shards[i] {
+			t.Errorf("expect record %d in %s, got %s", i, shards[i], aws.StringValue(r.ShardId))
+		}
+	}
+
+	for _, key := range []string{"-1", "340282366920938463463374607431768211456", "key"} {
+		_, err = client.PutRecords(&k.PutRecordsInput{
+			Records: []*k.PutRecordsRequestEntry{{PartitionKey: aws.String("a"), ExplicitHashKey: aws.String(key)}},
+		})
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != k.ErrCodeInvalidArgumentException {
+			t.Errorf("expect the hash key %s to be rejected, got %v", key, err)
+		}
+	}
+}
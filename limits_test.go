@@ -0,0 +1,120 @@
+package producer
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// limitsClient checks the PutRecords requests against the Kinesis limits.
+type limitsClient struct {
+	sync.Mutex
+	records    int
+	violations []string
+}
+
+func (c *limitsClient) PutRecords(input *k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	c.Lock()
+	defer c.Unlock()
+	if len(input.Records) > maxRecordsPerRequest {
+		c.violations = append(c.violations, fmt.Sprintf("request of %d records", len(input.Records)))
+	}
+	out := &k.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	size := 0
+	for _, r := range input.Records {
+		rsize := len(r.Data) + len(*r.PartitionKey)
+		if rsize > maxRecordSize {
+			c.violations = append(c.violations, fmt.Sprintf("record of %d bytes", rsize))
+		}
+		if isAggregated(r) {
+			if _, err := Deaggregate(r.Data, *r.PartitionKey); err != nil {
+				c.violations = append(c.violations, "invalid aggregated record: "+err.Error())
+			}
+		}
+		size += rsize
+		c.records++
+		out.Records = append(out.Records, &k.PutRecordsResultEntry{SequenceNumber: aws.String("1"), ShardId: aws.String("1")})
+	}
+	if size > maxRequestSize {
+		c.violations = append(c.violations, fmt.Sprintf("request of %d bytes", size))
+	}
+	return out, nil
+}
+
+// randomRecord returns a record of a random size, from tiny ones with many distinct
+// partition keys, to ones right at the record size limit.
+func randomRecord(r *rand.Rand) ([]byte, string) {
+	key := strconv.Itoa(r.Int()) + strings.Repeat("k", r.Intn(maxPartitionKeySize-20))
+	var size int
+	switch r.Intn(4) {
+	case 0:
+		size = r.Intn(100)
+	case 1:
+		size = r.Intn(100 << 10)
+	case 2:
+		size = r.Intn(maxRecordSize - len(key) + 1)
+	default:
+		size = maxRecordSize - len(key) - r.Intn(2048)
+	}
+	return make([]byte, size), key
+}
+
+func TestLimits(t *testing.T) {
+	for seed := int64(0); seed < 4; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		client := &limitsClient{}
+		config := &Config{
+			StreamName:          "foo",
+			AggregateBatchSize:  maxAggregationSize,
+			AggregateBatchCount: 1 + r.Intn(2000),
+			Client:              client,
+		}
+		if seed%2 == 1 {
+			config.RecordTimestamps = true
+		}
+		p := New(config)
+		p.Start()
+		n := 200 + r.Intn(200)
+		for i := 0; i < n; i++ {
+			data, key := randomRecord(r)
+			if err := p.Put(data, key); err != nil {
+				t.Fatalf("seed %d: put: %v", seed, err)
+			}
+		}
+		p.Stop()
+		for _, v := range client.violations {
+			t.Errorf("seed %d: %s", seed, v)
+		}
+		assert(t, client.records > 0, "expect the records to be sent")
+	}
+}
+
+func TestAggregateSizeLimit(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	p := New(&Config{
+		StreamName:         "foo",
+		AggregateBatchSize: maxAggregationSize,
+		Client:             &clientMock{incoming: make(map[int][]string)},
+	})
+	// many tiny records of distinct keys, whose framing outweighs their data
+	for i := 0; i < 200000; i++ {
+		data := make([]byte, r.Intn(4))
+		key := strconv.Itoa(i)
+		p.Lock()
+		if !p.fits(p.aggregator, len(data)+len(key), key) {
+			p.Unlock()
+			break
+		}
+		p.aggregator.Put(data, key)
+		p.Unlock()
+	}
+	entry, err := p.aggregator.Drain()
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(entry.Data)+len(*entry.PartitionKey) <= maxRecordSize, fmt.Sprintf("aggregated record of %d bytes exceeds 1MiB", len(entry.Data)+len(*entry.PartitionKey)))
+}
@@ -0,0 +1,40 @@
+package producer
+
+// marshalJob is an aggregated record left to be marshaled by the marshal workers,
+// out of the user records of its aggregator.
+type marshalJob struct {
+	record     *kinesisRecord
+	aggregator *Aggregator
+}
+
+// startMarshalers starts the marshal workers, taking the jobs queued since New, if any.
+func (p *Producer) startMarshalers() {
+	for i := 0; i < p.MarshalWorkers; i++ {
+		go p.marshalLoop()
+	}
+}
+
+// marshalLoop marshals the aggregated records of the jobs, until the producer is stopped.
+func (p *Producer) marshalLoop() {
+	for job := range p.marshals {
+		job.record.PutRecordsRequestEntry, job.record.marshalErr = job.aggregator.Drain()
+		close(job.record.marshaled)
+	}
+}
+
+// awaitMarshaled waits for the record to be marshaled, if left to the marshal workers.
+// It reports whether the record is to be sent: the user records of a record that failed
+// to be marshaled are lost, as when it fails once drained.
+func (p *Producer) awaitMarshaled(record *kinesisRecord) bool {
+	if record.marshaled == nil {
+		return true
+	}
+	<-record.marshaled
+	if record.marshalErr == nil {
+		return true
+	}
+	p.Logger.Error("drain aggregator", record.marshalErr)
+	record.resolve("", record.marshalErr)
+	p.releaseBytes(record.userBytes)
+	return false
+}
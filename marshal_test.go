@@ -0,0 +1,95 @@
+package producer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// dataClient succeeds and keeps the records put, in order.
+type dataClient struct {
+	sync.Mutex
+	records []*k.PutRecordsRequestEntry
+}
+
+func (c *dataClient) PutRecords(input *k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	c.Lock()
+	defer c.Unlock()
+	out := &k.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, r := range input.Records {
+		c.records = append(c.records, r)
+		out.Records = append(out.Records, &k.PutRecordsResultEntry{SequenceNumber: aws.String("1"), ShardId: aws.String("1")})
+	}
+	return out, nil
+}
+
+// dataDispatcher completes the records, keeping them in the client.
+type dataDispatcher struct {
+	client *dataClient
+}
+
+func (d *dataDispatcher) Run(records <-chan *DispatchRecord) {
+	for r := range records {
+		d.client.records = append(d.client.records, r.PutRecordsRequestEntry)
+		r.Done("shard-1", "1", nil)
+	}
+}
+
+func TestMarshalWorkers(t *testing.T) {
+	for _, dispatched := range []bool{false, true} {
+		client := &dataClient{}
+		var dispatcher Dispatcher
+		if dispatched {
+			dispatcher = &dataDispatcher{client}
+		}
+		p := New(&Config{
+			StreamName:          "foo",
+			Client:              client,
+			MarshalWorkers:      4,
+			AggregateBatchCount: 3,
+			MaxConnections:      1,
+			Dispatcher:          dispatcher,
+		})
+		for i := 0; i < 100; i++ {
+			// the records put before Start wait for the workers to start with it
+			if i == 9 {
+				assert(t, len(p.marshals) == 2, "expect the marshal workers to start with the producer")
+				p.Start()
+			}
+			assert(t, p.Put([]byte(fmt.Sprintf("%03d", i)), "key") == nil, "should put the record")
+		}
+		p.Stop()
+		var data []string
+		for _, r := range client.records {
+			out, err := Deaggregate(r.Data, *r.PartitionKey)
+			assert(t, err == nil, "should not return an error")
+			for _, u := range out {
+				data = append(data, string(u.Data))
+			}
+		}
+		assert(t, len(data) == 100, fmt.Sprintf("expect all the records to be sent, got: %d", len(data)))
+		for i, d := range data {
+			assert(t, d == fmt.Sprintf("%03d", i), "expect the records to be sent in order")
+		}
+	}
+}
+
+func TestMarshalWorkersFlushKey(t *testing.T) {
+	client := &dataClient{}
+	p := New(&Config{
+		StreamName:     "foo",
+		Client:         client,
+		MarshalWorkers: 2,
+	})
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	assert(t, p.FlushKey(context.Background(), "hello") == nil, "should flush the key")
+	assert(t, len(client.records) == 1, "expect the aggregated record to be sent")
+	out, err := Deaggregate(client.records[0].Data, "hello")
+	assert(t, err == nil && len(out) == 1 && string(out[0].Data) == "hello", "expect the record to be marshaled")
+	p.Stop()
+}
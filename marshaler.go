@@ -0,0 +1,44 @@
+package producer
+
+import (
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// marshaler serializes a protobuf message, appending its wire encoding to `b`.
+// It lets the aggregator swap the standard `proto.Marshal` for a faster one.
+type marshaler interface {
+	appendMarshal(b []byte, m proto.Message) ([]byte, error)
+}
+
+// protoMarshaler uses the standard `proto.Marshal`.
+type protoMarshaler struct{}
+
+func (protoMarshaler) appendMarshal(b []byte, m proto.Message) ([]byte, error) {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return b, err
+	}
+	return append(b, data...), nil
+}
+
+// fastMarshaler encodes the message straight into the given buffer, saving the
+// intermediate copy of `proto.Marshal`.
+type fastMarshaler struct{}
+
+func (fastMarshaler) appendMarshal(b []byte, m proto.Message) ([]byte, error) {
+	pb := proto.NewBuffer(b)
+	if err := pb.Marshal(m); err != nil {
+		return b, err
+	}
+	return pb.Bytes(), nil
+}
+
+// bufferPool holds the scratch buffers used for assembling aggregated records.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, defaultAggregationSize)
+		return &b
+	},
+}
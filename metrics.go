@@ -6,10 +6,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-const systemName = "go_kinesis_producer"
+// defaultMetricSubsystem is the default subsystem of the metrics.
+const defaultMetricSubsystem = "go_kinesis_producer"
 
 var timeMillisecondBuckets = []float64{.01, .1, .25, .5, 1, 2.5, 5, 10, 100, 1000, 10000, 60000}
 var sizeByteBuckets = []float64{1, 16, 64, 256, 512, 1024, 16384, 65536, 262144, 1048576, 4194304}
+var retryBuckets = []float64{0, 1, 2, 3, 5, 10}
+var ratioBuckets = []float64{.1, .2, .3, .4, .5, .6, .7, .8, .9, 1}
+var keyCountBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
 
 type prometheusMetrics struct {
 	userRecordsPutCnt                     *prometheus.CounterVec
@@ -23,9 +27,29 @@ type prometheusMetrics struct {
 	requestTimeDur                        *prometheus.HistogramVec
 	userRecordsPerKinesisRecordSum        *prometheus.HistogramVec
 	kinesisRecordsPerPutRecordsRequestSum *prometheus.HistogramVec
+	inFlightRequestsCnt                   *prometheus.GaugeVec
+	lastSuccessfulFlushTs                 *prometheus.GaugeVec
+	aggregationDecisionsCnt               *prometheus.CounterVec
+	aggregateFlushCnt                     *prometheus.CounterVec
+	failuresDroppedCnt                    *prometheus.CounterVec
+	requestTimeByCodeDur                  *prometheus.HistogramVec
+	bytesAcceptedCnt                      *prometheus.CounterVec
+	bytesSentCnt                          *prometheus.CounterVec
+	bufferedBytes                         *prometheus.GaugeVec
+	aggregateFillRatio                    *prometheus.HistogramVec
+	overflowSpilledCnt                    *prometheus.CounterVec
+	overflowReplayedCnt                   *prometheus.CounterVec
+	batchSplitsCnt                        *prometheus.CounterVec
+	recordsDroppedCnt                     *prometheus.CounterVec
+	aggregationFallbackActive             *prometheus.GaugeVec
+	metricCardinalityWarningsCnt          *prometheus.CounterVec
+	effectiveFlushIntervalMs              *prometheus.GaugeVec
+	throttleWaitDur                       *prometheus.HistogramVec
+	teeDroppedCnt                         *prometheus.CounterVec
+	aggregateDistinctKeys                 *prometheus.HistogramVec
 }
 
-func getMetrics(logger Logger) *prometheusMetrics {
+func getMetrics(config *Config) *prometheusMetrics {
 	var userRecordsPutCnt = &metric{
 		ID:          "userRecordsPutCnt",
 		Name:        "user_records_put_total",
@@ -82,6 +106,7 @@ func getMetrics(logger Logger) *prometheusMetrics {
 		Description: "Number of retries performed per kinesis record. Zero is emitted for records that succeed in one try.",
 		Args:        []string{"stream"},
 		Type:        "histogram_vec",
+		Buckets:     retryBuckets,
 	}
 
 	var bufferingTimeDur = &metric{
@@ -120,6 +145,170 @@ func getMetrics(logger Logger) *prometheusMetrics {
 		Buckets:     sizeByteBuckets,
 	}
 
+	var inFlightRequestsCnt = &metric{
+		ID:          "inFlightRequestsCnt",
+		Name:        "in_flight_requests",
+		Description: "The number of PutRecords requests currently in flight.",
+		Args:        []string{"stream"},
+		Type:        "gauge_vec",
+	}
+
+	var lastSuccessfulFlushTs = &metric{
+		ID:          "lastSuccessfulFlushTs",
+		Name:        "last_successful_flush_timestamp_seconds",
+		Description: "The unix time of the last successful PutRecords request.",
+		Args:        []string{"stream"},
+		Type:        "gauge_vec",
+	}
+
+	var aggregationDecisionsCnt = &metric{
+		ID:          "aggregationDecisionsCnt",
+		Name:        "aggregation_decisions_total",
+		Description: "Count of user records sent aggregated or unaggregated, by decision.",
+		Args:        []string{"stream", "decision"},
+		Type:        "counter_vec",
+	}
+
+	var aggregateFlushCnt = &metric{
+		ID:          "aggregateFlushCnt",
+		Name:        "aggregate_flush_total",
+		Description: "Count of aggregated records closed, by the reason the aggregator was drained: size, count, keys, timer, idle or explicit.",
+		Args:        []string{"stream", "reason"},
+		Type:        "counter_vec",
+	}
+
+	var failuresDroppedCnt = &metric{
+		ID:          "failuresDroppedCnt",
+		Name:        "failures_dropped_total",
+		Description: "Count of failure records dropped, oldest first, because the failures channel was full.",
+		Args:        []string{"stream"},
+		Type:        "counter_vec",
+	}
+
+	var requestTimeByCodeDur = &metric{
+		ID:          "requestTimeByCodeDur",
+		Name:        "request_time_by_code_milliseconds",
+		Description: "The time it takes to perform PutRecordsRequests failing, by error code.",
+		Args:        []string{"stream", "code"},
+		Type:        "histogram_vec",
+		Buckets:     timeMillisecondBuckets,
+	}
+
+	var bytesAcceptedCnt = &metric{
+		ID:          "bytesAcceptedCnt",
+		Name:        "bytes_accepted_total",
+		Description: "Bytes of data and partition keys of the user records accepted by put operations.",
+		Args:        []string{"stream"},
+		Type:        "counter_vec",
+	}
+
+	var bytesSentCnt = &metric{
+		ID:          "bytesSentCnt",
+		Name:        "bytes_sent_total",
+		Description: "Bytes of data and partition keys of the Kinesis records sent with PutRecords requests, retries included.",
+		Args:        []string{"stream"},
+		Type:        "counter_vec",
+	}
+
+	var bufferedBytes = &metric{
+		ID:          "bufferedBytes",
+		Name:        "buffered_bytes",
+		Description: "The number of bytes of user records buffered by the producer, from Put until they are sent.",
+		Args:        []string{"stream"},
+		Type:        "gauge_vec",
+	}
+
+	var aggregateFillRatio = &metric{
+		ID:          "aggregateFillRatio",
+		Name:        "aggregate_fill_ratio",
+		Description: "The size of the aggregated records relative to the aggregation size, at each flush of the aggregator.",
+		Args:        []string{"stream"},
+		Type:        "histogram_vec",
+		Buckets:     ratioBuckets,
+	}
+
+	var overflowSpilledCnt = &metric{
+		ID:          "overflowSpilledCnt",
+		Name:        "overflow_spilled_total",
+		Description: "The number of user records spilled to the overflow store.",
+		Args:        []string{"stream"},
+		Type:        "counter_vec",
+	}
+
+	var overflowReplayedCnt = &metric{
+		ID:          "overflowReplayedCnt",
+		Name:        "overflow_replayed_total",
+		Description: "The number of user records replayed from the overflow store.",
+		Args:        []string{"stream"},
+		Type:        "counter_vec",
+	}
+
+	var batchSplitsCnt = &metric{
+		ID:          "batchSplitsCnt",
+		Name:        "batch_splits_total",
+		Description: "The number of batches cut short of the flush interval to fit the BatchSize or BatchCount limits of a PutRecords request.",
+		Args:        []string{"stream"},
+		Type:        "counter_vec",
+	}
+
+	var recordsDroppedCnt = &metric{
+		ID:          "recordsDroppedCnt",
+		Name:        "records_dropped_total",
+		Description: "The number of user records dropped by the producer, by reason.",
+		Args:        []string{"stream", "reason"},
+		Type:        "counter_vec",
+	}
+
+	var aggregationFallbackActive = &metric{
+		ID:          "aggregationFallbackActive",
+		Name:        "aggregation_fallback_active",
+		Description: "Whether the producer fell back to unaggregated records after repeated failures of aggregated ones, 1 if it did, 0 otherwise.",
+		Args:        []string{"stream"},
+		Type:        "gauge_vec",
+	}
+
+	var metricCardinalityWarningsCnt = &metric{
+		ID:          "metricCardinalityWarningsCnt",
+		Name:        "metric_cardinality_warnings_total",
+		Description: "Count of the distinct values of a label of a metric beyond Config.MetricCardinalityLimit.",
+		Args:        []string{"stream", "metric"},
+		Type:        "counter_vec",
+	}
+
+	var effectiveFlushIntervalMs = &metric{
+		ID:          "effectiveFlushIntervalMs",
+		Name:        "effective_flush_interval_milliseconds",
+		Description: "The flush interval in use, shrunk toward MinFlushInterval as the backlog fills up.",
+		Args:        []string{"stream"},
+		Type:        "gauge_vec",
+	}
+
+	var throttleWaitDur = &metric{
+		ID:          "throttleWaitDur",
+		Name:        "throttle_wait_milliseconds",
+		Description: "Time the user records waited to be admitted by MaxRecordsPerSecond, in milliseconds.",
+		Args:        []string{"stream"},
+		Type:        "histogram_vec",
+		Buckets:     timeMillisecondBuckets,
+	}
+
+	var teeDroppedCnt = &metric{
+		ID:          "teeDroppedCnt",
+		Name:        "tee_requests_dropped_total",
+		Description: "The number of PutRecords requests not mirrored to the tee, as its queue was full.",
+		Args:        []string{"stream"},
+		Type:        "counter_vec",
+	}
+
+	var aggregateDistinctKeys = &metric{
+		ID:          "aggregateDistinctKeys",
+		Name:        "aggregate_distinct_keys",
+		Description: "The number of distinct partition keys of the user records of each aggregated record drained.",
+		Args:        []string{"stream"},
+		Type:        "histogram_vec",
+		Buckets:     keyCountBuckets,
+	}
+
 	metricList := []*metric{
 		userRecordsPutCnt,
 		userRecordsDataPutSz,
@@ -132,14 +321,46 @@ func getMetrics(logger Logger) *prometheusMetrics {
 		requestTimeDur,
 		userRecordsPerKinesisRecordSum,
 		kinesisRecordsPerPutRecordsRequestSum,
+		inFlightRequestsCnt,
+		lastSuccessfulFlushTs,
+		aggregationDecisionsCnt,
+		aggregateFlushCnt,
+		failuresDroppedCnt,
+		requestTimeByCodeDur,
+		bytesAcceptedCnt,
+		bytesSentCnt,
+		bufferedBytes,
+		aggregateFillRatio,
+		overflowSpilledCnt,
+		overflowReplayedCnt,
+		batchSplitsCnt,
+		recordsDroppedCnt,
+		aggregationFallbackActive,
+		metricCardinalityWarningsCnt,
+		effectiveFlushIntervalMs,
+		throttleWaitDur,
+		teeDroppedCnt,
+		aggregateDistinctKeys,
 	}
 
 	p := &prometheusMetrics{}
+	disabled := make(map[string]bool, len(config.DisabledMetrics))
+	for _, name := range config.DisabledMetrics {
+		disabled[name] = true
+	}
 
 	for _, metricDef := range metricList {
-		metric := newMetric(metricDef, systemName)
-		if err := prometheus.Register(metric); err != nil {
-			logger.Error(fmt.Sprintf("%s could not be registered in Prometheus", metricDef.Name), err)
+		if buckets, ok := config.MetricBuckets[metricDef.Name]; ok {
+			metricDef.Buckets = buckets
+		}
+		metric := newMetric(metricDef, config.MetricNamespace, config.MetricSubsystem)
+		// disabled metrics are still collected, but never exposed
+		if !disabled[metricDef.Name] {
+			for _, registerer := range config.Registerers {
+				if err := registerer.Register(metric); err != nil {
+					config.Logger.Error(fmt.Sprintf("%s could not be registered in Prometheus", metricDef.Name), err)
+				}
+			}
 		}
 
 		switch metricDef {
@@ -165,6 +386,46 @@ func getMetrics(logger Logger) *prometheusMetrics {
 			p.userRecordsPerKinesisRecordSum = metric.(*prometheus.HistogramVec)
 		case kinesisRecordsPerPutRecordsRequestSum:
 			p.kinesisRecordsPerPutRecordsRequestSum = metric.(*prometheus.HistogramVec)
+		case inFlightRequestsCnt:
+			p.inFlightRequestsCnt = metric.(*prometheus.GaugeVec)
+		case lastSuccessfulFlushTs:
+			p.lastSuccessfulFlushTs = metric.(*prometheus.GaugeVec)
+		case aggregationDecisionsCnt:
+			p.aggregationDecisionsCnt = metric.(*prometheus.CounterVec)
+		case aggregateFlushCnt:
+			p.aggregateFlushCnt = metric.(*prometheus.CounterVec)
+		case failuresDroppedCnt:
+			p.failuresDroppedCnt = metric.(*prometheus.CounterVec)
+		case requestTimeByCodeDur:
+			p.requestTimeByCodeDur = metric.(*prometheus.HistogramVec)
+		case bytesAcceptedCnt:
+			p.bytesAcceptedCnt = metric.(*prometheus.CounterVec)
+		case bytesSentCnt:
+			p.bytesSentCnt = metric.(*prometheus.CounterVec)
+		case bufferedBytes:
+			p.bufferedBytes = metric.(*prometheus.GaugeVec)
+		case aggregateFillRatio:
+			p.aggregateFillRatio = metric.(*prometheus.HistogramVec)
+		case overflowSpilledCnt:
+			p.overflowSpilledCnt = metric.(*prometheus.CounterVec)
+		case overflowReplayedCnt:
+			p.overflowReplayedCnt = metric.(*prometheus.CounterVec)
+		case batchSplitsCnt:
+			p.batchSplitsCnt = metric.(*prometheus.CounterVec)
+		case recordsDroppedCnt:
+			p.recordsDroppedCnt = metric.(*prometheus.CounterVec)
+		case aggregationFallbackActive:
+			p.aggregationFallbackActive = metric.(*prometheus.GaugeVec)
+		case metricCardinalityWarningsCnt:
+			p.metricCardinalityWarningsCnt = metric.(*prometheus.CounterVec)
+		case effectiveFlushIntervalMs:
+			p.effectiveFlushIntervalMs = metric.(*prometheus.GaugeVec)
+		case throttleWaitDur:
+			p.throttleWaitDur = metric.(*prometheus.HistogramVec)
+		case teeDroppedCnt:
+			p.teeDroppedCnt = metric.(*prometheus.CounterVec)
+		case aggregateDistinctKeys:
+			p.aggregateDistinctKeys = metric.(*prometheus.HistogramVec)
 		}
 
 		metricDef.MetricCollector = metric
@@ -184,12 +445,13 @@ type metric struct {
 }
 
 // nolint funlen
-func newMetric(m *metric, subsystem string) prometheus.Collector {
+func newMetric(m *metric, namespace, subsystem string) prometheus.Collector {
 	var metric prometheus.Collector
 	switch m.Type {
 	case "counter_vec":
 		metric = prometheus.NewCounterVec(
 			prometheus.CounterOpts{
+				Namespace: namespace,
 				Subsystem: subsystem,
 				Name:      m.Name,
 				Help:      m.Description,
@@ -198,6 +460,7 @@ func newMetric(m *metric, subsystem string) prometheus.Collector {
 		)
 	case "histogram_vec":
 		opts := prometheus.HistogramOpts{
+			Namespace: namespace,
 			Subsystem: subsystem,
 			Name:      m.Name,
 			Help:      m.Description,
@@ -206,6 +469,16 @@ func newMetric(m *metric, subsystem string) prometheus.Collector {
 			opts.Buckets = append(opts.Buckets, m.Buckets...)
 		}
 		metric = prometheus.NewHistogramVec(opts, m.Args)
+	case "gauge_vec":
+		metric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      m.Name,
+				Help:      m.Description,
+			},
+			m.Args,
+		)
 	}
 	return metric
 }
@@ -0,0 +1,216 @@
+package producer
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// bucketsOf returns the upper bounds of the buckets of the histogram.
+func bucketsOf(o prometheus.Observer) (out []float64) {
+	m := new(dto.Metric)
+	o.(prometheus.Metric).Write(m)
+	for _, b := range m.GetHistogram().GetBucket() {
+		out = append(out, b.GetUpperBound())
+	}
+	return
+}
+
+func TestMetricBuckets(t *testing.T) {
+	p := New(&Config{
+		StreamName:    "foo",
+		MetricBuckets: map[string][]float64{"request_time_milliseconds": {1, 10}},
+		Client:        &clientMock{incoming: make(map[int][]string)},
+	})
+	retries := bucketsOf(p.metrics.retriesPerRecordSum.WithLabelValues("foo"))
+	assert(t, len(retries) == len(retryBuckets) && retries[1] == 1, "expect integer buckets for the retries")
+	requests := bucketsOf(p.metrics.requestTimeDur.WithLabelValues("foo"))
+	assert(t, len(requests) == 2 && requests[1] == 10, "expect the buckets to be overridden")
+}
+
+func TestRequestTimeByCode(t *testing.T) {
+	p := New(&Config{
+		StreamName:      "foo",
+		MaxConnections:  1,
+		DisabledMetrics: []string{"request_time_by_code_milliseconds"},
+		Client: &clientMock{
+			incoming:  make(map[int][]string),
+			responses: []responseMock{{Error: awserr.New(k.ErrCodeResourceNotFoundException, "stream not found", nil)}},
+		},
+	})
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Stop()
+	m := new(dto.Metric)
+	p.metrics.requestTimeByCodeDur.WithLabelValues("foo", k.ErrCodeResourceNotFoundException).(prometheus.Metric).Write(m)
+	assert(t, m.GetHistogram().GetSampleCount() == 1, "expect the failed request to be observed by error code")
+}
+
+func TestBytesCounters(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		AggregateBatchCount: 1,
+		Client: &clientMock{
+			incoming: make(map[int][]string),
+			responses: []responseMock{
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(1),
+						Records: []*k.PutRecordsResultEntry{
+							{ErrorCode: aws.String("ProvisionedThroughputExceededException"), ErrorMessage: aws.String("error")},
+						},
+					},
+				},
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(0),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+						},
+					},
+				},
+			},
+		},
+	})
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Stop()
+	accepted := testutil.ToFloat64(p.metrics.bytesAcceptedCnt.WithLabelValues("foo"))
+	sent := testutil.ToFloat64(p.metrics.bytesSentCnt.WithLabelValues("foo"))
+	assert(t, accepted == 10, "expect the accepted bytes to be counted")
+	assert(t, sent > 2*accepted, "expect the sent bytes to count the aggregation overhead and the retries")
+}
+
+func TestAggregateFillRatio(t *testing.T) {
+	p := New(&Config{
+		StreamName:         "foo",
+		AggregateBatchSize: 1000,
+		Client:             &clientMock{incoming: make(map[int][]string)},
+	})
+	data := make([]byte, 100)
+	for i := 0; i < 12; i++ {
+		p.Put(data, "foo")
+	}
+	p.drainIfNeed("explicit")
+	m := new(dto.Metric)
+	p.metrics.aggregateFillRatio.WithLabelValues("foo").(prometheus.Metric).Write(m)
+	h := m.GetHistogram()
+	assert(t, h.GetSampleCount() == 2, "expect the fill ratio to be observed at each aggregate flush")
+	assert(t, h.GetSampleSum() > 1 && h.GetSampleSum() < 2, "expect the fill ratios to be relative to the aggregation size")
+	assert(t, h.GetBucket()[8].GetCumulativeCount() == 1, "expect the full aggregate to be over 0.9")
+}
+
+func TestBatchSplits(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		BatchCount:          2,
+		AggregateBatchCount: 1,
+		Client: &clientMock{
+			incoming: make(map[int][]string),
+			responses: []responseMock{
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(0),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+							{SequenceNumber: aws.String("2"), ShardId: aws.String("1")},
+						},
+					},
+				},
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(0),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("3"), ShardId: aws.String("1")},
+						},
+					},
+				},
+			},
+		},
+	})
+	p.Start()
+	for _, key := range []string{"a", "b", "c"} {
+		p.Put([]byte(key), key)
+	}
+	p.Stop()
+	splits := testutil.ToFloat64(p.metrics.batchSplitsCnt.WithLabelValues("foo"))
+	assert(t, splits == 1, "expect the batch split to fit BatchCount to be counted")
+}
+
+func TestBatchSplitsFullBatch(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		BatchCount: 2,
+		Client:     &successClient{},
+	})
+	p.Start()
+	for _, key := range []string{"a", "b"} {
+		p.Put([]byte(key), key)
+	}
+	p.Stop()
+	splits := testutil.ToFloat64(p.metrics.batchSplitsCnt.WithLabelValues("foo"))
+	assert(t, splits == 0, "expect a batch reaching BatchCount without a record carried over not to be counted")
+}
+
+func TestMetricCardinalityLimit(t *testing.T) {
+	p := New(&Config{
+		StreamName:             "cardinality",
+		MetricCardinalityLimit: 2,
+		Client:                 &clientMock{incoming: make(map[int][]string)},
+	})
+	warnings := p.metrics.metricCardinalityWarningsCnt.WithLabelValues("cardinality", "kinesis_records_put_total")
+	for _, shardID := range []string{"1", "2", "2", "1"} {
+		p.produce(&kinesisRecord{PutRecordsRequestEntry: &k.PutRecordsRequestEntry{PartitionKey: aws.String("k")}, count: 1}, shardID, "1", false)
+	}
+	assert(t, testutil.ToFloat64(warnings) == 0, "should not warn within the limit")
+	for _, shardID := range []string{"3", "4", "3"} {
+		p.produce(&kinesisRecord{PutRecordsRequestEntry: &k.PutRecordsRequestEntry{PartitionKey: aws.String("k")}, count: 1}, shardID, "1", false)
+	}
+	assert(t, testutil.ToFloat64(warnings) == 2, "expect a warning per label value beyond the limit")
+}
+
+func TestMetricSubsystem(t *testing.T) {
+	p := New(&Config{
+		StreamName:      "foo",
+		MetricNamespace: "team",
+		MetricSubsystem: "producer",
+		Client:          &clientMock{incoming: make(map[int][]string)},
+	})
+	p.metrics.userRecordsPutCnt.WithLabelValues("foo").Inc()
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert(t, err == nil, "should not return an error")
+	found := false
+	for _, f := range families {
+		found = found || f.GetName() == "team_producer_user_records_put_total"
+	}
+	assert(t, found, "expect the metrics to be named after the namespace and subsystem")
+	assert(t, New(&Config{StreamName: "foo"}).MetricSubsystem == "go_kinesis_producer", "expect the default subsystem")
+}
+
+func TestRegisterers(t *testing.T) {
+	local, pushed := prometheus.NewRegistry(), prometheus.NewRegistry()
+	p := New(&Config{
+		StreamName:  "foo",
+		Registerers: []prometheus.Registerer{local, pushed},
+		Client:      &clientMock{incoming: make(map[int][]string)},
+	})
+	p.Put([]byte("hello"), "hello")
+	for _, registry := range []*prometheus.Registry{local, pushed} {
+		families, err := registry.Gather()
+		assert(t, err == nil, "should gather the metrics")
+		var puts float64
+		for _, f := range families {
+			if f.GetName() == "go_kinesis_producer_user_records_put_total" {
+				puts = f.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		assert(t, puts == 1, "expect each registry to see the record put")
+	}
+}
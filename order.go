@@ -0,0 +1,55 @@
+package producer
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// totalOrderHashKey is the explicit hash key of the Kinesis records put with
+// `Config.TotalOrder`, the lowest of the hash key range, so that they all go to
+// the same shard whatever their partition keys.
+const totalOrderHashKey = "0"
+
+// pinShard sets the explicit hash key of the record, with `Config.TotalOrder`.
+func (p *Producer) pinShard(record *kinesisRecord) {
+	if p.TotalOrder {
+		record.ExplicitHashKey = aws.String(totalOrderHashKey)
+	}
+}
+
+// PutWithOrdering `data` using `partitionKey` like `Put`, but sorts the user records of
+// its aggregate by `orderingKey`, e.g. an entity ID, while the partition key picks the
+// shard, e.g. a tenant ID. The records of an ordering key are thus contiguous in the
+// aggregated record, in the order they were put, for consumers to read entity-ordered
+// substreams. The order only holds within an aggregate: the records of a key spread over
+// several aggregates keep the order of their requests, which retries may change, like
+// `Put`. Records put without ordering key come first. The aggregates holding records put
+// with an ordering key are serialized once drained, rather than as their records are put.
+func (p *Producer) PutWithOrdering(data []byte, partitionKey, orderingKey string) error {
+	return p.put(&userRecord{data: data, partitionKey: partitionKey, orderingKey: orderingKey})
+}
+
+// sortByOrderingKey sorts the user records by ordering key, if any was put with one,
+// keeping the order they were put in for the ones of the same key.
+func (a *Aggregator) sortByOrderingKey() {
+	if !a.ordered {
+		return
+	}
+	key := func(i int) string {
+		if m := a.metas[i]; m != nil {
+			return m.orderingKey
+		}
+		return ""
+	}
+	order := make([]int, len(a.buf))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return key(order[i]) < key(order[j]) })
+	buf, metas := make([]*Record, len(a.buf)), make([]*userMeta, len(a.metas))
+	for i, j := range order {
+		buf[i], metas[i] = a.buf[j], a.metas[j]
+	}
+	a.buf, a.metas = buf, metas
+}
@@ -0,0 +1,106 @@
+package producer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// orderClient throttles every third request, keeping the records put in order.
+type orderClient struct {
+	sync.Mutex
+	requests int
+	records  []*k.PutRecordsRequestEntry
+	// max is the maximum number of records of a request.
+	max int
+}
+
+func (c *orderClient) PutRecords(input *k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.requests++
+	if len(input.Records) > c.max {
+		c.max = len(input.Records)
+	}
+	out := &k.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, r := range input.Records {
+		if c.requests%3 == 0 {
+			out.Records = append(out.Records, &k.PutRecordsResultEntry{ErrorCode: aws.String(k.ErrCodeProvisionedThroughputExceededException), ErrorMessage: aws.String("throttled")})
+			*out.FailedRecordCount++
+			continue
+		}
+		c.records = append(c.records, r)
+		out.Records = append(out.Records, &k.PutRecordsResultEntry{SequenceNumber: aws.String("1"), ShardId: aws.String("1")})
+	}
+	return out, nil
+}
+
+func TestTotalOrder(t *testing.T) {
+	client := &orderClient{}
+	p := New(&Config{
+		StreamName:             "foo",
+		TotalOrder:             true,
+		AggregateBatchCount:    3,
+		AggregateBatchSize:     100,
+		AggregateMinKeyRecords: 2,
+		Client:                 client,
+	})
+	assert(t, p.MaxConnections == 1 && p.BatchCount == 1 && p.AggregateMinKeyRecords == 0, "expect a single request in flight, of a single record")
+	p.Start()
+	for i := 0; i < 50; i++ {
+		data, key := []byte(fmt.Sprintf("%02d", i)), fmt.Sprintf("key-%d", i%7)
+		// the records too large to be aggregated keep their order too, routed
+		// ones being rejected rather than losing their route
+		if i%7 == 3 && i%5 != 0 {
+			data = append(data, bytes.Repeat([]byte("-"), 200)...)
+		}
+		if i%5 == 0 {
+			p.PutWithRoute(data, key, "alerts")
+		} else {
+			p.Put(data, key)
+		}
+	}
+	p.Stop()
+
+	assert(t, client.max == 1, "expect one record per request")
+	var data []string
+	for _, r := range client.records {
+		assert(t, aws.StringValue(r.ExplicitHashKey) == totalOrderHashKey, "expect the records to be put into the same shard")
+		out, err := Deaggregate(r.Data, *r.PartitionKey)
+		assert(t, err == nil, "should not return an error")
+		for _, u := range out {
+			data = append(data, string(u.Data))
+		}
+	}
+	assert(t, len(data) == 50, "expect all the records to be sent")
+	for i, d := range data {
+		assert(t, d[:2] == fmt.Sprintf("%02d", i), fmt.Sprintf("expect the records in the order put, got %s at %d", d[:2], i))
+	}
+}
+
+func TestPutWithOrdering(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+	})
+	puts := []struct{ data, entity string }{
+		{"b1", "b"}, {"a1", "a"}, {"x", ""}, {"b2", "b"}, {"a2", "a"}, {"c1", "c"}, {"a3", "a"},
+	}
+	for _, r := range puts {
+		assert(t, p.PutWithOrdering([]byte(r.data), "tenant", r.entity) == nil, "should put the record")
+	}
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1 && len(records[0].metas) == len(puts), "expect a single aggregated record")
+	out, err := Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil, "should not return an error")
+	var data []string
+	for _, u := range out {
+		assert(t, u.PartitionKey == "tenant", "expect the records to keep their partition key")
+		data = append(data, string(u.Data))
+	}
+	assert(t, fmt.Sprint(data) == "[x a1 a2 a3 b1 b2 c1]", "expect the records sorted by ordering key, in the order put, got: "+fmt.Sprint(data))
+}
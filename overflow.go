@@ -0,0 +1,318 @@
+package producer
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// OverflowRecord is a user record spilled to an OverflowStore.
+type OverflowRecord struct {
+	Data         []byte
+	PartitionKey string
+	Route        string
+}
+
+// OverflowStore keeps the user records that don't fit in the memory of the producer,
+// in order, until they are replayed. Its methods may be called concurrently.
+type OverflowStore interface {
+	// Push the record at the end of the store.
+	Push(r OverflowRecord) error
+	// Peek returns the oldest record of the store, or false if the store is empty.
+	Peek() (OverflowRecord, bool, error)
+	// Remove the oldest record of the store.
+	Remove() error
+	// Len returns the number of records in the store.
+	Len() int
+}
+
+// closedDone is the done channel of the user records that don't wait for the backlog.
+var closedDone = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// spillable reports whether the user record may be spilled to the overflow store.
+// Its meta and options, if any, can't be, but its route.
+func (p *Producer) spillable(r *userRecord) bool {
+	if p.OverflowStore == nil {
+		return false
+	}
+	m := r.meta()
+	return m == nil || m.routeOnly()
+}
+
+// putOrSpill adds the user record, or spills it to the overflow store if the backlog
+// is full, or if older records are spilled already, so that the records keep their order.
+func (p *Producer) putOrSpill(r *userRecord) error {
+	if p.OverflowStore.Len() == 0 {
+		if r.done == nil {
+			r.done = closedDone
+		}
+		if err := p.add(r); err != ErrBacklogFull {
+			return err
+		}
+	}
+	p.metrics.overflowSpilledCnt.WithLabelValues(p.MetricStreamLabel).Inc()
+	return p.OverflowStore.Push(OverflowRecord{Data: r.data, PartitionKey: r.partitionKey, Route: r.route})
+}
+
+// replayOverflow adds the records of the overflow store back to the producer, in order, at
+// every flush interval, as long as the backlog has room for them, until overflowDone is closed.
+func (p *Producer) replayOverflow() {
+	defer close(p.overflowReplayed)
+	tick := time.NewTicker(p.getFlushInterval())
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-p.overflowDone:
+			if n := p.OverflowStore.Len(); n > 0 {
+				p.Logger.Info("records left in the overflow store", LogValue{"records", n})
+			}
+			return
+		}
+		for {
+			r, ok, err := p.OverflowStore.Peek()
+			if err != nil {
+				p.Logger.Error("replay overflow", err)
+			}
+			if !ok || err != nil {
+				break
+			}
+			err = p.add(&userRecord{data: r.Data, partitionKey: r.PartitionKey, route: r.Route, done: closedDone})
+			if err == ErrBacklogFull {
+				break
+			}
+			if err := p.OverflowStore.Remove(); err != nil {
+				p.Logger.Error("replay overflow", err)
+				break
+			}
+			p.metrics.overflowReplayedCnt.WithLabelValues(p.MetricStreamLabel).Inc()
+		}
+	}
+}
+
+// FileOverflowStore is an OverflowStore persisting the records to a file, so that the
+// records left in it when the producer stops are replayed by the next producer using it.
+// The file is not synced on every record, so the records may be lost when the machine,
+// rather than the process, crashes. It is compacted once the removed records take more
+// than half of it, by rewriting the records left into a new file renamed over it.
+type FileOverflowStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	// head and end are the offsets of the oldest record and the end of the records,
+	// which start after the header holding the head. size is the size of the file.
+	head, end, size int64
+	count           int
+}
+
+// overflowHeaderSize is the size of the header of the file, holding the head offset.
+const overflowHeaderSize = 8
+
+// NewFileOverflowStore opens the overflow store persisted to the file at `path`, creating
+// it if needed. The records already in the file are kept, unless it is removed first.
+func NewFileOverflowStore(path string) (*FileOverflowStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileOverflowStore{path: path, file: file, head: overflowHeaderSize, end: overflowHeaderSize}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load the head offset, and count the records, cutting the last one if incomplete.
+func (s *FileOverflowStore) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < overflowHeaderSize {
+		return s.reset()
+	}
+	s.size = info.Size()
+	var header [overflowHeaderSize]byte
+	if _, err := s.file.ReadAt(header[:], 0); err != nil {
+		return err
+	}
+	s.head = int64(binary.BigEndian.Uint64(header[:]))
+	if s.head < overflowHeaderSize || s.head > info.Size() {
+		return errors.New("kinesis: corrupted overflow store")
+	}
+	for s.end = s.head; ; s.count++ {
+		_, n, err := s.read(s.end)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		s.end += n
+	}
+	s.size = s.end
+	return s.file.Truncate(s.end)
+}
+
+// reset the file to an empty store.
+func (s *FileOverflowStore) reset() error {
+	if err := s.file.Truncate(overflowHeaderSize); err != nil {
+		return err
+	}
+	s.head, s.end, s.size, s.count = overflowHeaderSize, overflowHeaderSize, overflowHeaderSize, 0
+	return s.writeHead()
+}
+
+func (s *FileOverflowStore) writeHead() error {
+	return writeOverflowHead(s.file, s.head)
+}
+
+func writeOverflowHead(file *os.File, head int64) error {
+	var header [overflowHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:], uint64(head))
+	_, err := file.WriteAt(header[:], 0)
+	return err
+}
+
+// compact the file, once the removed records take more than half of it, by copying the
+// records left into a new file, renamed over the file, so that a crash leaves either.
+func (s *FileOverflowStore) compact() error {
+	if s.head-overflowHeaderSize <= s.end-s.head {
+		return nil
+	}
+	file, err := os.OpenFile(s.path+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n := s.end - s.head
+	err = writeOverflowHead(file, overflowHeaderSize)
+	if err == nil {
+		_, err = file.Seek(overflowHeaderSize, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(file, io.NewSectionReader(s.file, s.head, n))
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.head, s.end, s.size = overflowHeaderSize, overflowHeaderSize+n, overflowHeaderSize+n
+	return nil
+}
+
+// read the record at `offset`, and return its size in the file.
+// A record is stored as the sizes of its fields, followed by the fields.
+func (s *FileOverflowStore) read(offset int64) (OverflowRecord, int64, error) {
+	var sizes [12]byte
+	if _, err := s.file.ReadAt(sizes[:], offset); err != nil {
+		if err == io.EOF && offset < s.size {
+			err = io.ErrUnexpectedEOF
+		}
+		return OverflowRecord{}, 0, err
+	}
+	dataSize := binary.BigEndian.Uint32(sizes[0:])
+	keySize := binary.BigEndian.Uint32(sizes[4:])
+	routeSize := binary.BigEndian.Uint32(sizes[8:])
+	size := int64(dataSize) + int64(keySize) + int64(routeSize)
+	if offset+int64(len(sizes))+size > s.size {
+		return OverflowRecord{}, 0, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, size)
+	if _, err := s.file.ReadAt(buf, offset+int64(len(sizes))); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return OverflowRecord{}, 0, err
+	}
+	r := OverflowRecord{
+		Data:         buf[:dataSize],
+		PartitionKey: string(buf[dataSize : dataSize+keySize]),
+		Route:        string(buf[dataSize+keySize:]),
+	}
+	return r, int64(len(sizes) + len(buf)), nil
+}
+
+// Push the record at the end of the file.
+func (s *FileOverflowStore) Push(r OverflowRecord) error {
+	buf := make([]byte, 12, 12+len(r.Data)+len(r.PartitionKey)+len(r.Route))
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(r.Data)))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(r.PartitionKey)))
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(r.Route)))
+	buf = append(buf, r.Data...)
+	buf = append(buf, r.PartitionKey...)
+	buf = append(buf, r.Route...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.WriteAt(buf, s.end); err != nil {
+		return err
+	}
+	s.end += int64(len(buf))
+	s.size = s.end
+	s.count++
+	return nil
+}
+
+// Peek returns the oldest record of the file.
+func (s *FileOverflowStore) Peek() (OverflowRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return OverflowRecord{}, false, nil
+	}
+	r, _, err := s.read(s.head)
+	if err != nil {
+		return OverflowRecord{}, false, err
+	}
+	return r, true, nil
+}
+
+// Remove the oldest record of the file, truncating it once empty, or compacting it once
+// the removed records take more than half of it.
+func (s *FileOverflowStore) Remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return nil
+	}
+	_, n, err := s.read(s.head)
+	if err != nil {
+		return err
+	}
+	if s.count == 1 {
+		return s.reset()
+	}
+	s.head += n
+	s.count--
+	if err := s.writeHead(); err != nil {
+		return err
+	}
+	return s.compact()
+}
+
+// Len returns the number of records in the file.
+func (s *FileOverflowStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Close the file. The records left in it are kept.
+func (s *FileOverflowStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,144 @@
+package producer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// successClient accepts all the records, in a thread-safe way.
+type successClient struct {
+	sync.Mutex
+	keys []string
+}
+
+func (c *successClient) PutRecords(input *k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	c.Lock()
+	defer c.Unlock()
+	out := &k.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, r := range input.Records {
+		c.keys = append(c.keys, *r.PartitionKey)
+		out.Records = append(out.Records, &k.PutRecordsResultEntry{SequenceNumber: aws.String("1"), ShardId: aws.String("1")})
+	}
+	return out, nil
+}
+
+func TestFileOverflowStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overflow")
+	assert(t, err == nil, "should not return an error")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "overflow")
+
+	s, err := NewFileOverflowStore(path)
+	assert(t, err == nil, "should not return an error")
+	for _, key := range []string{"a", "b", "c"} {
+		assert(t, s.Push(OverflowRecord{Data: []byte("data-" + key), PartitionKey: key, Route: "r"}) == nil, "should push the record")
+	}
+	r, ok, err := s.Peek()
+	assert(t, err == nil && ok && r.PartitionKey == "a" && string(r.Data) == "data-a" && r.Route == "r", "expect the oldest record")
+	assert(t, s.Remove() == nil && s.Len() == 2, "expect the oldest record to be removed")
+	s.Close()
+
+	// an incomplete record, e.g. of a crashed process, is left out
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert(t, err == nil, "should not return an error")
+	f.Write([]byte{0, 0, 0, 10, 0})
+	f.Close()
+
+	s, err = NewFileOverflowStore(path)
+	assert(t, err == nil, "should not return an error")
+	assert(t, s.Len() == 2, "expect the records left in the file to be recovered")
+	r, ok, _ = s.Peek()
+	assert(t, ok && r.PartitionKey == "b", "expect the recovered records to keep their order")
+	s.Remove()
+	s.Remove()
+	_, ok, _ = s.Peek()
+	assert(t, !ok && s.Len() == 0, "expect the store to be empty")
+	assert(t, s.Push(OverflowRecord{Data: []byte("data-d"), PartitionKey: "d"}) == nil, "should push the record")
+	r, ok, _ = s.Peek()
+	assert(t, ok && r.PartitionKey == "d", "expect the store to be reused once empty")
+	s.Close()
+}
+
+func TestOverflowStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overflow")
+	assert(t, err == nil, "should not return an error")
+	defer os.RemoveAll(dir)
+	store, err := NewFileOverflowStore(filepath.Join(dir, "overflow"))
+	assert(t, err == nil, "should not return an error")
+	defer store.Close()
+
+	client := &successClient{}
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		BacklogCount:        1,
+		AggregateBatchCount: 1,
+		FlushInterval:       10 * time.Millisecond,
+		OverflowStore:       store,
+		Client:              client,
+	})
+	// the loop is not started yet, so the backlog is not consumed
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, key := range keys {
+		err := p.Put([]byte(key), key)
+		assert(t, err == nil, "expect the records not to block on the full backlog")
+	}
+	assert(t, store.Len() == 3, "expect the records not fitting in the backlog to be spilled")
+
+	p.Start()
+	deadline := time.Now().Add(time.Second)
+	for store.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	p.Stop()
+	assert(t, store.Len() == 0, "expect the spilled records to be replayed")
+	client.Lock()
+	defer client.Unlock()
+	assert(t, len(client.keys) == len(keys), "expect all the records to be sent")
+	for i, key := range client.keys {
+		assert(t, key == keys[i], "expect the records to keep their order")
+	}
+}
+
+func TestFileOverflowStoreCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overflow")
+	assert(t, err == nil, "should not return an error")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "overflow")
+
+	s, err := NewFileOverflowStore(path)
+	assert(t, err == nil, "should not return an error")
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		assert(t, s.Push(OverflowRecord{Data: []byte("data-" + key), PartitionKey: key}) == nil, "should push the record")
+	}
+	info, _ := os.Stat(path)
+	size := info.Size()
+	s.Remove()
+	s.Remove()
+	info, _ = os.Stat(path)
+	assert(t, info.Size() == size, "expect the file not to be compacted while the records left take most of it")
+	s.Remove()
+	info, _ = os.Stat(path)
+	assert(t, info.Size() < size/2, "expect the file to be compacted once the removed records take most of it")
+	assert(t, s.Push(OverflowRecord{Data: []byte("data-f"), PartitionKey: "f"}) == nil, "should push the record")
+	s.Close()
+
+	s, err = NewFileOverflowStore(path)
+	assert(t, err == nil, "should not return an error")
+	var keys []string
+	for s.Len() > 0 {
+		r, _, _ := s.Peek()
+		keys = append(keys, r.PartitionKey)
+		s.Remove()
+	}
+	assert(t, strings.Join(keys, "") == "def", "expect the compacted file to keep the records in order, got: "+strings.Join(keys, ""))
+	s.Close()
+}
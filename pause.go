@@ -0,0 +1,55 @@
+package producer
+
+import "sync/atomic"
+
+// Pause stops sending records to the stream, while `Put` keeps aggregating them into
+// the backlog. Once the backlog is full, `Put` fails with `ErrBacklogFull`, rather than
+// blocking, until the producer is resumed. Records already in flight are unaffected.
+// A producer paused before `Start` starts paused.
+func (p *Producer) Pause() {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	p.Lock()
+	if p.stopped || p.paused {
+		p.Unlock()
+		return
+	}
+	p.paused = true
+	p.Unlock()
+	if p.running {
+		p.pause <- true
+	}
+	p.Logger.Info("paused producer", LogValue{"stream", p.StreamName})
+	p.emit(EventPaused, 0, "")
+}
+
+// Resume sending the records to the stream, after a `Pause`.
+func (p *Producer) Resume() {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	p.resume()
+}
+
+// resume the producer if paused, and pipe the held records into the backlog.
+// It must be called with the pause lock held.
+func (p *Producer) resume() {
+	p.Lock()
+	if !p.paused {
+		p.Unlock()
+		return
+	}
+	p.paused = false
+	held := p.held
+	p.held = nil
+	atomic.StoreInt32(&p.holding, 0)
+	p.Unlock()
+	if p.running {
+		p.pause <- false
+	}
+	for _, record := range held {
+		p.enqueue(record)
+	}
+	p.signalRoom()
+	p.Logger.Info("resumed producer", LogValue{"stream", p.StreamName})
+	p.emit(EventResumed, 0, "")
+}
@@ -0,0 +1,65 @@
+package producer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestPauseResume(t *testing.T) {
+	client := &clientMock{
+		incoming: make(map[int][]string),
+		responses: []responseMock{
+			{
+				Response: &k.PutRecordsOutput{
+					FailedRecordCount: aws.Int64(0),
+					Records: []*k.PutRecordsResultEntry{
+						{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+						{SequenceNumber: aws.String("2"), ShardId: aws.String("1")},
+					},
+				},
+			},
+		},
+	}
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		BatchCount:          2,
+		BacklogCount:        1,
+		AggregateBatchCount: 1,
+		Client:              client,
+	})
+	p.Start()
+	p.Pause()
+	// the first record is aggregated, the second one drains it into the backlog,
+	// and the third one needs room the backlog doesn't have.
+	assert(t, p.Put([]byte("hello"), "hello") == nil, "expect first record to be aggregated")
+	assert(t, p.Put([]byte("world"), "world") == nil, "expect second record to be put")
+	assert(t, p.Put([]byte("foo"), "foo") == ErrBacklogFull, "expect full backlog to reject records while paused")
+	p.Resume()
+	p.Stop()
+
+	assert(t, client.calls == 1, "expect the records to be flushed once resumed")
+	assert(t, len(client.incoming[0]) == 2, "expect the buffered records to be flushed")
+}
+
+func TestPauseBeforeStart(t *testing.T) {
+	client := &successClient{}
+	p := New(&Config{
+		StreamName:          "foo",
+		AggregateBatchCount: 1,
+		FlushInterval:       time.Millisecond,
+		Client:              client,
+	})
+	p.Pause()
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	time.Sleep(10 * time.Millisecond)
+	assert(t, p.Stats().Produced == 0, "expect a producer paused before Start to start paused")
+	p.Resume()
+	p.Stop()
+	assert(t, p.Stats().Produced == 2, "expect the records to be produced once resumed")
+}
@@ -0,0 +1,150 @@
+package producer
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// PutWithPriority `data` using `partitionKey` ahead of the prioritized records of lower
+// priority. Prioritized records wait in a queue of `Config.BacklogCount` records of
+// their own, drained highest priority first into the aggregator like `Put`. When the
+// queue is full, the prioritized record of the lowest priority is dropped: either the
+// one being put, in which case `ErrBacklogFull` is returned, or a queued one, which is
+// then reported as a failure.
+// Note that the priority only orders the prioritized records among themselves: once
+// drained, they share the aggregator and the backlog with the `Put` ones, and wait
+// behind them for room in a full backlog. `Put` records are never dropped, nor
+// overtaken in the backlog, in favor of prioritized ones. Prioritized records do not
+// keep their order relative to `Put` ones, and are reported as failures with
+// `ErrBacklogFull` when the backlog is full while paused.
+func (p *Producer) PutWithPriority(data []byte, partitionKey string, priority int) error {
+	r := &userRecord{data: data, partitionKey: partitionKey}
+	if err := p.encode(r); err != nil {
+		return err
+	}
+	if err := p.validate(r); err != nil {
+		return err
+	}
+	dropped, err := p.priority.push(r, priority)
+	if err != nil {
+		return err
+	}
+	if dropped != nil {
+		p.dispatchFailures([]*kinesisRecord{dropped.kinesisRecord()}, ErrBacklogFull)
+	}
+	return nil
+}
+
+// drainPriority pops the prioritized records into the aggregator, through the same
+// dedupe and key tracking as `Put`, until the queue is closed and empty.
+func (p *Producer) drainPriority() {
+	defer close(p.priorityDone)
+	for {
+		r, ok := p.priority.pop()
+		if !ok {
+			return
+		}
+		if err := p.admit(r); err != nil {
+			p.dispatchFailures([]*kinesisRecord{r.kinesisRecord()}, err)
+		}
+	}
+}
+
+// prioritizedRecord is a user record waiting in the priority queue.
+type prioritizedRecord struct {
+	*userRecord
+	priority int
+	// seq keeps records of the same priority in order.
+	seq uint64
+}
+
+// priorityHeap implements heap.Interface, with the highest priority first.
+type priorityHeap []*prioritizedRecord
+
+func (h priorityHeap) Len() int { return len(h) }
+
+func (h priorityHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h priorityHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *priorityHeap) Push(x interface{}) { *h = append(*h, x.(*prioritizedRecord)) }
+
+func (h *priorityHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
+
+// priorityQueue is a bounded, blocking priority queue of user records.
+type priorityQueue struct {
+	sync.Mutex
+	cond   *sync.Cond
+	heap   priorityHeap
+	size   int
+	seq    uint64
+	closed bool
+}
+
+func newPriorityQueue(size int) *priorityQueue {
+	q := &priorityQueue{size: size}
+	q.cond = sync.NewCond(q)
+	return q
+}
+
+// push the record into the queue, and return the record dropped to make room
+// for it, if any. ErrBacklogFull is returned when the record itself is dropped.
+func (q *priorityQueue) push(r *userRecord, priority int) (*userRecord, error) {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return nil, ErrStoppedProducer
+	}
+	var dropped *userRecord
+	if len(q.heap) >= q.size {
+		// the lowest priority, and the most recent among equals, is dropped first
+		lowest := 0
+		for i, x := range q.heap {
+			if x.priority < q.heap[lowest].priority || x.priority == q.heap[lowest].priority && x.seq > q.heap[lowest].seq {
+				lowest = i
+			}
+		}
+		if priority <= q.heap[lowest].priority {
+			return nil, ErrBacklogFull
+		}
+		dropped = heap.Remove(&q.heap, lowest).(*prioritizedRecord).userRecord
+	}
+	q.seq++
+	heap.Push(&q.heap, &prioritizedRecord{userRecord: r, priority: priority, seq: q.seq})
+	q.cond.Signal()
+	return dropped, nil
+}
+
+// pop the record of the highest priority, blocking until there is one.
+// It returns false once the queue is closed and empty.
+func (q *priorityQueue) pop() (*userRecord, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.heap) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.heap) == 0 {
+		return nil, false
+	}
+	return heap.Pop(&q.heap).(*prioritizedRecord).userRecord, true
+}
+
+// close the queue. Queued records are still popped.
+func (q *priorityQueue) close() {
+	q.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.Unlock()
+}
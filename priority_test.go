@@ -0,0 +1,70 @@
+package producer
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	q := newPriorityQueue(3)
+	push := func(key string, priority int) (*userRecord, error) {
+		return q.push(&userRecord{partitionKey: key}, priority)
+	}
+	push("low", 1)
+	push("high", 5)
+	push("mid", 3)
+
+	_, err := push("lowest", 0)
+	assert(t, err == ErrBacklogFull, "expect the lowest priority record to be rejected")
+	dropped, err := push("higher", 4)
+	assert(t, err == nil, "expect the record to be queued")
+	assert(t, dropped != nil && dropped.partitionKey == "low", "expect the lowest priority record to be dropped")
+
+	q.close()
+	_, err = push("closed", 10)
+	assert(t, err == ErrStoppedProducer, "expect closed queue to reject records")
+
+	var keys []string
+	for {
+		r, ok := q.pop()
+		if !ok {
+			break
+		}
+		keys = append(keys, r.partitionKey)
+	}
+	assert(t, len(keys) == 3 && keys[0] == "high" && keys[1] == "higher" && keys[2] == "mid", "expect records by priority")
+}
+
+func TestPutWithPriority(t *testing.T) {
+	client := &clientMock{
+		incoming: make(map[int][]string),
+		responses: []responseMock{
+			{
+				Response: &k.PutRecordsOutput{
+					FailedRecordCount: aws.Int64(0),
+					Records:           []*k.PutRecordsResultEntry{{SequenceNumber: aws.String("1"), ShardId: aws.String("1")}},
+				},
+			},
+		},
+	}
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		AggregateBatchCount: 1,
+		Client:              client,
+	})
+	p.Start()
+	err := p.PutWithPriority([]byte("hello"), "hello", 1)
+	assert(t, err == nil, "expect record to be put")
+	p.Stop()
+	err = p.PutWithPriority([]byte("world"), "world", 1)
+	assert(t, err == ErrStoppedProducer, "expect stopped producer to reject records")
+
+	var records int
+	for _, keys := range client.incoming {
+		records += len(keys)
+	}
+	assert(t, records == 1, "expect prioritized record to be flushed on stop")
+}
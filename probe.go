@@ -0,0 +1,106 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// ErrProbeUnsupported is returned by `Probe` when the client does not implement
+// DescribeStreamSummary and no `Config.ProbePartitionKey` is set.
+var ErrProbeUnsupported = errors.New("Unable to probe the stream. Client does not describe streams")
+
+// contextDescriber is the part of the KinesisAPI that describes a stream with a
+// context, implemented by the SDK clients.
+type contextDescriber interface {
+	DescribeStreamSummaryWithContext(aws.Context, *k.DescribeStreamSummaryInput, ...request.Option) (*k.DescribeStreamSummaryOutput, error)
+}
+
+// probeResult is the result of the last probe request, reused until
+// `Config.ProbeInterval` elapsed.
+type probeResult struct {
+	sync.Mutex
+	at  time.Time
+	err error
+}
+
+// Probe checks that the producer's client can reach the stream, for readiness checks.
+// It describes the stream, failing with ErrStreamNotActive unless the stream is ACTIVE,
+// or puts a tiny record under `Config.ProbePartitionKey` when set. Probes are rate
+// limited: within `Config.ProbeInterval` of the last request, Probe returns its result
+// rather than sending another one. The concurrent probes wait for a single request.
+func (p *Producer) Probe(ctx context.Context) error {
+	p.probe.Lock()
+	defer p.probe.Unlock()
+	if !p.probe.at.IsZero() && time.Since(p.probe.at) < p.ProbeInterval {
+		return p.probe.err
+	}
+	err := p.probeStream(ctx)
+	// a probe given up by its caller says nothing about the stream
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	p.probe.at, p.probe.err = time.Now(), err
+	return err
+}
+
+// probeStream issues the probe request.
+func (p *Producer) probeStream(ctx context.Context) error {
+	if p.ProbePartitionKey != "" {
+		return p.probePut(ctx)
+	}
+	input := &k.DescribeStreamSummaryInput{StreamName: &p.StreamName}
+	var (
+		out *k.DescribeStreamSummaryOutput
+		err error
+	)
+	switch client := p.client().(type) {
+	case contextDescriber:
+		out, err = client.DescribeStreamSummaryWithContext(ctx, input)
+	case streamDescriber:
+		out, err = client.DescribeStreamSummary(input)
+	default:
+		return ErrProbeUnsupported
+	}
+	if err != nil {
+		return err
+	}
+	if aws.StringValue(out.StreamDescriptionSummary.StreamStatus) != k.StreamStatusActive {
+		return ErrStreamNotActive
+	}
+	return nil
+}
+
+// probePut puts the tiny probe record under `Config.ProbePartitionKey`.
+func (p *Producer) probePut(ctx context.Context) error {
+	input := &k.PutRecordsInput{
+		StreamName: &p.StreamName,
+		Records: []*k.PutRecordsRequestEntry{{
+			Data:         []byte{},
+			PartitionKey: &p.ProbePartitionKey,
+		}},
+	}
+	var (
+		out *k.PutRecordsOutput
+		err error
+	)
+	if client, ok := p.client().(contextPutter); ok {
+		out, err = client.PutRecordsWithContext(ctx, input, p.RequestOptions...)
+	} else {
+		out, err = p.client().PutRecords(input)
+	}
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(out.FailedRecordCount) > 0 && len(out.Records) > 0 {
+		r := out.Records[0]
+		return fmt.Errorf("%s: %s", aws.StringValue(r.ErrorCode), aws.StringValue(r.ErrorMessage))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package producer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+type probeClientMock struct {
+	streamClientMock
+	described int
+}
+
+func (c *probeClientMock) DescribeStreamSummary(input *k.DescribeStreamSummaryInput) (*k.DescribeStreamSummaryOutput, error) {
+	c.described++
+	return c.streamClientMock.DescribeStreamSummary(input)
+}
+
+func TestProbe(t *testing.T) {
+	client := &probeClientMock{streamClientMock: streamClientMock{status: k.StreamStatusActive}}
+	p := New(&Config{StreamName: "foo", ProbeInterval: 50 * time.Millisecond, Client: client})
+	ctx := context.Background()
+	assert(t, p.Probe(ctx) == nil, "expect an active stream to pass the probe")
+	client.status = k.StreamStatusUpdating
+	assert(t, p.Probe(ctx) == nil, "expect the last result within the probe interval")
+	assert(t, client.described == 1, "expect a single request within the probe interval")
+	time.Sleep(60 * time.Millisecond)
+	assert(t, p.Probe(ctx) == ErrStreamNotActive, "expect an inactive stream to fail the probe")
+	assert(t, client.described == 2, "expect a new request after the probe interval")
+
+	p = New(&Config{StreamName: "foo", Client: &clientMock{incoming: make(map[int][]string)}})
+	assert(t, p.Probe(ctx) == ErrProbeUnsupported, "expect a client without DescribeStreamSummary to be unsupported")
+
+	mock := &clientMock{incoming: make(map[int][]string), responses: []responseMock{{Response: &k.PutRecordsOutput{}}}}
+	p = New(&Config{StreamName: "foo", ProbePartitionKey: "probe", Client: mock})
+	assert(t, p.Probe(ctx) == nil, "expect the probe record to be put")
+	assert(t, len(mock.incoming[0]) == 1 && mock.incoming[0][0] == "probe", "expect a single record under the probe key")
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	p = New(&Config{StreamName: "foo", Client: client})
+	assert(t, p.Probe(cancelled) == context.Canceled, "expect a cancelled probe to return the context error")
+	assert(t, p.probe.at.IsZero(), "expect a cancelled probe not to be kept")
+}
@@ -7,12 +7,15 @@
 package producer
 
 import (
-	"crypto/md5"
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/jpillora/backoff"
 )
@@ -20,41 +23,280 @@ import (
 // Errors
 var (
 	ErrStoppedProducer     = errors.New("Unable to Put record. Producer is already stopped")
-	ErrIllegalPartitionKey = errors.New("Invalid parition key. Length must be at least 1 and at most 256")
-	ErrRecordSizeExceeded  = errors.New("Data must be less than or equal to 1MB in size")
+	ErrEmptyPartitionKey   = errors.New("Invalid partition key. Length must be at least 1")
+	ErrRecordSizeExceeded  = errors.New("Data and partition key must be less than or equal to 1MB in size")
+	ErrPartitionKeyTooLong = errors.New("Invalid partition key. Length must be at most 256 bytes")
+	ErrBacklogFull         = errors.New("Unable to Put record. Backlog is full")
+	ErrDeadlineExceeded    = errors.New("Unable to Put record. Deadline exceeded")
+
+	// Deprecated: ErrIllegalPartitionKey is ErrEmptyPartitionKey, returned for empty
+	// partition keys, whereas too long ones return ErrPartitionKeyTooLong.
+	ErrIllegalPartitionKey = ErrEmptyPartitionKey
 )
 
 // Producer batches records.
 type Producer struct {
+	// lastFlush is the unix time in nanoseconds of the last successful flush.
+	// Accessed atomically, and kept first for 64-bit alignment.
+	lastFlush int64
+	// lastPut is the unix time in nanoseconds of the last put record, when
+	// flushing eagerly. Accessed atomically.
+	lastPut int64
+	// produced and failed count the user records since the producer started.
+	// Accessed atomically.
+	produced int64
+	failed   int64
+	// recordsSent and bytesSent count the Kinesis records put, and their bytes.
+	// Accessed atomically.
+	recordsSent uint64
+	bytesSent   uint64
+	// batchSize, batchCount and flushInterval are the batching limits of the
+	// loop, that may be changed at runtime. Accessed atomically.
+	batchSize     int64
+	batchCount    int64
+	flushInterval int64
+
 	sync.RWMutex
 	*Config
 	aggregator *Aggregator
-	semaphore  semaphore
-	records    chan *kinesis.PutRecordsRequestEntry
-	failure    chan *FailureRecord
-	done       chan struct{}
+	// groups are the aggregators of the records put with `PutWithRoute`,
+	// or grouped by `Config.AggregateKeyGroupFunc`.
+	groups    map[aggregateGroup]*Aggregator
+	semaphore semaphore
+	records   chan *kinesisRecord
+	// marshals are the aggregated records left to the marshal workers, if any.
+	marshals chan *marshalJob
+	failure  chan *FailureRecord
+	results  chan *PutResult
+	done     chan struct{}
+	// flushes are the tallies of the `Flush` calls, handed to the loop, and
+	// exited is closed once the loop returns.
+	flushes chan *flushTally
+	exited  chan struct{}
+	// priority queue of the records put with `PutWithPriority`, drained
+	// into the aggregator until priorityDone is closed.
+	priority     *priorityQueue
+	priorityDone chan struct{}
+	// pause signals the loop to stop, or resume, sending records, once running.
+	// pauseMu keeps the signals in the order of the paused state changes.
+	pause   chan bool
+	pauseMu sync.Mutex
+	running bool
+	// clientMu guards `Config.Client`, swapped by `Config.CredentialRefresher`.
+	clientMu sync.RWMutex
+	// stopOnce makes `Stop` idempotent.
+	stopOnce sync.Once
+	// kept are the failure records handed to no listener, reported on `Close`.
+	kept []*FailureRecord
+	// held are the drained records left out of the full backlog, and room
+	// signals that the loop consumed some of the backlog.
+	held []*kinesisRecord
+	room chan struct{}
+	// holding is set, atomically, while records are held, and backlog is the last
+	// `BacklogState` of the backlog, changed by CAS, whose changes are signaled on
+	// backlogChanges, if `Config.OnBacklogState`.
+	holding        int32
+	backlog        int32
+	backlogChanges chan struct{}
+	// buffer bounds the bytes of the user records held by the producer.
+	buffer byteBudget
+	// teed are the requests mirrored to `Config.Tee`, if any, of teeBytes, sent until
+	// teeDone is closed, or dropped once teeStop is.
+	teed     chan *teeRequest
+	teeBytes int64
+	teeDone  chan struct{}
+	teeStop  chan struct{}
+	// limiter bounds the rate of the user records, if `Config.MaxRecordsPerSecond`.
+	limiter *rateLimiter
+	// keys counts the most frequent partition keys, if `Config.TrackKeyDistribution`.
+	keys *keySketch
+	// labels tracks the distinct values of the shard label.
+	labels labelTracker
+	// dedupe holds the dedupe keys seen within the dedupe window, if any.
+	dedupe *dedupeSet
+	// overflowDone stops replaying the overflow store, and overflowReplayed
+	// is closed once it is stopped.
+	overflowDone     chan struct{}
+	overflowReplayed chan struct{}
+	// aggregateFailures is the number of aggregated records failed in a row, and
+	// fallback is 1 once it reached `Config.AggregateFallbackThreshold`.
+	aggregateFailures int64
+	fallback          int32
+	// aborted is closed, along with abortCause set, once `StopContext` gives up.
+	aborted    chan struct{}
+	abortCause error
+	abortOnce  sync.Once
+	// snapshot keeps the records left in the producer, once `Snapshot` is called.
+	snapshot *snapshotRecords
+	// probe holds the result of the last `Probe` request.
+	probe probeResult
+	// ready is closed once the producer proved it can write, for `StartAndWait`.
+	ready     chan struct{}
+	readyOnce sync.Once
 
 	// Current state of the Producer
 	// notify set to true after calling to `NotifyFailures`
 	notify bool
+	// notifyResults set to true after calling to `Results`
+	notifyResults bool
+	// notifyEvents set to true after calling to `Events`
+	notifyEvents bool
+	events       chan Event
 	// stopped set to true after `Stop`ing the Producer.
 	// This will prevent from user to `Put` any new data.
 	stopped bool
+	// paused set to true after `Pause`ing the Producer, and back to false on `Resume`.
+	paused  bool
 	metrics *prometheusMetrics
 }
 
 // New creates new producer with the given config.
 func New(config *Config) *Producer {
 	config.defaults()
-	metrics := getMetrics(config.Logger)
-	return &Producer{
-		Config:     config,
-		done:       make(chan struct{}),
-		records:    make(chan *kinesis.PutRecordsRequestEntry, config.BacklogCount),
-		semaphore:  make(chan struct{}, config.MaxConnections),
-		aggregator: new(Aggregator),
-		metrics:    metrics,
+	metrics := getMetrics(config)
+	p := &Producer{
+		Config:         config,
+		done:           make(chan struct{}),
+		records:        make(chan *kinesisRecord, config.BacklogCount),
+		semaphore:      make(chan struct{}, config.MaxConnections),
+		priority:       newPriorityQueue(config.BacklogCount),
+		priorityDone:   make(chan struct{}),
+		pause:          make(chan bool),
+		flushes:        make(chan *flushTally),
+		exited:         make(chan struct{}),
+		room:           make(chan struct{}, 1),
+		backlogChanges: make(chan struct{}, 1),
+		metrics:        metrics,
+		buffer:         byteBudget{max: config.MaxBufferedBytes},
+
+		overflowDone:     make(chan struct{}),
+		overflowReplayed: make(chan struct{}),
+		ready:            make(chan struct{}),
+		aborted:          make(chan struct{}),
+	}
+	p.aggregator = p.newAggregator()
+	if config.MarshalWorkers > 0 {
+		p.marshals = make(chan *marshalJob, p.BacklogCount)
+	}
+	if config.MaxRecordsPerSecond > 0 {
+		p.limiter = newRateLimiter(config.MaxRecordsPerSecond)
+	}
+	if config.DedupeWindow > 0 {
+		p.dedupe = &dedupeSet{window: config.DedupeWindow, max: config.DedupeMaxKeys}
+	}
+	if config.TrackKeyDistribution {
+		p.keys = newKeySketch()
+	}
+	p.batchSize, p.batchCount, p.flushInterval = int64(config.BatchSize), int64(config.BatchCount), int64(config.FlushInterval)
+	return p
+}
+
+// newAggregator creates a new aggregator with the producer configuration.
+func (p *Producer) newAggregator() *Aggregator {
+	a := &Aggregator{
+		framing:   p.Framing,
+		delimiter: p.Delimiter,
+		marshaler: fastMarshaler{},
+		keyFunc:   p.AggregateKeyFunc,
+
+		checksumScope:   p.ChecksumScope,
+		minKeyRecords:   p.AggregateMinKeyRecords,
+		smallRecordSize: p.AggregateSmallRecordSize,
+		incremental:     p.MarshalWorkers == 0,
+	}
+	if p.Framing == FramingKPL {
+		a.idFunc = p.AggregateIDFunc
+		a.nextID = a.idFunc()
+	}
+	return a
+}
+
+// aggregateGroup identifies the aggregator of a user record.
+type aggregateGroup struct {
+	route string
+	group string
+}
+
+// groupOf returns the aggregate group of a user record.
+func (p *Producer) groupOf(route, partitionKey string) aggregateGroup {
+	if p.TotalOrder {
+		return aggregateGroup{}
+	}
+	g := aggregateGroup{route: route}
+	if p.AggregateKeyGroupFunc != nil {
+		g.group = p.AggregateKeyGroupFunc(partitionKey)
+	}
+	return g
+}
+
+// aggregatorOf returns the aggregator of the group, creating it if needed.
+// It must be called with the lock held.
+func (p *Producer) aggregatorOf(g aggregateGroup) *Aggregator {
+	if g == (aggregateGroup{}) {
+		return p.aggregator
+	}
+	a, ok := p.groups[g]
+	if !ok {
+		if p.groups == nil {
+			p.groups = make(map[aggregateGroup]*Aggregator)
+		}
+		a = p.newAggregator()
+		p.groups[g] = a
+	}
+	return a
+}
+
+// kinesisRecord is a Kinesis record on its way to the stream, along with
+// the metas of the user records it carries.
+type kinesisRecord struct {
+	*kinesis.PutRecordsRequestEntry
+	metas []*userMeta
+	// count is the number of user records carried by the record.
+	count int
+	// aggregated is true if the record aggregates its user records.
+	aggregated bool
+	// userBytes is the size of the user records, as counted by the buffer.
+	userBytes int
+	// aggregateID is the ID of the aggregated record, if any.
+	aggregateID string
+	// users are the user records carried by a delimited record, to report its failure
+	// per user record. The ones of a KPL aggregated record are extracted out of it.
+	users []*kinesis.PutRecordsRequestEntry
+	// marshaled is closed once the aggregated record is marshaled by the marshal workers,
+	// with marshalErr set if it failed. It is nil for the records marshaled when drained.
+	marshaled  chan struct{}
+	marshalErr error
+	// tally counts the outcome of the record, if flushed by `Flush`.
+	tally *flushTally
+	// retries are the numbers of times the record was retried, by key of the
+	// retry policies.
+	retries map[string]int
+}
+
+// resolve the futures of the user records carried by the record.
+func (r *kinesisRecord) resolve(sequenceNumber string, err error) {
+	for _, m := range r.metas {
+		if m != nil && m.future != nil {
+			m.future.resolve(sequenceNumber, err)
+		}
+	}
+}
+
+// requestSize returns the size of the records in a PutRecords request.
+func requestSize(records []*kinesisRecord) (n int) {
+	for _, r := range records {
+		n += len(r.Data) + len(*r.PartitionKey)
+	}
+	return
+}
+
+// entries returns the Kinesis entries of the records.
+func entries(records []*kinesisRecord) []*kinesis.PutRecordsRequestEntry {
+	out := make([]*kinesis.PutRecordsRequestEntry, len(records))
+	for i, r := range records {
+		out[i] = r.PutRecordsRequestEntry
 	}
+	return out
 }
 
 // Put `data` using `partitionKey` asynchronously. This method is thread-safe.
@@ -64,92 +306,503 @@ func New(config *Config) *Producer {
 // When unrecoverable error has detected(e.g: trying to put to in a stream that
 // doesn't exist), the message will returned by the Producer.
 // Add a listener with `Producer.NotifyFailures` to handle undeliverable messages.
+//
+// The user records of an aggregated record keep the order their `Put` calls returned
+// in, so records put in sequence with the same partition key are consumed in the same
+// order. Records sent unaggregated, or with `PutWithPriority`, may overtake them, and
+// retries may reorder the Kinesis records of a PutRecords request.
 func (p *Producer) Put(data []byte, partitionKey string) error {
+	return p.put(&userRecord{data: data, partitionKey: partitionKey})
+}
+
+// userRecord is a record handed to the producer, along with its options.
+type userRecord struct {
+	data         []byte
+	partitionKey string
+	// future resolved once the record is produced, if any.
+	future *Future
+	// values of the `Config.ContextFields` of the context the record was put with.
+	values map[interface{}]interface{}
+	// done bounds the time spent waiting for the backlog, if set.
+	done <-chan struct{}
+	// ctx the record was put with, if any, handed to the record encoder.
+	ctx context.Context
+	// route the record is aggregated by, if any.
+	route string
+	// compression of the record, overriding `Config.Compression` if set.
+	compression *Compression
+	// debug flags the record for the consumers, see `PutWithDebug`.
+	debug bool
+	// contentType of the data for the consumers, see `PutWithContentType`.
+	contentType string
+	// deadline the record must be produced by, if any, see `PutWithDeadline`.
+	deadline time.Time
+	// orderingKey the record is sorted by within its aggregate, see `PutWithOrdering`.
+	orderingKey string
+	// timestamp of the record with `Config.RecordTimestamps`, if it was handed to
+	// the producer before, e.g. by `Replay`.
+	timestamp time.Time
+}
+
+// userMeta is what the producer keeps of a user record until it is produced, along
+// with the options it was put with, for its failure to be replayed with them.
+type userMeta struct {
+	future      *Future
+	values      map[interface{}]interface{}
+	deadline    time.Time
+	orderingKey string
+	route       string
+	compression *Compression
+	debug       bool
+	contentType string
+}
+
+// meta returns the meta of the user record, or nil if there is nothing to keep.
+func (r *userRecord) meta() *userMeta {
+	m := userMeta{
+		future:      r.future,
+		values:      r.values,
+		deadline:    r.deadline,
+		orderingKey: r.orderingKey,
+		route:       r.route,
+		compression: r.compression,
+		debug:       r.debug,
+		contentType: r.contentType,
+	}
+	if m.route == "" && m.routeOnly() {
+		return nil
+	}
+	return &m
+}
+
+// routeOnly reports whether the meta keeps nothing but the route of the user record.
+func (m *userMeta) routeOnly() bool {
+	return m.future == nil && m.values == nil && m.deadline.IsZero() && m.orderingKey == "" &&
+		m.compression == nil && !m.debug && m.contentType == ""
+}
+
+// restore the options of the user record kept in its meta.
+func (r *userRecord) restore(m *userMeta) {
+	r.values, r.deadline, r.orderingKey = m.values, m.deadline, m.orderingKey
+	r.route, r.compression, r.debug, r.contentType = m.route, m.compression, m.debug, m.contentType
+}
+
+// unaggregatedErr returns the error of the user record if its options are stored in the
+// aggregate, and would be lost with the record sent unaggregated.
+func (r *userRecord) unaggregatedErr(framing Framing) error {
+	switch {
+	case r.contentType != "":
+		return ErrContentTypeUnaggregated
+	case r.debug:
+		return ErrDebugUnaggregated
+	case r.route != "" && framing == FramingKPL:
+		return ErrRouteUnaggregated
+	}
+	return nil
+}
+
+// kinesisRecord returns the user record as a plain Kinesis record.
+func (r *userRecord) kinesisRecord() *kinesisRecord {
+	record := &kinesisRecord{
+		PutRecordsRequestEntry: &kinesis.PutRecordsRequestEntry{
+			Data:         r.data,
+			PartitionKey: &r.partitionKey,
+		},
+		count: 1,
+	}
+	if m := r.meta(); m != nil {
+		record.metas = []*userMeta{m}
+	}
+	record.userBytes = len(r.data) + len(r.partitionKey)
+	return record
+}
+
+// put the user record, once encoded and validated.
+func (p *Producer) put(r *userRecord) error {
+	if err := p.encode(r); err != nil {
+		return err
+	}
+	if err := p.validate(r); err != nil {
+		return err
+	}
+	return p.admit(r)
+}
+
+// admit the encoded and validated user record, dropping it if it is a duplicate. The dedupe
+// key of a record that can't be added is forgotten, for the put to be retried.
+func (p *Producer) admit(r *userRecord) error {
+	var key string
+	if p.dedupe != nil {
+		key = p.DedupeKeyFunc(r.data)
+		if p.dedupe.seen(key, time.Now()) {
+			p.metrics.recordsDroppedCnt.WithLabelValues(p.MetricStreamLabel, "dup").Inc()
+			if r.future != nil {
+				r.future.resolve("", nil)
+			}
+			return nil
+		}
+	}
+	if p.keys != nil {
+		p.keys.add(r.partitionKey)
+	}
+	var err error
+	if p.spillable(r) {
+		err = p.putOrSpill(r)
+	} else {
+		err = p.add(r)
+	}
+	if err != nil && p.dedupe != nil {
+		p.dedupe.forget(key)
+	}
+	return err
+}
+
+// encode the data of the user record with the record encoder, if any.
+func (p *Producer) encode(r *userRecord) error {
+	if p.RecordEncoder == nil {
+		return nil
+	}
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	data, err := p.RecordEncoder(ctx, r.data)
+	if err != nil {
+		return err
+	}
+	r.data = data
+	return nil
+}
+
+// validate the user record before putting it, giving it a random partition key
+// if it has none and `Config.AutoPartitionKey` is set.
+func (p *Producer) validate(r *userRecord) error {
 	p.RLock()
 	stopped := p.stopped
 	p.RUnlock()
 	if stopped {
 		return ErrStoppedProducer
 	}
-	if len(data) > maxRecordSize {
+	if len(r.partitionKey) < 1 {
+		if !p.AutoPartitionKey {
+			return ErrEmptyPartitionKey
+		}
+		r.partitionKey = randomPartitionKey()
+	}
+	if len(r.partitionKey) > maxPartitionKeySize {
+		return ErrPartitionKeyTooLong
+	}
+	size := len(r.data)
+	if p.keyCounted {
+		size += len(r.partitionKey)
+	}
+	if size > p.recordSizeLimit {
 		return ErrRecordSizeExceeded
 	}
-	if l := len(partitionKey); l < 1 || l > 256 {
-		return ErrIllegalPartitionKey
+	return nil
+}
+
+// add the user record to the aggregator, or straight to the backlog if it is too big
+// to be aggregated. It returns ErrBacklogFull if the record doesn't block on the backlog,
+// and the backlog can't take the records it causes to be sent.
+func (p *Producer) add(r *userRecord) error {
+	if p.limiter != nil {
+		if err := p.throttle(r); err != nil {
+			return err
+		}
+	}
+	data, partitionKey := r.data, r.partitionKey
+	if p.EagerFlush {
+		atomic.StoreInt64(&p.lastPut, time.Now().UnixNano())
 	}
-	p.metrics.userRecordsPutCnt.WithLabelValues(p.StreamName).Inc()
+	p.metrics.userRecordsPutCnt.WithLabelValues(p.MetricStreamLabel).Inc()
 	dataBytes := len(data)
-	p.metrics.userRecordsDataPutSz.WithLabelValues(p.StreamName).Observe(float64(dataBytes))
-	nbytes := dataBytes + len([]byte(partitionKey))
+	p.metrics.userRecordsDataPutSz.WithLabelValues(p.MetricStreamLabel).Observe(float64(dataBytes))
+	var tags []*Tag
+	if p.RecordTimestamps {
+		ts := r.timestamp
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		tags = append(tags, timestampTag(ts))
+	}
+	if r.route != "" {
+		tags = append(tags, routeTag(r.route))
+	}
+	if r.debug {
+		tags = append(tags, debugTag)
+	}
+	if r.contentType != "" {
+		tags = append(tags, contentTypeTag(r.contentType))
+	}
+	nbytes := dataBytes + len([]byte(partitionKey)) + tagsSize(tags)
+	compression, minSize := p.Compression, p.CompressionMinSize
+	if r.compression != nil {
+		compression, minSize = *r.compression, 0
+	}
+	if compression != CompressionNone && dataBytes >= minSize && nbytes <= p.AggregateBatchSize {
+		compressed, tag, err := compress(compression, data)
+		if err != nil {
+			p.Logger.Error("compress record", err)
+		} else if len(compressed)+tagsSize([]*Tag{tag}) < dataBytes {
+			data = compressed
+			tags = append(tags, tag)
+			nbytes = len(data) + len([]byte(partitionKey)) + tagsSize(tags)
+		}
+	}
+	if !p.aggregatable(nbytes) || p.fellBack() {
+		if err := r.unaggregatedErr(p.Framing); err != nil {
+			return err
+		}
+	}
+	weight := len(data) + len(partitionKey)
+	if err := p.acquireBytes(r, weight); err != nil {
+		return err
+	}
 	// if the record size is bigger than aggregation size
 	// handle it as a simple kinesis record
-	if nbytes > p.AggregateBatchSize {
-		p.metrics.userRecordsPerKinesisRecordSum.WithLabelValues(p.Config.StreamName).Observe(1)
-		p.records <- &kinesis.PutRecordsRequestEntry{
-			Data:         data,
-			PartitionKey: &partitionKey,
+	if !p.aggregatable(nbytes) || p.fellBack() {
+		if err := p.lockForRoom(r, func() bool { return true }); err != nil {
+			p.releaseBytes(weight)
+			return err
+		}
+		records := []*kinesisRecord{r.kinesisRecord()}
+		// the records of the aggregate are older, and go first for the order to hold
+		if p.TotalOrder {
+			records = append(p.drainAggregator(p.aggregator, "size"), records...)
+		}
+		if p.paused || r.done != nil {
+			p.hold(records)
+			p.Unlock()
+		} else {
+			p.Unlock()
+			for _, record := range records {
+				p.enqueue(record)
+			}
 		}
+		p.metrics.userRecordsPerKinesisRecordSum.WithLabelValues(p.MetricStreamLabel).Observe(1)
+		p.metrics.aggregationDecisionsCnt.WithLabelValues(p.MetricStreamLabel, "unaggregated").Inc()
 	} else {
-		p.Lock()
-		needToDrain := nbytes+p.aggregator.Size()+md5.Size+len(magicNumber)+partitionKeyIndexSize > p.AggregateBatchSize || p.aggregator.Count() >= p.AggregateBatchCount
-		var (
-			record *kinesis.PutRecordsRequestEntry
-			err    error
-		)
+		g := p.groupOf(r.route, partitionKey)
+		if err := p.lockForRoom(r, func() bool { return !p.fits(p.aggregatorOf(g), nbytes, partitionKey) }); err != nil {
+			p.releaseBytes(weight)
+			return err
+		}
+		a := p.aggregatorOf(g)
+		needToDrain := !p.fits(a, nbytes, partitionKey)
+		var records []*kinesisRecord
 		if needToDrain {
-			p.metrics.userRecordsPerKinesisRecordSum.WithLabelValues(p.Config.StreamName).Observe(float64(p.aggregator.Count()))
-			if record, err = p.aggregator.Drain(); err != nil {
-				p.Logger.Error("drain aggregator", err)
+			reason := "size"
+			if a.Count() >= p.AggregateBatchCount {
+				reason = "count"
+			} else if !p.fitsKey(a, partitionKey) {
+				reason = "keys"
 			}
+			records = p.drainAggregator(a, reason)
+		}
+		a.put(data, partitionKey, tags, r.meta())
+		if p.paused || r.done != nil {
+			p.hold(records)
+			records = nil
 		}
-		p.aggregator.Put(data, partitionKey)
 		p.Unlock()
-		// release the lock and then pipe the record to the records channel
+		// release the lock and then pipe the records to the records channel
 		// we did it, because the "send" operation blocks when the backlog is full
 		// and this can cause deadlock(when we never release the lock)
-		if needToDrain && record != nil {
-			p.records <- record
+		for _, record := range records {
+			p.enqueue(record)
 		}
 	}
+	p.metrics.bytesAcceptedCnt.WithLabelValues(p.MetricStreamLabel).Add(float64(dataBytes + len(partitionKey)))
 	return nil
 }
 
+// WouldFit reports whether a record of `data` and `partitionKey` would fit in the current
+// aggregate, rather than causing it to be drained, if it was put now. It does not change
+// the state of the producer. It only considers the aggregates of the records put without
+// a route.
+func (p *Producer) WouldFit(data []byte, partitionKey string) bool {
+	nbytes := len(data) + len([]byte(partitionKey))
+	if p.RecordTimestamps {
+		nbytes += tagsSize([]*Tag{timestampTag(time.Now())})
+	}
+	if !p.aggregatable(nbytes) || p.fellBack() {
+		return false
+	}
+	p.RLock()
+	defer p.RUnlock()
+	a := p.aggregator
+	if g := p.groupOf("", partitionKey); g != (aggregateGroup{}) {
+		if a = p.groups[g]; a == nil {
+			return true
+		}
+	}
+	return p.fits(a, nbytes, partitionKey)
+}
+
+// fits reports whether a user record of `nbytes` and `partitionKey` fits in the aggregator.
+// It must be called with the lock held.
+func (p *Producer) fits(a *Aggregator, nbytes int, partitionKey string) bool {
+	return nbytes+a.wireSize()+a.overhead() <= p.aggregateSizeLimit() && a.Count() < p.AggregateBatchCount &&
+		p.fitsKey(a, partitionKey)
+}
+
+// fitsKey reports whether a user record of `partitionKey` fits in the aggregator without
+// exceeding `Config.MaxKeysPerAggregate` distinct partition keys.
+func (p *Producer) fitsKey(a *Aggregator, partitionKey string) bool {
+	if p.MaxKeysPerAggregate == 0 || len(a.pkeys) < p.MaxKeysPerAggregate {
+		return true
+	}
+	_, ok := a.pkeyIndex[partitionKey]
+	return ok
+}
+
+// aggregatable reports whether a user record of `nbytes` fits in an empty aggregator.
+func (p *Producer) aggregatable(nbytes int) bool {
+	return nbytes+p.aggregator.overhead() <= p.aggregateSizeLimit()
+}
+
+// aggregateSizeLimit returns the maximum size of the data of an aggregated record, leaving
+// room for its partition key within the record size limit when the key counts toward it.
+func (p *Producer) aggregateSizeLimit() int {
+	limit := p.AggregateBatchSize
+	if max := p.recordSizeLimit - maxPartitionKeySize; p.keyCounted && limit > max {
+		limit = max
+	}
+	return limit
+}
+
 // Failure record type
 type FailureRecord struct {
 	Error        error
 	Data         []byte
 	PartitionKey string
+	// ContextValues are the values of `Config.ContextFields` in the context the
+	// record was put with, if any.
+	ContextValues map[interface{}]interface{}
+	// Route, OrderingKey, Compression, Debug and ContentType are the options the record
+	// was put with, e.g. by `PutWithRoute`, if any, restored by `Replay`.
+	Route       string
+	OrderingKey string
+	Compression *Compression
+	Debug       bool
+	ContentType string
+	// Timestamp is the time the record was handed to the producer, if aggregated with
+	// `Config.RecordTimestamps`, kept by `Replay`.
+	Timestamp time.Time
 }
 
 // NotifyFailures registers and return listener to handle undeliverable messages.
 // The incoming struct has a copy of the Data and the PartitionKey along with some
 // error information about why the publishing failed.
+// Note that nothing is sent to the returned channel when `Config.FailureSink` is set.
 func (p *Producer) NotifyFailures() <-chan *FailureRecord {
 	p.Lock()
 	defer p.Unlock()
 	if !p.notify {
 		p.notify = true
-		p.failure = make(chan *FailureRecord, p.BacklogCount)
+		size := p.BacklogCount
+		if p.FailureChannelSize > 0 {
+			size = p.FailureChannelSize
+		}
+		p.failure = make(chan *FailureRecord, size)
 	}
 	return p.failure
 }
 
+// PutResult is the outcome of a successfully produced Kinesis record.
+// Note that an aggregated Kinesis record carries many user records, but
+// yields a single result.
+type PutResult struct {
+	PartitionKey   string
+	ShardID        string
+	SequenceNumber string
+	// AggregateID is the ID of the aggregated record, see `Config.AggregateIDFunc`.
+	AggregateID string
+}
+
+// Results registers and return listener to handle the results of the produced records.
+// Results are dropped rather than blocking the producer when the channel is full, so
+// the listener should keep up with the producer.
+func (p *Producer) Results() <-chan *PutResult {
+	p.Lock()
+	defer p.Unlock()
+	if !p.notifyResults {
+		p.notifyResults = true
+		p.results = make(chan *PutResult, p.BacklogCount)
+	}
+	return p.results
+}
+
 // Start the producer
 func (p *Producer) Start() {
 	p.Logger.Info("starting producer", LogValue{"stream", p.StreamName})
+	if p.CreateStreamIfNotExists {
+		if err := p.createStreamIfNotExists(); err != nil {
+			p.Logger.Error("create stream", err, LogValue{"stream", p.StreamName})
+		}
+	}
+	if p.VerifyStreamOnStart {
+		if err := p.verifyStream(); err != nil {
+			p.Logger.Error("verify stream", err, LogValue{"stream", p.StreamName})
+		}
+	}
+	if p.WarmUp {
+		p.warmUp()
+	}
+	// the loop starts paused if paused before, and is signaled from then on
+	p.pauseMu.Lock()
+	p.running = true
 	go p.loop()
+	p.pauseMu.Unlock()
+	go p.drainPriority()
+	if p.marshals != nil {
+		p.startMarshalers()
+	}
+	if p.OnStats != nil {
+		go p.reportStats()
+	}
+	if p.OnBacklogState != nil {
+		go p.watchBacklog()
+	}
+	if p.OverflowStore != nil {
+		go p.replayOverflow()
+	}
+	if p.Tee != nil {
+		p.startTee()
+	}
+	p.emit(EventStarted, 0, "")
 }
 
 // Stop the producer gracefully. Flushes any in-flight data.
+// Stopping an already stopped producer does nothing.
 func (p *Producer) Stop() {
+	p.stopOnce.Do(p.stop)
+}
+
+func (p *Producer) stop() {
+	p.pauseMu.Lock()
 	p.Lock()
 	p.stopped = true
 	p.Unlock()
+	p.resume()
+	p.pauseMu.Unlock()
 	p.Logger.Info("stopping producer", LogValue{"backlog", len(p.records)})
+	if p.DiscardOnStop {
+		p.abort(ErrStoppedProducer)
+	}
 
-	// drain
-	if record, ok := p.drainIfNeed(); ok {
-		p.records <- record
+	// stop replaying the overflow store, leaving its records to the next producer
+	if p.OverflowStore != nil {
+		close(p.overflowDone)
+		<-p.overflowReplayed
+	}
+
+	// drain the prioritized records, and then the aggregator
+	p.priority.close()
+	<-p.priorityDone
+	for _, record := range p.drainIfNeed("explicit") {
+		p.enqueue(record)
 	}
 	p.done <- struct{}{}
 	close(p.records)
@@ -157,106 +810,252 @@ func (p *Producer) Stop() {
 	// wait
 	<-p.done
 	p.semaphore.wait()
+	if p.marshals != nil {
+		close(p.marshals)
+	}
+	if p.teed != nil {
+		p.stopTee()
+	}
 
-	// close the failures channel if we notify
+	// close the failures, results and events channels if we notify
+	p.emit(EventStopped, 0, "")
 	p.RLock()
 	if p.notify {
 		close(p.failure)
 	}
+	if p.notifyResults {
+		close(p.results)
+	}
+	if p.notifyEvents {
+		close(p.events)
+	}
 	p.RUnlock()
 	p.Logger.Info("stopped producer")
 }
 
-// loop and flush at the configured interval, or when the buffer is exceeded.
+// loop hands the records of the backlog over to the dispatcher, the built-in `batcher`
+// unless `Config.Dispatcher` is set, and drains the aggregators at the configured interval,
+// when idle, or on `Flush`.
 func (p *Producer) loop() {
-	start := time.Now()
-	size := 0
-	drain := false
-	buf := make([]*kinesis.PutRecordsRequestEntry, 0, p.BatchCount)
-	tick := time.NewTicker(p.FlushInterval)
-
-	flush := func(msg string) {
-		p.semaphore.acquire()
-		elapsed := float64(time.Since(start)) / float64(time.Millisecond)
-		p.metrics.bufferingTimeDur.WithLabelValues(p.Config.StreamName).Observe(elapsed)
-		go p.flush(buf, msg)
-		buf = nil
+	dispatcher, builtin := p.Dispatcher, p.Dispatcher == nil
+	if builtin {
+		dispatcher = &batcher{p}
+	}
+	// the batcher takes the records one by one, for the backlog to block once it is busy
+	size := p.BacklogCount
+	if builtin {
 		size = 0
-		start = time.Now()
 	}
-
-	bufAppend := func(record *kinesis.PutRecordsRequestEntry) {
-		dataSize := len(record.Data)
-		p.metrics.kinesisRecordsDataPutSz.WithLabelValues(p.Config.StreamName).Observe(float64(dataSize))
-		// the record size limit applies to the total size of the
-		// partition key and data blob.
-		rsize := dataSize + len([]byte(*record.PartitionKey))
-		if size+rsize > p.BatchSize {
-			flush("batch size")
+	dispatched := make(chan *DispatchRecord, size)
+	ran := make(chan struct{})
+	go func() {
+		defer close(ran)
+		dispatcher.Run(dispatched)
+	}()
+	// tally counts the records dispatched while handling a `Flush`
+	var tally *flushTally
+	dispatch := func(records ...*kinesisRecord) {
+		p.backlogChanged()
+		for _, record := range records {
+			if !p.awaitMarshaled(record) {
+				continue
+			}
+			if tally != nil {
+				tally.add(record)
+			}
+			p.pinShard(record)
+			dispatched <- p.dispatchRecord(record)
+		}
+	}
+	// signal the batcher to flush its buffer for the given reason, sealing the tally once
+	// its records are added. Other dispatchers batch the records on their own.
+	signal := func(reason string, interval time.Duration, t *flushTally) {
+		if builtin {
+			dispatched <- &DispatchRecord{flush: reason, interval: interval, tally: t}
+		} else if t != nil {
+			t.seal()
+		}
+	}
+	// takeBacklog dispatches the records waiting in the backlog, which were put
+	// before the held ones.
+	takeBacklog := func() {
+		n := len(p.records)
+		for i := 0; i < n; i++ {
+			dispatch(<-p.records)
 		}
-		size += rsize
-		buf = append(buf, record)
-		if len(buf) >= p.BatchCount {
-			flush("batch length")
+		if n > 0 {
+			p.signalRoom()
 		}
 	}
 
-	defer tick.Stop()
+	interval := p.effectiveFlushInterval()
+	tick := newFlushTimer(interval, p.FlushCoalesceWindow)
+	// records is nil while paused, so that the backlog is not consumed
+	records := p.records
+	p.RLock()
+	if p.paused {
+		records = nil
+	}
+	p.RUnlock()
+	// idle fires when flushing eagerly, once no record was put for the idle
+	// flush delay, as far as the last put record is concerned
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if p.EagerFlush {
+		idleTimer = time.NewTimer(p.IdleFlushDelay)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	defer tick.stop()
 	defer close(p.done)
+	defer close(p.exited)
+	drain := false
 
 	for {
 		select {
-		case record, ok := <-p.records:
+		case record, ok := <-records:
 			if drain && !ok {
-				if size > 0 {
-					flush("drain")
-				}
+				dispatch(p.takeHeld()...)
+				close(dispatched)
+				<-ran
 				p.Logger.Info("backlog drained")
 				return
 			}
-			bufAppend(record)
-		case <-tick.C:
-			if record, ok := p.drainIfNeed(); ok {
-				bufAppend(record)
+			dispatch(record)
+			p.signalRoom()
+		case paused := <-p.pause:
+			records = p.records
+			if paused {
+				records = nil
+			}
+		case <-tick.C():
+			interval = p.effectiveFlushInterval()
+			tick.next(interval)
+			if records == nil {
+				continue
+			}
+			takeBacklog()
+			if held := p.takeHeld(); len(held) > 0 {
+				dispatch(held...)
+				p.signalRoom()
 			}
-			// if the buffer is still containing records
-			if size > 0 {
-				flush("interval")
+			dispatch(p.drainIfNeed("timer")...)
+			signal("interval", interval, nil)
+		case <-idle:
+			lastPut := time.Unix(0, atomic.LoadInt64(&p.lastPut))
+			if since := time.Since(lastPut); since < p.IdleFlushDelay {
+				// a record was put meanwhile, wait for the delay after it
+				idleTimer.Reset(p.IdleFlushDelay - since)
+				continue
 			}
+			idleTimer.Reset(p.IdleFlushDelay)
+			if records == nil {
+				continue
+			}
+			takeBacklog()
+			dispatch(p.drainIfNeed("idle")...)
+			signal("idle", 0, nil)
+		case t := <-p.flushes:
+			if records == nil {
+				// the records of a `FlushKey` are left to the backlog while paused
+				if t.records != nil {
+					p.Lock()
+					p.hold(t.records)
+					p.Unlock()
+				}
+				t.seal()
+				continue
+			}
+			tally = t
+			reason := "flush"
+			if t.records != nil {
+				reason = "key"
+				dispatch(t.records...)
+			} else {
+				takeBacklog()
+				dispatch(p.takeHeld()...)
+				p.signalRoom()
+				dispatch(p.drainIfNeed("flush")...)
+			}
+			tally = nil
+			signal(reason, 0, t)
 		case <-p.done:
 			drain = true
 		}
 	}
 }
 
-func (p *Producer) drainIfNeed() (*kinesis.PutRecordsRequestEntry, bool) {
+// drainIfNeed drains the aggregators that are not empty, for the given reason.
+func (p *Producer) drainIfNeed(reason string) []*kinesisRecord {
 	p.RLock()
-	needToDrain := p.aggregator.Size() > 0
+	needToDrain := p.aggregator.Size() > 0 || len(p.groups) > 0
 	p.RUnlock()
-	if needToDrain {
-		p.metrics.userRecordsPerKinesisRecordSum.WithLabelValues(p.Config.StreamName).Observe(float64(p.aggregator.Count()))
-		p.Lock()
-		record, err := p.aggregator.Drain()
-		p.Unlock()
-		if err != nil {
-			p.Logger.Error("drain aggregator", err)
-		} else {
-			return record, true
+	if !needToDrain {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	records := p.drainAggregator(p.aggregator, reason)
+	for g, a := range p.groups {
+		records = append(records, p.drainAggregator(a, reason)...)
+		// the aggregators of the groups are created again when needed
+		delete(p.groups, g)
+	}
+	return records
+}
+
+// drainAggregator drains the aggregator into Kinesis records, for the given reason.
+// It must be called with the lock held.
+func (p *Producer) drainAggregator(a *Aggregator, reason string) []*kinesisRecord {
+	if a.Count() > 0 {
+		p.metrics.aggregateFlushCnt.WithLabelValues(p.MetricStreamLabel, reason).Inc()
+		ratio := float64(a.Size()+a.overhead()) / float64(p.AggregateBatchSize)
+		p.metrics.aggregateFillRatio.WithLabelValues(p.MetricStreamLabel).Observe(ratio)
+		p.metrics.aggregateDistinctKeys.WithLabelValues(p.MetricStreamLabel).Observe(float64(len(a.pkeys)))
+	}
+	if p.marshals != nil && a.framing == FramingKPL && !a.incremental {
+		records, job := a.drainDetached()
+		if job != nil {
+			p.marshals <- job
+		}
+		p.observeDrained(records)
+		return records
+	}
+	buffered := a.userBytes
+	records, err := a.drain()
+	if err != nil {
+		p.Logger.Error("drain aggregator", err)
+		// the user records of the aggregated record are lost
+		p.releaseBytes(buffered - userBytes(records))
+	}
+	p.observeDrained(records)
+	return records
+}
+
+// observeDrained observes the metrics of the records drained out of an aggregator.
+func (p *Producer) observeDrained(records []*kinesisRecord) {
+	for _, r := range records {
+		p.metrics.userRecordsPerKinesisRecordSum.WithLabelValues(p.MetricStreamLabel).Observe(float64(r.count))
+		decision := "aggregated"
+		if !r.aggregated {
+			decision = "unaggregated"
 		}
+		p.metrics.aggregationDecisionsCnt.WithLabelValues(p.MetricStreamLabel, decision).Add(float64(r.count))
 	}
-	return nil, false
 }
 
 // flush records and retry failures if necessary.
 // for example: when we get "ProvisionedThroughputExceededException"
-func (p *Producer) flush(records []*kinesis.PutRecordsRequestEntry, reason string) {
+func (p *Producer) flush(records []*kinesisRecord, reason string) {
 	b := &backoff.Backoff{
 		Jitter: true,
 	}
 
 	defer p.semaphore.release()
+	defer p.releaseBytes(userBytes(records))
 
 	numRetries := 0
+	numRefreshes := 0
 	numRecords := len(records)
 
 	if numRecords == 0 {
@@ -264,92 +1063,327 @@ func (p *Producer) flush(records []*kinesis.PutRecordsRequestEntry, reason strin
 		return
 	}
 
+	// retry notifies the retry hook about the records retried by error code,
+	// and returns the backoff to wait before retrying them
+	retry := func(codes map[string]int) time.Duration {
+		d, duration := b.Duration(), time.Duration(0)
+		for code, n := range codes {
+			cd := d
+			if policy, ok := p.retryPolicy(code); ok && (policy.MinBackoff > 0 || policy.MaxBackoff > 0) {
+				cd = policy.backoff(numRetries)
+			}
+			if cd > duration {
+				duration = cd
+			}
+			if p.OnRetry != nil {
+				p.OnRetry(numRetries+1, code, n)
+			}
+			if throttlingErrorCodes[code] {
+				p.emit(EventThrottled, n, code)
+			}
+		}
+		return duration
+	}
+
 	for {
+		if err := p.abortErr(); err != nil {
+			p.dispatchFailures(records, err)
+			return
+		}
+		if records = p.expire(records); len(records) == 0 {
+			return
+		}
+		if p.OnBatchAssembled != nil {
+			if err := p.OnBatchAssembled(p.batchInfo(records, reason)); err != nil {
+				p.Logger.Error("batch assembled", err)
+				p.dispatchFailures(records, err)
+				return
+			}
+		}
 		p.Logger.Info("flushing records", LogValue{"reason", reason}, LogValue{"records", numRecords})
 		start := time.Now()
-		p.metrics.kinesisRecordsPerPutRecordsRequestSum.WithLabelValues(p.Config.StreamName).Observe(float64(numRecords))
-		out, err := p.Client.PutRecords(&kinesis.PutRecordsInput{
+		p.metrics.kinesisRecordsPerPutRecordsRequestSum.WithLabelValues(p.MetricStreamLabel).Observe(float64(numRecords))
+		p.metrics.inFlightRequestsCnt.WithLabelValues(p.MetricStreamLabel).Inc()
+		p.metrics.bytesSentCnt.WithLabelValues(p.MetricStreamLabel).Add(float64(requestSize(records)))
+		var end func(failed int, err error)
+		if p.Tracer != nil {
+			end = p.Tracer.StartPutRecords(p.batchInfo(records, reason))
+		}
+		countRequest(records)
+		if p.teed != nil && numRetries == 0 {
+			p.tee(records)
+		}
+		out, err := p.putRecords(&kinesis.PutRecordsInput{
 			StreamName: &p.StreamName,
-			Records:    records,
+			Records:    entries(records),
 		})
+		if end != nil {
+			failed := len(records)
+			if err == nil {
+				failed = int(aws.Int64Value(out.FailedRecordCount))
+			}
+			end(failed, err)
+		}
+		p.metrics.inFlightRequestsCnt.WithLabelValues(p.MetricStreamLabel).Dec()
 		elapsed := float64(time.Since(start)) / float64(time.Millisecond)
-		p.metrics.requestTimeDur.WithLabelValues(p.Config.StreamName).Observe(elapsed)
+		p.metrics.requestTimeDur.WithLabelValues(p.MetricStreamLabel).Observe(elapsed)
+		if err != nil {
+			code := errorCode(err)
+			if code == "" {
+				code = "unknown"
+			}
+			p.metrics.requestTimeByCodeDur.WithLabelValues(p.MetricStreamLabel, code).Observe(elapsed)
+		}
 
 		if err != nil {
-			p.Logger.Error("flush", err)
-			p.RLock()
-			notify := p.notify
-			p.RUnlock()
-			if notify {
-				p.dispatchFailures(records, err)
+			if isCredentialError(err) && numRefreshes < maxCredentialRefreshes && p.refreshCredentials(err) {
+				numRefreshes++
+				duration := retry(map[string]int{errorCode(err): len(records)})
+				p.Logger.Info("retrying with refreshed credentials", LogValue{"backoff", duration.String()})
+				p.sleep(duration, records)
+				reason = "retry"
+				numRetries++
+				continue
+			}
+			if p.RetryableErrorFunc(err) {
+				var exhausted, left []*kinesisRecord
+				for _, r := range records {
+					if p.retriesLeft(r, errorCode(err)) {
+						left = append(left, r)
+					} else {
+						exhausted = append(exhausted, r)
+					}
+				}
+				if len(exhausted) > 0 {
+					p.dispatchFailures(exhausted, err)
+				}
+				if records = left; len(records) == 0 {
+					return
+				}
+				duration := retry(map[string]int{errorCode(err): len(records)})
+				p.Logger.Error("flush", err, LogValue{"backoff", duration.String()})
+				p.sleep(duration, records)
+				reason = "retry"
+				numRetries++
+				continue
 			}
+			p.Logger.Error("flush", err)
+			p.dispatchFailures(records, err)
 			return
 		}
+		numRefreshes = 0
+		p.flushed(time.Now())
+
+		p.RLock()
+		notifyResults := p.notifyResults
+		p.RUnlock()
+
+		// records to retry, and their number by error code
+		var retries []*kinesisRecord
+		codes := make(map[string]int)
 
 		for i, r := range out.Records {
 			values := make([]LogValue, 2)
 			if r.ErrorCode != nil {
 				errorCode := *r.ErrorCode
-				p.metrics.errorsByCodeCnt.WithLabelValues(p.Config.StreamName, errorCode).Inc()
-				p.metrics.allErrorsCnt.WithLabelValues(p.Config.StreamName).Inc()
+				if err := awserr.New(errorCode, aws.StringValue(r.ErrorMessage), nil); p.RetryableErrorFunc(err) && p.retriesLeft(records[i], errorCode) {
+					codes[errorCode]++
+					retries = append(retries, records[i])
+				} else {
+					if records[i].aggregated {
+						p.aggregateFailed()
+					}
+					p.dispatchFailures(records[i:i+1], err)
+				}
+				p.metrics.errorsByCodeCnt.WithLabelValues(p.MetricStreamLabel, errorCode).Inc()
+				p.metrics.allErrorsCnt.WithLabelValues(p.MetricStreamLabel).Inc()
 				values[0] = LogValue{"ErrorCode", *r.ErrorCode}
 				values[1] = LogValue{"ErrorMessage", *r.ErrorMessage}
 			} else {
-				shardID := *r.ShardId
-				p.metrics.kinesisRecordsPutCnt.WithLabelValues(p.Config.StreamName, shardID).Inc()
-				values[0] = LogValue{"ShardId", shardID}
+				values[0] = LogValue{"ShardId", *r.ShardId}
 				values[1] = LogValue{"SequenceNumber", *r.SequenceNumber}
+				p.produce(records[i], *r.ShardId, *r.SequenceNumber, notifyResults)
 			}
 			if p.Verbose {
 				p.Logger.Info(fmt.Sprintf("Result[%d]", i), values...)
 			}
 		}
 
-		failed := *out.FailedRecordCount
+		failed := len(retries)
+		p.emit(EventFlushed, len(records)-int(aws.Int64Value(out.FailedRecordCount)), reason)
 		if failed == 0 {
 			if numRetries != 0 {
-				p.metrics.retriesPerRecordSum.WithLabelValues(p.Config.StreamName).Observe(float64(numRecords) / float64(numRetries))
+				p.metrics.retriesPerRecordSum.WithLabelValues(p.MetricStreamLabel).Observe(float64(numRecords) / float64(numRetries))
 			} else {
-				p.metrics.retriesPerRecordSum.WithLabelValues(p.Config.StreamName).Observe(0)
+				p.metrics.retriesPerRecordSum.WithLabelValues(p.MetricStreamLabel).Observe(0)
 			}
 			return
 		}
 
-		duration := b.Duration()
+		duration := retry(codes)
 
 		p.Logger.Info(
 			"put failures",
 			LogValue{"failures", failed},
 			LogValue{"backoff", duration.String()},
 		)
-		time.Sleep(duration)
+		p.sleep(duration, records)
 
 		// change the logging state for the next itertion
 		reason = "retry"
-		records = failures(records, out.Records)
+		records = retries
 		numRetries++
 	}
 }
 
-// dispatchFailures gets batch of records, extract them, and push them
-// into the failure channel
-func (p *Producer) dispatchFailures(records []*kinesis.PutRecordsRequestEntry, err error) {
+// produce completes the record put to the shard with the sequence number.
+func (p *Producer) produce(record *kinesisRecord, shardID, sequenceNumber string, notifyResults bool) {
+	shard := p.ShardLabelFunc(shardID)
+	p.trackLabel("kinesis_records_put_total", shard)
+	p.metrics.kinesisRecordsPutCnt.WithLabelValues(p.MetricStreamLabel, shard).Inc()
+	record.resolve(sequenceNumber, nil)
+	if record.tally != nil {
+		record.tally.complete(record, false)
+	}
+	atomic.AddInt64(&p.produced, int64(record.count))
+	atomic.AddUint64(&p.recordsSent, 1)
+	atomic.AddUint64(&p.bytesSent, uint64(len(record.Data)+len(*record.PartitionKey)))
+	if record.aggregated {
+		p.aggregateProduced()
+	}
+	if notifyResults {
+		p.dispatchResult(&PutResult{*record.PartitionKey, shardID, sequenceNumber, record.aggregateID})
+	}
+}
+
+// dispatchFailures gets batch of records, extract them, and hand them over
+// to the failure sink, or push them into the failure channel if we notify
+func (p *Producer) dispatchFailures(records []*kinesisRecord, err error) {
+	if err == ErrSnapshotted {
+		p.snapshotted(records)
+		return
+	}
 	for _, r := range records {
-		if isAggregated(r) {
-			p.dispatchFailures(extractRecords(r), err)
-		} else {
-			p.failure <- &FailureRecord{err, r.Data, *r.PartitionKey}
+		r.resolve("", err)
+		if r.tally != nil {
+			r.tally.complete(r, true)
+		}
+	}
+	failures := failureRecords(records, err)
+	// counted in user records, like the produced ones, whether extracted or not
+	atomic.AddInt64(&p.failed, int64(userCount(records)))
+	if p.FailureTransformer != nil {
+		failures = p.transformFailures(failures)
+		if len(failures) == 0 {
+			return
 		}
 	}
+	if p.FailureSink != nil {
+		p.FailureSink(failures)
+		return
+	}
+	p.RLock()
+	notify := p.notify
+	p.RUnlock()
+	if !notify {
+		p.keep(failures)
+		return
+	}
+	for _, r := range failures {
+		if p.FailureChannelSize == 0 {
+			p.failure <- r
+			continue
+		}
+		p.pushDroppingOldest(r)
+	}
+}
+
+// userCount returns the number of user records carried by the records.
+func userCount(records []*kinesisRecord) (n int) {
+	for _, r := range records {
+		n += r.count
+	}
+	return
 }
 
-// failures returns the failed records as indicated in the response.
-func failures(records []*kinesis.PutRecordsRequestEntry,
-	response []*kinesis.PutRecordsResultEntry) (out []*kinesis.PutRecordsRequestEntry) {
-	for i, record := range response {
-		if record.ErrorCode != nil {
-			out = append(out, records[i])
+// transformFailures applies the failure transformer to the failure records,
+// leaving out the ones it drops.
+func (p *Producer) transformFailures(failures []*FailureRecord) []*FailureRecord {
+	out := failures[:0]
+	for _, r := range failures {
+		if r = p.FailureTransformer(r); r != nil {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// pushDroppingOldest pushes the failure record into the failures channel, making
+// room for it by dropping the oldest one if the channel is full.
+func (p *Producer) pushDroppingOldest(r *FailureRecord) {
+	for {
+		select {
+		case p.failure <- r:
+			return
+		default:
+		}
+		select {
+		case <-p.failure:
+			p.metrics.failuresDroppedCnt.WithLabelValues(p.MetricStreamLabel).Inc()
+		default:
+		}
+	}
+}
+
+// dispatchResult pushes the result into the results channel, or drops it
+// if the channel is full
+func (p *Producer) dispatchResult(r *PutResult) {
+	select {
+	case p.results <- r:
+	default:
+	}
+}
+
+// failureRecords converts a batch of records into failure records,
+// extracting the user records out of the aggregated ones.
+func failureRecords(records []*kinesisRecord, err error) (out []*FailureRecord) {
+	for _, r := range records {
+		for _, u := range r.userRecords() {
+			out = append(out, &FailureRecord{
+				Error:         err,
+				Data:          u.data,
+				PartitionKey:  u.partitionKey,
+				ContextValues: u.values,
+				Route:         u.route,
+				OrderingKey:   u.orderingKey,
+				Compression:   u.compression,
+				Debug:         u.debug,
+				ContentType:   u.contentType,
+				Timestamp:     u.timestamp,
+			})
 		}
 	}
 	return
 }
+
+// userRecords returns the user records carried by the record, with the options they were
+// put with. The record is returned as a whole if its user records can't be extracted.
+func (r *kinesisRecord) userRecords() []*userRecord {
+	var out []*userRecord
+	if r.users != nil {
+		for _, u := range r.users {
+			out = append(out, &userRecord{data: u.Data, partitionKey: *u.PartitionKey})
+		}
+	} else if isAggregated(r.PutRecordsRequestEntry) {
+		out = extractUserRecords(r.PutRecordsRequestEntry)
+	}
+	if len(out) == 0 {
+		out = []*userRecord{{data: r.Data, partitionKey: *r.PartitionKey}}
+	}
+	for i, u := range out {
+		if i < len(r.metas) && r.metas[i] != nil {
+			u.restore(r.metas[i])
+		}
+	}
+	return out
+}
@@ -1,12 +1,22 @@
 package producer
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	k "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 type responseMock struct {
@@ -107,7 +117,7 @@ var testCases = []testCase{
 						FailedRecordCount: aws.Int64(1),
 						Records: []*k.PutRecordsResultEntry{
 							{SequenceNumber: aws.String("3"), ShardId: aws.String("1")},
-							{ErrorCode: aws.String("400"), ErrorMessage: aws.String("error")},
+							{ErrorCode: aws.String("ProvisionedThroughputExceededException"), ErrorMessage: aws.String("error")},
 						},
 					},
 				},
@@ -216,3 +226,803 @@ func TestNotify(t *testing.T) {
 		t.Error("failed test: NotifyFailure\n\texpect failures channel to be closed")
 	}
 }
+
+func TestFailureSink(t *testing.T) {
+	kError := errors.New("ResourceNotFoundException: Stream foo under account X not found")
+	var (
+		mu     sync.Mutex
+		failed int
+	)
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		BatchCount:          1,
+		AggregateBatchCount: 10,
+		Client: &clientMock{
+			incoming:  make(map[int][]string),
+			responses: []responseMock{{Error: kError}},
+		},
+		FailureSink: func(records []*FailureRecord) {
+			mu.Lock()
+			failed += len(records)
+			mu.Unlock()
+		},
+	})
+	// the failures channel must not be used when a sink is set,
+	// so leaving it unread should not block the producer.
+	p.NotifyFailures()
+	p.Start()
+	records := genBulk(10, "bar")
+	for _, r := range records {
+		p.Put([]byte(r), r)
+	}
+	p.Stop()
+
+	if failed != len(records) {
+		t.Errorf("failed test: FailureSink\n\texcpeted:%v\n\tactual:%v", len(records), failed)
+	}
+}
+
+func TestResults(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		BatchCount:          2,
+		AggregateBatchCount: 1,
+		Client: &clientMock{
+			incoming: make(map[int][]string),
+			responses: []responseMock{
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(1),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("3"), ShardId: aws.String("1")},
+							{ErrorCode: aws.String("ProvisionedThroughputExceededException"), ErrorMessage: aws.String("error")},
+						},
+					},
+				},
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(0),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("4"), ShardId: aws.String("1")},
+						},
+					},
+				},
+			}},
+	})
+	results := p.Results()
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	p.Stop()
+
+	var got []*PutResult
+	for r := range results {
+		got = append(got, r)
+	}
+	if len(got) != 2 || got[0].PartitionKey != "hello" || got[1].PartitionKey != "world" || got[1].SequenceNumber != "4" {
+		t.Errorf("failed test: Results\n\tactual:%v", got)
+	}
+}
+
+func TestCredentialRefresher(t *testing.T) {
+	refreshed := 0
+	client := &clientMock{
+		incoming: make(map[int][]string),
+		responses: []responseMock{
+			{Error: awserr.New("ExpiredTokenException", "The security token included in the request is expired", nil)},
+		},
+	}
+	refreshedClient := &clientMock{
+		incoming:  make(map[int][]string),
+		responses: []responseMock{{Response: &k.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}}},
+	}
+	p := New(&Config{
+		StreamName:     "foo",
+		MaxConnections: 1,
+		Client:         client,
+		CredentialRefresher: func() (Putter, error) {
+			refreshed++
+			return refreshedClient, nil
+		},
+	})
+	failures := p.NotifyFailures()
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Stop()
+
+	assert(t, refreshed == 1, "should refresh the credentials once")
+	assert(t, client.calls == 1 && refreshedClient.calls == 1, "should retry the records with the refreshed client")
+	_, ok := <-failures
+	assert(t, !ok, "should not report the retried records as failures")
+}
+
+func TestOnRetry(t *testing.T) {
+	type retry struct {
+		attempt int
+		code    string
+		records int
+	}
+	var retries []retry
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		BatchCount:          3,
+		AggregateBatchCount: 1,
+		Client: &clientMock{
+			incoming: make(map[int][]string),
+			responses: []responseMock{
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(2),
+						Records: []*k.PutRecordsResultEntry{
+							{ErrorCode: aws.String("ProvisionedThroughputExceededException"), ErrorMessage: aws.String("error")},
+							{SequenceNumber: aws.String("3"), ShardId: aws.String("1")},
+							{ErrorCode: aws.String("ProvisionedThroughputExceededException"), ErrorMessage: aws.String("error")},
+						},
+					},
+				},
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(0),
+					},
+				},
+			}},
+		OnRetry: func(attempt int, code string, records int) {
+			retries = append(retries, retry{attempt, code, records})
+		},
+	})
+	p.Start()
+	for _, r := range []string{"a", "b", "c"} {
+		p.Put([]byte(r), r)
+	}
+	p.Stop()
+
+	expected := retry{1, "ProvisionedThroughputExceededException", 2}
+	if len(retries) != 1 || retries[0] != expected {
+		t.Errorf("failed test: OnRetry\n\texcpeted:%v\n\tactual:%v", []retry{expected}, retries)
+	}
+}
+
+func TestRetryableErrorFunc(t *testing.T) {
+	localstackError := errors.New("localstack: slow down")
+	client := &clientMock{
+		incoming: make(map[int][]string),
+		responses: []responseMock{
+			{Error: localstackError},
+			{
+				Response: &k.PutRecordsOutput{
+					FailedRecordCount: aws.Int64(1),
+					Records: []*k.PutRecordsResultEntry{
+						{SequenceNumber: aws.String("3"), ShardId: aws.String("1")},
+						{ErrorCode: aws.String("AccessDeniedException"), ErrorMessage: aws.String("error")},
+					},
+				},
+			},
+		},
+	}
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		BatchCount:          2,
+		AggregateBatchCount: 1,
+		Client:              client,
+		RetryableErrorFunc: func(err error) bool {
+			return err == localstackError || IsRetryableError(err)
+		},
+	})
+	failures := p.NotifyFailures()
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	p.Stop()
+
+	assert(t, client.calls == 2, "should retry the request failing with a retryable error")
+	failure, ok := <-failures
+	assert(t, ok && failure.PartitionKey == "world", "should report a record failing with a permanent error")
+	_, ok = <-failures
+	assert(t, !ok, "should report only the records failing with a permanent error")
+}
+
+func TestHealth(t *testing.T) {
+	p := New(&Config{
+		StreamName:     "foo",
+		MaxConnections: 1,
+		Client: &clientMock{
+			incoming: make(map[int][]string),
+			responses: []responseMock{
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(0),
+					},
+				},
+			}},
+	})
+	assert(t, p.Health().LastSuccessfulFlush.IsZero(), "should not have flushed yet")
+	start := time.Now()
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Stop()
+	health := p.Health()
+	assert(t, health.Stopped, "should report the producer as stopped")
+	assert(t, !health.LastSuccessfulFlush.Before(start), "should report the time of the last successful flush")
+}
+
+func TestStartAndWait(t *testing.T) {
+	p := New(&Config{
+		StreamName:    "foo",
+		FlushInterval: 10 * time.Millisecond,
+		Client:        &successClient{},
+	})
+	p.Put([]byte("hello"), "hello")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := p.StartAndWait(ctx)
+	assert(t, err == nil, "should return once the first flush succeeded")
+	p.Stop()
+
+	// nothing is written without records
+	p = New(&Config{StreamName: "foo", Client: &successClient{}})
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = p.StartAndWait(ctx)
+	assert(t, err == context.DeadlineExceeded, "should return the error of the context")
+	p.Stop()
+
+	// unless the probe record is put
+	client := &failingClient{code: "InternalFailure", request: true}
+	p = New(&Config{
+		StreamName:        "foo",
+		ProbePartitionKey: "probe",
+		ProbeInterval:     time.Millisecond,
+		Client:            client,
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = p.StartAndWait(ctx)
+	assert(t, err == context.DeadlineExceeded, "expect a failing probe put not to prove the producer can write")
+	p.Stop()
+	client.Lock()
+	assert(t, client.requests > 1, "expect the probe record to be put until one succeeds")
+	client.Unlock()
+
+	p = New(&Config{StreamName: "foo", ProbePartitionKey: "probe", Client: &successClient{}})
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert(t, p.StartAndWait(ctx) == nil, "should return once the probe record is put")
+	p.Stop()
+}
+
+func TestMetricStreamLabel(t *testing.T) {
+	p := New(&Config{
+		StreamName:        "foo",
+		MetricStreamLabel: "arn:aws:kinesis:eu-west-1:123456789012:stream/foo",
+		Client:            &clientMock{incoming: make(map[int][]string)},
+	})
+	p.Put([]byte("hello"), "hello")
+	put := testutil.ToFloat64(p.metrics.userRecordsPutCnt.WithLabelValues("arn:aws:kinesis:eu-west-1:123456789012:stream/foo"))
+	assert(t, put == 1, "expect the metrics to be labeled with MetricStreamLabel")
+	put = testutil.ToFloat64(p.metrics.userRecordsPutCnt.WithLabelValues("foo"))
+	assert(t, put == 0, "expect the metrics not to be labeled with StreamName")
+}
+
+func TestWouldFit(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		AggregateBatchCount: 2,
+		Client:              &clientMock{incoming: make(map[int][]string)},
+	})
+	assert(t, p.WouldFit([]byte("hello"), "hello"), "expect record to fit in the empty aggregate")
+	assert(t, !p.WouldFit(make([]byte, p.AggregateBatchSize), "hello"), "expect record bigger than an aggregate not to fit")
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	assert(t, !p.WouldFit([]byte("foo"), "foo"), "expect record not to fit in the full aggregate")
+	assert(t, p.aggregator.Count() == 2, "expect WouldFit not to change the aggregate")
+}
+
+func TestAggregateOrdering(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		AggregateBatchCount: 1000,
+		Client:              &clientMock{incoming: make(map[int][]string)},
+	})
+	keys, n := 10, 50
+	var wg sync.WaitGroup
+	wg.Add(keys)
+	for i := 0; i < keys; i++ {
+		go func(key string) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				p.Put([]byte(strconv.Itoa(j)), key)
+			}
+		}("key-" + strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1, "expect a single aggregated record")
+	out, err := Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil && len(out) == keys*n, "expect all the user records")
+	next := make(map[string]int)
+	for _, r := range out {
+		assert(t, string(r.Data) == strconv.Itoa(next[r.PartitionKey]), "expect the user records of a key in Put order")
+		next[r.PartitionKey]++
+	}
+}
+
+func TestShardLabelFunc(t *testing.T) {
+	p := New(&Config{
+		StreamName:     "foo",
+		MaxConnections: 1,
+		ShardLabelFunc: func(shardID string) string { return "group-" + shardID },
+		Client: &clientMock{
+			incoming: make(map[int][]string),
+			responses: []responseMock{
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(0),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("1"), ShardId: aws.String("shardId-000000000001")},
+						},
+					},
+				},
+			},
+		},
+	})
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Stop()
+	put := testutil.ToFloat64(p.metrics.kinesisRecordsPutCnt.WithLabelValues("foo", "group-shardId-000000000001"))
+	assert(t, put == 1, "expect the shard label to be mapped by ShardLabelFunc")
+}
+
+func TestAggregateFlushReason(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		AggregateBatchCount: 2,
+		Client:              &clientMock{incoming: make(map[int][]string)},
+	})
+	for _, key := range []string{"a", "b", "c"} {
+		p.Put([]byte("hello"), key)
+	}
+	p.drainIfNeed("explicit")
+	count := testutil.ToFloat64(p.metrics.aggregateFlushCnt.WithLabelValues("foo", "count"))
+	explicit := testutil.ToFloat64(p.metrics.aggregateFlushCnt.WithLabelValues("foo", "explicit"))
+	assert(t, count == 1 && explicit == 1, "expect the aggregate flushes to be counted by reason")
+}
+
+func TestMaxKeysPerAggregate(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxKeysPerAggregate: 2,
+		Client:              &clientMock{incoming: make(map[int][]string)},
+	})
+	for _, key := range []string{"a", "b", "a", "b", "c", "a"} {
+		p.Put([]byte("hello"), key)
+	}
+	record := <-p.records
+	assert(t, record.count == 4, "expect the aggregate to be drained before its third partition key")
+	keys := testutil.ToFloat64(p.metrics.aggregateFlushCnt.WithLabelValues("foo", "keys"))
+	assert(t, keys == 1, "expect the aggregate flush to be counted for its keys")
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1 && records[0].count == 2, "expect the next aggregate to hold the rest")
+	m := new(dto.Metric)
+	p.metrics.aggregateDistinctKeys.WithLabelValues("foo").(prometheus.Metric).Write(m)
+	assert(t, m.GetHistogram().GetSampleCount() == 2 && m.GetHistogram().GetSampleSum() == 4, "expect the distinct keys of each aggregate to be observed")
+}
+
+func TestAggregateTargetSize(t *testing.T) {
+	target := 1024
+	p := New(&Config{
+		StreamName:         "foo",
+		AggregateBatchSize: target,
+		Client:             &clientMock{incoming: make(map[int][]string)},
+	})
+	data := make([]byte, 50)
+	for i := 0; i < 100; i++ {
+		p.Put(data, "foo")
+	}
+	p.Put(make([]byte, 2*target), "large")
+	close(p.records)
+	var sizes []int
+	for r := range p.records {
+		sizes = append(sizes, len(r.Data))
+	}
+	assert(t, len(sizes) > 1, "expect many aggregated records")
+	for _, size := range sizes[:len(sizes)-1] {
+		assert(t, size <= target && size > target-target/8, "expect aggregated records close to the target size")
+	}
+	assert(t, sizes[len(sizes)-1] == 2*target, "expect the larger record to be sent alone")
+}
+
+func TestPutValidation(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+	})
+	assert(t, p.Put([]byte("hello"), "") == ErrIllegalPartitionKey, "expect an empty key to be rejected")
+	assert(t, p.Put([]byte("hello"), strings.Repeat("k", 257)) == ErrPartitionKeyTooLong, "expect a key longer than 256 bytes to be rejected")
+	assert(t, p.Put([]byte("hello"), strings.Repeat("k", 256)) == nil, "expect a key of 256 bytes to be accepted")
+	assert(t, p.Put(make([]byte, maxRecordSize), "k") == ErrRecordSizeExceeded, "expect the key to count toward the record size")
+	assert(t, p.Put(make([]byte, maxRecordSize-1), "k") == nil, "expect a record of the maximum size to be accepted")
+}
+
+func TestAutoPartitionKey(t *testing.T) {
+	p := New(&Config{
+		StreamName:       "foo",
+		AutoPartitionKey: true,
+		Client:           &clientMock{incoming: make(map[int][]string)},
+	})
+	assert(t, p.Put([]byte("hello"), "") == nil, "expect an empty key to be replaced")
+	assert(t, p.Put([]byte("world"), "") == nil, "expect an empty key to be replaced")
+	records := p.drainIfNeed("explicit")
+	out, err := Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(out) == 2 && len(out[0].PartitionKey) == 36, "expect the records to be put with a UUID")
+	assert(t, out[0].PartitionKey != out[1].PartitionKey, "expect the keys to be random")
+
+	p = New(&Config{StreamName: "foo", Client: &clientMock{incoming: make(map[int][]string)}})
+	assert(t, p.Put([]byte("hello"), "") == ErrEmptyPartitionKey, "expect an empty key to be rejected")
+}
+
+func TestEagerFlush(t *testing.T) {
+	p := New(&Config{
+		StreamName:     "foo",
+		MaxConnections: 1,
+		FlushInterval:  time.Hour,
+		EagerFlush:     true,
+		Client: &clientMock{
+			incoming: make(map[int][]string),
+			responses: []responseMock{
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(0),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+						},
+					},
+				},
+			},
+		},
+	})
+	results := p.Results()
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	select {
+	case r := <-results:
+		assert(t, r.SequenceNumber == "1", "expect the record to be produced")
+	case <-time.After(time.Second):
+		t.Error("expect the record to be flushed once idle")
+	}
+	p.Stop()
+}
+
+func TestIdleFlushDelay(t *testing.T) {
+	client := &successClient{}
+	p := New(&Config{
+		StreamName:     "foo",
+		FlushInterval:  time.Hour,
+		IdleFlushDelay: 100 * time.Millisecond,
+		Client:         client,
+	})
+	assert(t, p.EagerFlush, "expect the idle flush delay to enable eager flushes")
+	p.Start()
+	// the delay is reset on each put
+	for i := 0; i < 10; i++ {
+		p.Put([]byte("hello"), "hello")
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Lock()
+	sent := len(client.keys)
+	client.Unlock()
+	assert(t, sent == 0, "expect no flush while records are put")
+	deadline := time.Now().Add(time.Second)
+	for sent == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		client.Lock()
+		sent = len(client.keys)
+		client.Unlock()
+	}
+	assert(t, sent == 1, "expect the partial aggregate to be flushed once idle")
+	p.Stop()
+}
+
+func TestFailureChannelSize(t *testing.T) {
+	kError := errors.New("ResourceNotFoundException: Stream foo under account X not found")
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		AggregateBatchCount: 1,
+		FailureChannelSize:  2,
+		Client: &clientMock{
+			incoming:  make(map[int][]string),
+			responses: []responseMock{{Error: kError}},
+		},
+	})
+	failures := p.NotifyFailures()
+	p.Start()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		p.Put([]byte(key), key)
+	}
+	// the failures are not read until the producer stops
+	p.Stop()
+
+	var keys []string
+	for r := range failures {
+		keys = append(keys, r.PartitionKey)
+	}
+	assert(t, len(keys) == 2 && keys[0] == "c" && keys[1] == "d", "expect the oldest failures to be dropped")
+	dropped := testutil.ToFloat64(p.metrics.failuresDroppedCnt.WithLabelValues("foo"))
+	assert(t, dropped == 2, "expect the dropped failures to be counted")
+}
+
+func TestOnBatchAssembled(t *testing.T) {
+	var batches []BatchInfo
+	client := &clientMock{incoming: make(map[int][]string)}
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		AggregateBatchCount: 1,
+		Client:              client,
+		OnBatchAssembled: func(info BatchInfo) error {
+			batches = append(batches, info)
+			return errors.New("manifest unavailable")
+		},
+	})
+	failures := p.NotifyFailures()
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	p.Stop()
+
+	assert(t, len(client.incoming) == 0, "expect the aborted batch not to be sent")
+	assert(t, len(batches) == 1, "expect the hook to be called for the batch")
+	info := batches[0]
+	assert(t, info.StreamName == "foo" && info.Reason == "drain", "expect the batch to be described")
+	assert(t, info.Records == 2 && info.UserRecords == 2, "expect the records of the batch to be counted")
+	assert(t, len(info.PartitionKeys) == 2 && info.PartitionKeys[0] == "hello", "expect the partition keys of the batch")
+	n := 0
+	for r := range failures {
+		assert(t, r.Error.Error() == "manifest unavailable", "expect the records to fail with the hook error")
+		n++
+	}
+	assert(t, n == 2, "expect the records of the aborted batch to be reported as failures")
+}
+
+func TestManifestDigest(t *testing.T) {
+	p := New(&Config{StreamName: "foo", Client: &clientMock{incoming: make(map[int][]string)}})
+	hello, world := "hello", "world"
+	records := []*kinesisRecord{
+		{PutRecordsRequestEntry: &k.PutRecordsRequestEntry{Data: []byte("a"), PartitionKey: &hello}, count: 3},
+		{PutRecordsRequestEntry: &k.PutRecordsRequestEntry{Data: []byte("bc"), PartitionKey: &world}, count: 1},
+	}
+	d := p.batchInfo(records, "interval").ManifestDigest()
+	h := sha256.Sum256([]byte("\x00\x00\x00\x05hello\x00\x00\x00\x01a\x00\x00\x00\x05world\x00\x00\x00\x02bc"))
+	assert(t, d.Records == 2 && d.UserRecords == 4 && d.Bytes == 13, "expect the batch to be counted")
+	assert(t, d.Hash == hex.EncodeToString(h[:]), "expect the keys and data to be hashed in order")
+	assert(t, d.String() == "records=2 user_records=4 bytes=13 sha256="+d.Hash, "expect a compact representation")
+
+	world = "other"
+	assert(t, p.batchInfo(records, "interval").ManifestDigest().Hash != d.Hash, "expect the hash to change with the keys")
+	info := BatchInfo{PartitionKeys: []string{"hello"}}
+	assert(t, len(info.ManifestDigest().Hash) == 64, "expect the keys of a batch without data to be hashed")
+}
+
+func TestFailureTransformer(t *testing.T) {
+	kError := errors.New("ResourceNotFoundException: Stream foo under account X not found")
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		AggregateBatchCount: 1,
+		Client: &clientMock{
+			incoming:  make(map[int][]string),
+			responses: []responseMock{{Error: kError}},
+		},
+		FailureTransformer: func(r *FailureRecord) *FailureRecord {
+			if r.PartitionKey == "secret" {
+				return nil
+			}
+			r.Data = append([]byte("redacted:"), r.Data...)
+			return r
+		},
+	})
+	failures := p.NotifyFailures()
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("password"), "secret")
+	p.Stop()
+
+	var data []string
+	for r := range failures {
+		data = append(data, string(r.Data))
+	}
+	assert(t, len(data) == 1 && data[0] == "redacted:hello", "expect the failures to be transformed, or dropped")
+	assert(t, p.closeResult().Failed == 2, "expect the dropped failures to be counted as failed")
+}
+
+func TestDelimitedFailures(t *testing.T) {
+	kError := errors.New("ResourceNotFoundException: Stream foo under account X not found")
+	p := New(&Config{
+		StreamName:     "foo",
+		MaxConnections: 1,
+		Framing:        FramingDelimited,
+		Delimiter:      []byte("\n"),
+		Client: &clientMock{
+			incoming:  make(map[int][]string),
+			responses: []responseMock{{Error: kError}},
+		},
+	})
+	failures := p.NotifyFailures()
+	p.Start()
+	p.Put([]byte("hello"), "foo")
+	p.Put([]byte("world"), "bar")
+	p.Stop()
+
+	var got []string
+	for r := range failures {
+		got = append(got, r.PartitionKey+":"+string(r.Data))
+	}
+	assert(t, len(got) == 2, "expect a failure per user record")
+	assert(t, got[0] == "foo:hello" && got[1] == "bar:world", "expect the failures to hold the user records")
+}
+
+// tracerMock records the traced PutRecords requests.
+type tracerMock struct {
+	infos  []BatchInfo
+	failed []int
+	errs   []error
+}
+
+func (m *tracerMock) StartPutRecords(info BatchInfo) func(int, error) {
+	m.infos = append(m.infos, info)
+	return func(failed int, err error) {
+		m.failed = append(m.failed, failed)
+		m.errs = append(m.errs, err)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &tracerMock{}
+	p := New(&Config{
+		StreamName:     "foo",
+		MaxConnections: 1,
+		Tracer:         tracer,
+		Client: &clientMock{
+			incoming: make(map[int][]string),
+			responses: []responseMock{
+				{
+					Response: &k.PutRecordsOutput{
+						FailedRecordCount: aws.Int64(0),
+						Records: []*k.PutRecordsResultEntry{
+							{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+						},
+					},
+				},
+			},
+		},
+	})
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	p.Stop()
+	assert(t, len(tracer.infos) == 1 && tracer.infos[0].UserRecords == 2, "expect the request to be traced")
+	assert(t, tracer.failed[0] == 0 && tracer.errs[0] == nil, "expect the outcome of the request to be traced")
+}
+
+func TestMaxUserRecordsPerRequest(t *testing.T) {
+	response := func(seq string) responseMock {
+		return responseMock{
+			Response: &k.PutRecordsOutput{
+				FailedRecordCount: aws.Int64(0),
+				Records: []*k.PutRecordsResultEntry{
+					{SequenceNumber: aws.String(seq), ShardId: aws.String("1")},
+				},
+			},
+		}
+	}
+	client := &clientMock{
+		incoming:  make(map[int][]string),
+		responses: []responseMock{response("1"), response("2"), response("3")},
+	}
+	p := New(&Config{
+		StreamName:               "foo",
+		MaxConnections:           1,
+		AggregateBatchCount:      2,
+		MaxUserRecordsPerRequest: 3,
+		Client:                   client,
+	})
+	assert(t, p.Stats().MaxUserRecordsPerRequest == 3, "expect the effective limit in the stats")
+	p.Start()
+	for i := 0; i < 6; i++ {
+		p.Put([]byte("hello"), strconv.Itoa(i))
+	}
+	p.Stop()
+	assert(t, len(client.incoming) == 3, "expect a request per aggregated record")
+	assert(t, p.Stats().Produced == 6, "expect the produced records in the stats")
+}
+
+func TestOnStats(t *testing.T) {
+	stats := make(chan Stats, 100)
+	p := New(&Config{
+		StreamName:    "foo",
+		FlushInterval: 5 * time.Millisecond,
+		StatsInterval: 10 * time.Millisecond,
+		OnStats:       func(s Stats) { stats <- s },
+		Client:        &successClient{},
+	})
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	deadline := time.After(time.Second)
+	for produced := false; !produced; {
+		select {
+		case s := <-stats:
+			produced = s.Produced == 1
+		case <-deadline:
+			t.Fatal("expect the stats to be reported periodically")
+		}
+	}
+	p.Stop()
+	time.Sleep(30 * time.Millisecond)
+	for len(stats) > 0 {
+		<-stats
+	}
+	time.Sleep(30 * time.Millisecond)
+	assert(t, len(stats) == 0, "expect the stats to stop being reported once stopped")
+}
+
+func TestAggregatedPartitionKeys(t *testing.T) {
+	group := func(key string) string { return "group-" + key[:1] }
+	for _, config := range []Config{{}, {MarshalWorkers: 2}} {
+		client := &dataClient{}
+		config.StreamName = "foo"
+		config.Client = client
+		config.AggregateKeyGroupFunc = group
+		config.AggregateKeyFunc = func(keys []string) string { return group(keys[0]) }
+		p := New(&config)
+		p.Start()
+		keys := []string{"a1", "b1", "a2", "a1", "b2"}
+		for _, key := range keys {
+			p.Put([]byte("data-"+key), key)
+		}
+		p.Stop()
+
+		assert(t, len(client.records) == 2, "expect an aggregated record per group")
+		found := make(map[string]int)
+		for _, r := range client.records {
+			out, err := Deaggregate(r.Data, *r.PartitionKey)
+			assert(t, err == nil, "should not return an error")
+			for _, u := range out {
+				assert(t, string(u.Data) == "data-"+u.PartitionKey, "expect the user records to keep their own partition key")
+				assert(t, group(u.PartitionKey) == *r.PartitionKey, "expect the aggregated record to be put with the group key")
+				found[u.PartitionKey]++
+			}
+		}
+		assert(t, found["a1"] == 2 && found["a2"] == 1 && found["b1"] == 1 && found["b2"] == 1, "expect all the user records")
+
+		failures := failureRecords([]*kinesisRecord{{PutRecordsRequestEntry: client.records[0], aggregated: true}}, errors.New("failed"))
+		for _, f := range failures {
+			assert(t, string(f.Data) == "data-"+f.PartitionKey, "expect the failures to carry the partition key of their user record")
+		}
+	}
+}
+
+func TestTotalsSent(t *testing.T) {
+	client := &dataClient{}
+	p := New(&Config{
+		StreamName:          "foo",
+		AggregateBatchCount: 2,
+		Client:              client,
+	})
+	p.Start()
+	for _, key := range []string{"a", "b", "c"} {
+		p.Put([]byte("data-"+key), key)
+	}
+	p.Stop()
+	bytes := 0
+	for _, r := range client.records {
+		bytes += len(r.Data) + len(*r.PartitionKey)
+	}
+	assert(t, p.TotalRecordsSent() == 2, "expect the Kinesis records to be counted")
+	assert(t, p.TotalBytesSent() == uint64(bytes), "expect the bytes of the Kinesis records to be counted")
+}
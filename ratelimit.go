@@ -0,0 +1,69 @@
+package producer
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket of user records, refilled at `rate` records per
+// second, up to a second worth of them.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take a token out of the bucket at `now`, or returns how long to wait for the next one.
+func (l *rateLimiter) take(now time.Time) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+		l.last = now
+	}
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// throttle waits for the user record to be admitted by `Config.MaxRecordsPerSecond`,
+// like for room in the backlog: a record put while the producer is paused, without a
+// deadline, doesn't wait, and fails with ErrBacklogFull, as does a record whose context
+// is done first.
+func (p *Producer) throttle(r *userRecord) error {
+	start := time.Now()
+	wait := p.limiter.take(start)
+	if wait == 0 {
+		return nil
+	}
+	defer func() {
+		elapsed := float64(time.Since(start)) / float64(time.Millisecond)
+		p.metrics.throttleWaitDur.WithLabelValues(p.MetricStreamLabel).Observe(elapsed)
+	}()
+	for ; wait > 0; wait = p.limiter.take(time.Now()) {
+		p.RLock()
+		block := !p.paused || r.done != nil
+		p.RUnlock()
+		if !block {
+			return ErrBacklogFull
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-r.done:
+			timer.Stop()
+			return ErrBacklogFull
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package producer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(10)
+	now := l.last
+	for i := 0; i < 10; i++ {
+		assert(t, l.take(now) == 0, "expect a burst of a second worth of records")
+	}
+	assert(t, l.take(now) == 100*time.Millisecond, "expect to wait for the next token")
+	assert(t, l.take(now.Add(50*time.Millisecond)) == 50*time.Millisecond, "expect the bucket to be refilled over time")
+	assert(t, l.take(now.Add(100*time.Millisecond)) == 0, "expect a token once refilled")
+	assert(t, l.take(now.Add(time.Hour)) == 0 && l.tokens == 9, "expect the bucket to be capped")
+}
+
+func TestMaxRecordsPerSecond(t *testing.T) {
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxRecordsPerSecond: 20,
+		Client:              &successClient{},
+	})
+	p.Start()
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		assert(t, p.Put([]byte("hello"), "hello") == nil, "should put the record")
+	}
+	assert(t, time.Since(start) >= 400*time.Millisecond, "expect the records over the burst to be throttled")
+	m := new(dto.Metric)
+	p.metrics.throttleWaitDur.WithLabelValues("foo").(prometheus.Metric).Write(m)
+	assert(t, m.GetHistogram().GetSampleCount() > 0, "expect the throttle wait time to be observed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert(t, p.PutWithContext(ctx, []byte("hello"), "hello") == ErrBacklogFull, "expect a record to give up once its context is done")
+	p.Pause()
+	assert(t, p.Put([]byte("hello"), "hello") == ErrBacklogFull, "expect a record put while paused not to wait")
+	p.Resume()
+	p.Stop()
+}
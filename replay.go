@@ -0,0 +1,53 @@
+package producer
+
+import "fmt"
+
+// ReplayError is returned by `Replay` when some of the failure records were not
+// re-enqueued. Their `Error` is set to the reason they were not.
+type ReplayError struct {
+	Failed []*FailureRecord
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("kinesis: %d records not replayed: %v", len(e.Failed), e.Failed[0].Error)
+}
+
+// Replay re-enqueues the failure records into the producer, with their partition key,
+// context values and the options they were put with, e.g. their route, and their
+// timestamp, as they were reported, i.e. without encoding or deduplicating them again.
+// It doesn't wait for room in the backlog: the records that don't fit, or can't be put,
+// are returned in a `*ReplayError`, to be replayed later or dropped.
+func (p *Producer) Replay(records []*FailureRecord) error {
+	var failed []*FailureRecord
+	for _, f := range records {
+		r := &userRecord{
+			data:         f.Data,
+			partitionKey: f.PartitionKey,
+			values:       f.ContextValues,
+			route:        f.Route,
+			orderingKey:  f.OrderingKey,
+			compression:  f.Compression,
+			debug:        f.Debug,
+			contentType:  f.ContentType,
+			timestamp:    f.Timestamp,
+			done:         closedDone,
+		}
+		err := p.validate(r)
+		if err == nil {
+			if p.spillable(r) {
+				err = p.putOrSpill(r)
+			} else {
+				err = p.add(r)
+			}
+		}
+		if err != nil {
+			failure := *f
+			failure.Error = err
+			failed = append(failed, &failure)
+		}
+	}
+	if len(failed) > 0 {
+		return &ReplayError{Failed: failed}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package producer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	client := &successClient{}
+	p := New(&Config{
+		StreamName:          "foo",
+		BacklogCount:        1,
+		AggregateBatchCount: 1,
+		Client:              client,
+	})
+	kError := errors.New("ResourceNotFoundException: Stream foo under account X not found")
+	var failures []*FailureRecord
+	for _, key := range []string{"a", "", "b", "c"} {
+		failures = append(failures, &FailureRecord{Error: kError, Data: []byte("data-" + key), PartitionKey: key})
+	}
+	err := p.Replay(failures)
+	rerr, ok := err.(*ReplayError)
+	assert(t, ok, "expect a replay error")
+	assert(t, len(rerr.Failed) == 2, "expect the records not re-enqueued to be returned")
+	assert(t, rerr.Failed[0].PartitionKey == "" && rerr.Failed[0].Error == ErrIllegalPartitionKey, "expect an invalid record not to be replayed")
+	assert(t, rerr.Failed[1].PartitionKey == "c" && rerr.Failed[1].Error == ErrBacklogFull, "expect the records to respect the backlog limit")
+
+	p.Start()
+	p.Stop()
+	assert(t, len(client.keys) == 2 && client.keys[0] == "a" && client.keys[1] == "b", "expect the replayed records to be produced")
+}
+
+func TestReplayOptions(t *testing.T) {
+	var failures []*FailureRecord
+	p := New(&Config{
+		StreamName:       "foo",
+		MaxConnections:   1,
+		RecordTimestamps: true,
+		Client:           &failingClient{code: "InternalFailure"},
+		FailureSink:      func(f []*FailureRecord) { failures = append(failures, f...) },
+		RetryPolicies: map[string]RetryPolicy{
+			RetryClassInternal: {MaxRetries: 1, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		},
+	})
+	p.Start()
+	p.PutWithRoute([]byte("routed"), "a", "orders")
+	p.PutWithContentType([]byte("{}"), "b", "application/json")
+	p.PutWithCodec([]byte("compressed"), "c", CompressionGzip)
+	p.PutWithOrdering([]byte("ordered"), "d", "1")
+	p.Stop()
+	assert(t, len(failures) == 4, "expect the records to fail")
+	options := make(map[string]*FailureRecord)
+	for _, f := range failures {
+		options[f.PartitionKey] = f
+		assert(t, !f.Timestamp.IsZero(), "expect the timestamp of the records to be kept")
+	}
+	assert(t, options["a"].Route == "orders", "expect the route to be kept")
+	assert(t, options["b"].ContentType == "application/json", "expect the content type to be kept")
+	assert(t, options["c"] != nil && string(options["c"].Data) == "compressed" &&
+		options["c"].Compression != nil && *options["c"].Compression == CompressionGzip, "expect the compression to be kept")
+	assert(t, options["d"].OrderingKey == "1", "expect the ordering key to be kept")
+
+	replayed := failures
+	failures = nil
+	p = New(&Config{
+		StreamName:       "foo",
+		MaxConnections:   1,
+		RecordTimestamps: true,
+		Client:           &failingClient{code: "InternalFailure"},
+		FailureSink:      func(f []*FailureRecord) { failures = append(failures, f...) },
+		RetryPolicies: map[string]RetryPolicy{
+			RetryClassInternal: {MaxRetries: 1, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		},
+	})
+	time.Sleep(2 * time.Millisecond)
+	assert(t, p.Replay(replayed) == nil, "expect the records to be replayed")
+	p.Start()
+	p.Stop()
+	assert(t, len(failures) == 4, "expect the replayed records to fail")
+	for _, f := range failures {
+		o := options[f.PartitionKey]
+		assert(t, f.Route == o.Route && f.ContentType == o.ContentType && f.OrderingKey == o.OrderingKey &&
+			(f.Compression == nil) == (o.Compression == nil) && f.Timestamp.Equal(o.Timestamp), "expect the options to be restored")
+	}
+}
@@ -0,0 +1,109 @@
+package producer
+
+import (
+	"time"
+
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/jpillora/backoff"
+)
+
+// retryableErrorCodes are the Kinesis error codes of transient errors,
+// worth retrying.
+var retryableErrorCodes = map[string]bool{
+	k.ErrCodeProvisionedThroughputExceededException: true,
+	k.ErrCodeKMSThrottlingException:                 true,
+	"InternalFailure":                               true,
+	"ServiceUnavailable":                            true,
+	"ServiceUnavailableException":                   true, // Firehose
+	"ThrottlingException":                           true,
+	"Throttling":                                    true,
+	errCodeTimeout:                                  true,
+}
+
+// IsRetryableError is the default `Config.RetryableErrorFunc`. It reports whether `err`
+// is a transient error, based on the Kinesis throttling and internal error codes.
+func IsRetryableError(err error) bool {
+	return retryableErrorCodes[errorCode(err)]
+}
+
+// The classes of error codes `Config.RetryPolicies` may be keyed by, for the
+// error codes without a policy of their own.
+const (
+	// RetryClassThrottling are the throttling error codes of the stream,
+	// e.g. "ProvisionedThroughputExceededException".
+	RetryClassThrottling = "throttling"
+	// RetryClassInternal are the internal error codes of the service,
+	// e.g. "InternalFailure".
+	RetryClassInternal = "internal"
+	// RetryClassOther are the other error codes.
+	RetryClassOther = "other"
+)
+
+// internalErrorCodes are the error codes of the internal errors of the service.
+var internalErrorCodes = map[string]bool{
+	"InternalFailure":             true,
+	"ServiceUnavailable":          true,
+	"ServiceUnavailableException": true,
+}
+
+// RetryPolicy bounds the retries of the records failing with the error codes it applies to.
+type RetryPolicy struct {
+	// MaxRetries is the number of times a record is retried before being failed with the
+	// error. Zero retries it until it succeeds, as without policy.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the exponential backoff between the retries. They
+	// default to 100ms and 10s, as without policy. The longest backoff of the error codes
+	// of a batch is waited for before retrying its records.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// backoff returns the backoff before the retry following `attempt` retries.
+func (r RetryPolicy) backoff(attempt int) time.Duration {
+	b := &backoff.Backoff{Min: r.MinBackoff, Max: r.MaxBackoff, Jitter: true}
+	return b.ForAttempt(float64(attempt))
+}
+
+// retryPolicy returns the retry policy of the error code, if any: the one of
+// the code, or else the one of its class.
+func (p *Producer) retryPolicy(code string) (RetryPolicy, bool) {
+	key, ok := p.retryPolicyKey(code)
+	return p.RetryPolicies[key], ok
+}
+
+// retryPolicyKey returns the key of the retry policy of the error code in
+// `Config.RetryPolicies`: the code itself, or else its class.
+func (p *Producer) retryPolicyKey(code string) (string, bool) {
+	if len(p.RetryPolicies) == 0 {
+		return "", false
+	}
+	if _, ok := p.RetryPolicies[code]; ok {
+		return code, true
+	}
+	class := RetryClassOther
+	if throttlingErrorCodes[code] {
+		class = RetryClassThrottling
+	} else if internalErrorCodes[code] {
+		class = RetryClassInternal
+	}
+	_, ok := p.RetryPolicies[class]
+	return class, ok
+}
+
+// retriesLeft reports whether the record failing with the error code may be retried
+// according to its retry policy, and counts the retry if so. The retries are counted
+// by policy, so that e.g. throttling retries don't use up the internal errors ones.
+func (p *Producer) retriesLeft(r *kinesisRecord, code string) bool {
+	key, ok := p.retryPolicyKey(code)
+	if !ok {
+		return true
+	}
+	if policy := p.RetryPolicies[key]; policy.MaxRetries > 0 && r.retries[key] >= policy.MaxRetries {
+		return false
+	}
+	if r.retries == nil {
+		r.retries = make(map[string]int)
+	}
+	r.retries[key]++
+	return true
+}
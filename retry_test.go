@@ -0,0 +1,84 @@
+package producer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// failingClient fails the records, or the whole requests, with the error code.
+type failingClient struct {
+	sync.Mutex
+	code     string
+	request  bool
+	requests int
+}
+
+func (c *failingClient) PutRecords(input *k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.requests++
+	if c.request {
+		return nil, awserr.New(c.code, "failed", nil)
+	}
+	out := &k.PutRecordsOutput{FailedRecordCount: aws.Int64(int64(len(input.Records)))}
+	for range input.Records {
+		out.Records = append(out.Records, &k.PutRecordsResultEntry{ErrorCode: aws.String(c.code), ErrorMessage: aws.String("failed")})
+	}
+	return out, nil
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+		RetryPolicies: map[string]RetryPolicy{
+			"InternalFailure":    {MaxRetries: 1},
+			RetryClassThrottling: {MaxRetries: 2},
+			RetryClassInternal:   {MaxRetries: 3},
+		},
+	})
+	cases := map[string]int{
+		"InternalFailure": 1,
+		k.ErrCodeProvisionedThroughputExceededException: 2,
+		"ServiceUnavailable":                            3,
+	}
+	for code, max := range cases {
+		policy, ok := p.retryPolicy(code)
+		assert(t, ok && policy.MaxRetries == max, "expect the policy of "+code)
+	}
+	_, ok := p.retryPolicy("Timeout")
+	assert(t, !ok, "expect no policy for the other error codes")
+
+	r := &kinesisRecord{}
+	throttled := k.ErrCodeProvisionedThroughputExceededException
+	assert(t, p.retriesLeft(r, throttled) && p.retriesLeft(r, throttled), "expect the throttling retries of the policy")
+	assert(t, p.retriesLeft(r, "InternalFailure"), "expect the throttling retries not to use up the other policies")
+	assert(t, !p.retriesLeft(r, throttled) && !p.retriesLeft(r, "InternalFailure"), "expect the retries to be bounded by policy")
+	assert(t, p.retriesLeft(r, "Timeout"), "expect the codes without policy to be retried")
+}
+
+func TestRetryPolicies(t *testing.T) {
+	for _, request := range []bool{false, true} {
+		client := &failingClient{code: "InternalFailure", request: request}
+		var failures []*FailureRecord
+		p := New(&Config{
+			StreamName:     "foo",
+			MaxConnections: 1,
+			Client:         client,
+			FailureSink:    func(f []*FailureRecord) { failures = append(failures, f...) },
+			RetryPolicies: map[string]RetryPolicy{
+				RetryClassInternal: {MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			},
+		})
+		p.Start()
+		p.Put([]byte("hello"), "hello")
+		p.Stop()
+		assert(t, client.requests == 3, "expect the records to be retried up to the max retries of the policy")
+		assert(t, len(failures) == 1 && errorCode(failures[0].Error) == "InternalFailure", "expect the records to be failed with the error")
+	}
+}
@@ -0,0 +1,30 @@
+package producer
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ErrRouteUnaggregated is returned for the records put with `PutWithRoute` that would be
+// sent unaggregated with FramingKPL, as the route is stored in the aggregate.
+var ErrRouteUnaggregated = errors.New("Unable to Put record. Route requires the record to be aggregated")
+
+// PutWithRoute `data` using `partitionKey` like `Put`, but aggregates it only with
+// the records put with the same `route`, so that each aggregated record carries
+// a single route, and consumers can dispatch the records by route cheaply.
+// With FramingKPL, the route is stored along with each user record, and returned
+// by `Deaggregate`. It then returns ErrRouteUnaggregated, rather than dropping the
+// route, if the record is too large to be aggregated, or aggregation fell back, see
+// `Config.AggregateFallbackThreshold`.
+func (p *Producer) PutWithRoute(data []byte, partitionKey, route string) error {
+	return p.put(&userRecord{data: data, partitionKey: partitionKey, route: route})
+}
+
+// routeTag returns the tag storing the route of a user record.
+func routeTag(route string) *Tag {
+	return &Tag{
+		Key:   proto.String(tagRoute),
+		Value: proto.String(route),
+	}
+}
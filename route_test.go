@@ -0,0 +1,91 @@
+package producer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPutWithRoute(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+	})
+	p.PutWithRoute([]byte("hello"), "hello", "alerts")
+	p.PutWithRoute([]byte("world"), "world", "metrics")
+	p.PutWithRoute([]byte("foo"), "foo", "alerts")
+	p.Put([]byte("bar"), "bar")
+
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 3, "expect an aggregated record per route")
+	routes := make(map[string]int)
+	for _, r := range records {
+		out, err := Deaggregate(r.Data, *r.PartitionKey)
+		assert(t, err == nil, "should not return an error")
+		for _, u := range out {
+			assert(t, u.Route == out[0].Route, "expect a single route per aggregated record")
+			routes[u.Route]++
+		}
+	}
+	assert(t, routes["alerts"] == 2 && routes["metrics"] == 1 && routes[""] == 1, "expect the records by route")
+	assert(t, len(p.groups) == 0, "expect the drained routes to be released")
+}
+
+func TestRouteUnaggregated(t *testing.T) {
+	p := New(&Config{
+		StreamName:         "foo",
+		AggregateBatchSize: 100,
+		Client:             &clientMock{incoming: make(map[int][]string)},
+	})
+	err := p.PutWithRoute(bytes.Repeat([]byte("a"), 200), "hello", "alerts")
+	assert(t, err == ErrRouteUnaggregated, "expect a record too large to be aggregated to be rejected")
+	assert(t, len(p.records) == 0, "expect the rejected record not to be sent")
+
+	p = New(&Config{
+		StreamName:         "foo",
+		Framing:            FramingDelimited,
+		AggregateBatchSize: 100,
+		Client:             &clientMock{incoming: make(map[int][]string)},
+	})
+	err = p.PutWithRoute(bytes.Repeat([]byte("a"), 200), "hello", "alerts")
+	assert(t, err == nil, "expect the route to be dropped with FramingDelimited, which stores no routes")
+
+	p = New(&Config{
+		StreamName:             "foo",
+		AggregateMinKeyRecords: 2,
+		Client:                 &clientMock{incoming: make(map[int][]string)},
+	})
+	p.PutWithRoute(bytes.Repeat([]byte("a"), 500), "single", "alerts")
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1 && records[0].aggregated, "expect the routed record under a single-use key to stay aggregated")
+	out, err := Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil && len(out) == 1 && out[0].Route == "alerts", "expect the route to be kept")
+}
+
+func TestAggregateKeyGroupFunc(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+		AggregateKeyGroupFunc: func(partitionKey string) string {
+			return partitionKey[:1]
+		},
+	})
+	for _, key := range []string{"a1", "b1", "a2", "b2", "a3"} {
+		p.Put([]byte(key), key)
+	}
+	p.PutWithRoute([]byte("a4"), "a4", "alerts")
+
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 3, "expect an aggregated record per group and route")
+	for _, r := range records {
+		out, err := Deaggregate(r.Data, *r.PartitionKey)
+		assert(t, err == nil, "should not return an error")
+		for _, u := range out {
+			assert(t, u.PartitionKey[:1] == out[0].PartitionKey[:1], "expect a single group per aggregated record")
+			assert(t, u.Route == out[0].Route, "expect a single route per aggregated record")
+		}
+		if len(out) == 3 {
+			assert(t, out[0].PartitionKey == "a1" && out[2].PartitionKey == "a3", "expect the records of a group to keep their order")
+		}
+	}
+	assert(t, len(p.groups) == 0, "expect the drained groups to be released")
+}
@@ -0,0 +1,54 @@
+package producer
+
+import "time"
+
+// flushTimer fires at every flush interval, rounded up to the next boundary of the
+// coalescing window, if any, so that the producers sharing a window flush together.
+type flushTimer struct {
+	timer  *time.Timer
+	window time.Duration
+}
+
+func newFlushTimer(interval, window time.Duration) *flushTimer {
+	t := &flushTimer{window: window}
+	t.timer = time.NewTimer(t.delay(time.Now(), interval))
+	return t
+}
+
+// C is the channel the ticks are delivered on.
+func (t *flushTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+// next schedules the tick following the one received, after `interval`.
+func (t *flushTimer) next(interval time.Duration) {
+	t.timer.Reset(t.delay(time.Now(), interval))
+}
+
+// delay returns how long to wait from `now` for the tick following `interval`.
+func (t *flushTimer) delay(now time.Time, interval time.Duration) time.Duration {
+	if t.window <= 0 {
+		return interval
+	}
+	at := now.Add(interval)
+	if aligned := at.Truncate(t.window); !aligned.Equal(at) {
+		at = aligned.Add(t.window)
+	}
+	return at.Sub(now)
+}
+
+func (t *flushTimer) stop() {
+	t.timer.Stop()
+}
+
+// effectiveFlushInterval returns the flush interval, shrunk toward `Config.MinFlushInterval`
+// according to the depth of the backlog.
+func (p *Producer) effectiveFlushInterval() time.Duration {
+	interval := p.getFlushInterval()
+	if floor := p.MinFlushInterval; floor > 0 && floor < interval && cap(p.records) > 0 {
+		depth := float64(len(p.records)) / float64(cap(p.records))
+		interval -= time.Duration(depth * float64(interval-floor))
+	}
+	p.metrics.effectiveFlushIntervalMs.WithLabelValues(p.MetricStreamLabel).Set(float64(interval) / float64(time.Millisecond))
+	return interval
+}
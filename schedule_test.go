@@ -0,0 +1,49 @@
+package producer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFlushTimerDelay(t *testing.T) {
+	base := time.Unix(1000, 0)
+	cases := []struct {
+		name     string
+		window   time.Duration
+		now      time.Time
+		interval time.Duration
+		want     time.Duration
+	}{
+		{"no window", 0, base.Add(300 * time.Millisecond), time.Second, time.Second},
+		{"aligned", time.Second, base, time.Second, time.Second},
+		{"rounded up", time.Second, base.Add(300 * time.Millisecond), time.Second, 1700 * time.Millisecond},
+		{"window below interval", 2 * time.Second, base.Add(500 * time.Millisecond), time.Second, 1500 * time.Millisecond},
+	}
+	for _, c := range cases {
+		timer := &flushTimer{window: c.window}
+		got := timer.delay(c.now, c.interval)
+		assert(t, got == c.want, c.name+": unexpected delay "+got.String())
+	}
+}
+
+func TestEffectiveFlushInterval(t *testing.T) {
+	p := New(&Config{
+		StreamName:       "foo",
+		BacklogCount:     4,
+		FlushInterval:    100 * time.Millisecond,
+		MinFlushInterval: 20 * time.Millisecond,
+		Client:           &clientMock{incoming: make(map[int][]string)},
+	})
+	assert(t, p.effectiveFlushInterval() == 100*time.Millisecond, "expect the flush interval with an empty backlog")
+	p.records <- &kinesisRecord{}
+	p.records <- &kinesisRecord{}
+	assert(t, p.effectiveFlushInterval() == 60*time.Millisecond, "expect the flush interval to shrink with the depth of the backlog")
+	assert(t, testutil.ToFloat64(p.metrics.effectiveFlushIntervalMs.WithLabelValues("foo")) == 60, "expect the interval in use to be exposed")
+	p.records <- &kinesisRecord{}
+	p.records <- &kinesisRecord{}
+	assert(t, p.effectiveFlushInterval() == 20*time.Millisecond, "expect the floor with a full backlog")
+	p.SetFlushInterval(10 * time.Millisecond)
+	assert(t, p.effectiveFlushInterval() == 10*time.Millisecond, "expect a flush interval below the floor to be left as is")
+}
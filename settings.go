@@ -0,0 +1,68 @@
+package producer
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// SetBatchSize changes the maximum number of bytes to send with a PutRecords request,
+// like `Config.BatchSize`, while the producer is running. It takes effect on the next
+// record buffered for sending. It must be large enough for a record of the record size
+// limit, 1MiB (1000KiB with Firehose), to fit a request. It fails with `Config.TotalOrder`,
+// which sends a single record per request.
+func (p *Producer) SetBatchSize(n int) error {
+	if p.TotalOrder {
+		return errors.New("kinesis: BatchSize can't be changed with TotalOrder")
+	}
+	if n < p.recordSizeLimit || n > p.requestSizeLimit {
+		return errors.New("kinesis: BatchSize must be between the record and the request size limits")
+	}
+	atomic.StoreInt64(&p.batchSize, int64(n))
+	return nil
+}
+
+// SetBatchCount changes the maximum number of items to pack in batch, like `Config.BatchCount`,
+// while the producer is running. It takes effect on the next record buffered for sending.
+// It fails with `Config.TotalOrder`, whose BatchCount of 1 keeps the retries from reordering
+// the records.
+func (p *Producer) SetBatchCount(n int) error {
+	if p.TotalOrder {
+		return errors.New("kinesis: BatchCount can't be changed with TotalOrder")
+	}
+	if n < 1 || n > maxRecordsPerRequest {
+		return errors.New("kinesis: BatchCount must be between 1 and 500")
+	}
+	if n < p.MinBatchCount {
+		return errors.New("kinesis: MinBatchCount exceeds BatchCount")
+	}
+	atomic.StoreInt64(&p.batchCount, int64(n))
+	return nil
+}
+
+// SetFlushInterval changes the interval for flushing the buffer, like `Config.FlushInterval`,
+// while the producer is running. It takes effect on the next flush interval.
+func (p *Producer) SetFlushInterval(d time.Duration) error {
+	if d <= 0 {
+		return errors.New("kinesis: FlushInterval must be positive")
+	}
+	atomic.StoreInt64(&p.flushInterval, int64(d))
+	return nil
+}
+
+// getFlushInterval returns the current flush interval.
+func (p *Producer) getFlushInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.flushInterval))
+}
+
+// EffectiveConfig returns a copy of the configuration the producer runs with, once the
+// defaults are applied, including the limits changed with the setters above. It is named
+// so as not to clash with the embedded `Config`. The copy is shallow: its slices, maps and
+// functions are shared with the producer, and must not be modified.
+func (p *Producer) EffectiveConfig() Config {
+	c := *p.Config
+	c.BatchSize = int(atomic.LoadInt64(&p.batchSize))
+	c.BatchCount = int(atomic.LoadInt64(&p.batchCount))
+	c.FlushInterval = p.getFlushInterval()
+	return c
+}
@@ -0,0 +1,74 @@
+package producer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestSetters(t *testing.T) {
+	p := New(&Config{
+		StreamName:    "foo",
+		MinBatchCount: 10,
+		Client:        &clientMock{incoming: make(map[int][]string)},
+	})
+	assert(t, p.SetBatchSize(0) != nil && p.SetBatchSize(maxRecordSize-1) != nil && p.SetBatchSize(maxRequestSize+1) != nil,
+		"expect invalid batch sizes to be rejected")
+	assert(t, p.SetBatchSize(1<<20) == nil && p.batchSize == 1<<20, "expect the batch size to be changed")
+	assert(t, p.SetBatchCount(501) != nil && p.SetBatchCount(5) != nil, "expect invalid batch counts to be rejected")
+	assert(t, p.SetBatchCount(100) == nil && p.batchCount == 100, "expect the batch count to be changed")
+	assert(t, p.SetFlushInterval(0) != nil, "expect invalid flush intervals to be rejected")
+	assert(t, p.SetFlushInterval(time.Second) == nil && p.getFlushInterval() == time.Second, "expect the flush interval to be changed")
+}
+
+func TestSettersTotalOrder(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		TotalOrder: true,
+		Client:     &clientMock{incoming: make(map[int][]string)},
+	})
+	assert(t, p.SetBatchCount(500) != nil && p.batchCount == 1, "expect the batch count to be kept with TotalOrder")
+	assert(t, p.SetBatchSize(1<<20) != nil, "expect the batch size to be kept with TotalOrder")
+	assert(t, p.SetFlushInterval(time.Second) == nil, "expect the flush interval to be changed")
+}
+
+func TestSetBatchCount(t *testing.T) {
+	client := &clientMock{
+		incoming: make(map[int][]string),
+		responses: []responseMock{
+			{Response: &k.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}},
+			{Response: &k.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}},
+			{Response: &k.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}},
+		},
+	}
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		AggregateBatchCount: 1,
+		Client:              client,
+	})
+	p.SetBatchCount(1)
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	p.Put([]byte("foo"), "foo")
+	p.Stop()
+	assert(t, client.calls == 3, "expect batches of the changed count")
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+	})
+	c := p.EffectiveConfig()
+	assert(t, c.StreamName == "foo" && c.BatchCount == maxRecordsPerRequest, "expect the defaults to be applied")
+	assert(t, c.FlushInterval == defaultFlushInterval && c.MaxConnections == defaultMaxConnections, "expect the defaults to be applied")
+	p.SetBatchCount(10)
+	c.BatchSize = 1
+	c = p.EffectiveConfig()
+	assert(t, c.BatchCount == 10, "expect the limits changed at runtime")
+	assert(t, c.BatchSize == maxRequestSize, "expect a copy of the configuration")
+}
@@ -0,0 +1,35 @@
+package producer
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// FlushOnSignal stops the producer, flushing its in-flight data, once one of the given
+// signals is received, or SIGINT and SIGTERM if none is given. It returns a function
+// canceling the handler, which is safe to call more than once. While it is installed,
+// the signals don't terminate the process: exiting once the producer is stopped is left
+// to the caller, which may wait for it with `Close`.
+func (p *Producer) FlushOnSignal(sigs ...os.Signal) (cancel func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-c:
+			p.Logger.Info("flushing on signal", LogValue{"signal", sig.String()})
+			p.Stop()
+		case <-done:
+		}
+		signal.Stop(c)
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
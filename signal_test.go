@@ -0,0 +1,68 @@
+//go:build !windows
+// +build !windows
+
+package producer
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestFlushOnSignal(t *testing.T) {
+	client := &clientMock{
+		incoming: make(map[int][]string),
+		responses: []responseMock{
+			{
+				Response: &k.PutRecordsOutput{
+					FailedRecordCount: aws.Int64(0),
+					Records: []*k.PutRecordsResultEntry{
+						{SequenceNumber: aws.String("1"), ShardId: aws.String("1")},
+					},
+				},
+			},
+		},
+	}
+	p := New(&Config{
+		StreamName:     "foo",
+		MaxConnections: 1,
+		Client:         client,
+	})
+	cancel := p.FlushOnSignal(syscall.SIGUSR1)
+	defer cancel()
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	deadline := time.Now().Add(time.Second)
+	for {
+		p.RLock()
+		stopped := p.stopped
+		p.RUnlock()
+		if stopped || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.RLock()
+	assert(t, p.stopped, "expect the producer to be stopped on the signal")
+	p.RUnlock()
+	// waits for the producer to be stopped
+	p.Stop()
+	assert(t, len(client.incoming[0]) == 1, "expect the records to be flushed on the signal")
+}
+
+func TestFlushOnSignalCancel(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+	})
+	cancel := p.FlushOnSignal(syscall.SIGUSR2)
+	cancel()
+	cancel()
+	p.RLock()
+	defer p.RUnlock()
+	assert(t, !p.stopped, "expect the producer not to be stopped once canceled")
+}
@@ -0,0 +1,215 @@
+package producer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrSnapshotted is the error the futures of the records left in a producer are
+// resolved with by `Snapshot`, as the records are snapshotted rather than sent.
+var ErrSnapshotted = errors.New("Record not sent. Producer was snapshotted")
+
+// snapshotMagic starts a snapshot, followed by the version of its format.
+const snapshotMagic = "KPSN\x02"
+
+// snapshotRecords are the user records left in the producer once snapshotted.
+type snapshotRecords struct {
+	sync.Mutex
+	records []*userRecord
+}
+
+// Snapshot stops the producer like `Stop`, but rather than sending the records left in
+// it, it writes them to `w`, with their partition key, deadline, timestamp and the
+// options they were put with, e.g. their route or ordering key, for `Load` to put them
+// into another producer, e.g. the next instance of a service being deployed. The context
+// values of the records are not kept. The futures of the records
+// snapshotted are resolved with ErrSnapshotted. The PutRecords requests in flight are
+// not canceled, and their records are snapshotted if retried. The records handed to
+// a `Dispatcher`, and the ones spilled to the `OverflowStore`, are not snapshotted.
+// It returns ErrStoppedProducer if the producer is already stopped.
+func (p *Producer) Snapshot(w io.Writer) error {
+	p.Lock()
+	if p.stopped || p.snapshot != nil {
+		p.Unlock()
+		return ErrStoppedProducer
+	}
+	s := &snapshotRecords{}
+	p.snapshot = s
+	p.Unlock()
+	p.abort(ErrSnapshotted)
+	p.Stop()
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(snapshotMagic); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, r := range s.records {
+		if err := writeSnapshotRecord(bw, r); err != nil {
+			return err
+		}
+	}
+	p.Logger.Info("snapshotted producer", LogValue{"records", len(s.records)})
+	return bw.Flush()
+}
+
+// Load puts the records written by `Snapshot` into the producer, in order, like `Put`,
+// waiting for room in the backlog, but without encoding or deduplicating them again.
+// Records with a deadline are put as by `PutWithDeadline`, and the records keep the
+// options they were put with.
+// It returns the first error of reading the snapshot or putting its records, leaving
+// the records after it out.
+func (p *Producer) Load(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if string(magic) != snapshotMagic {
+		return errors.New("kinesis: invalid snapshot")
+	}
+	for {
+		s, err := readSnapshotRecord(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.load(s); err != nil {
+			return err
+		}
+	}
+}
+
+// load puts the user record of a snapshot, giving up waiting for the backlog at its
+// deadline, if any.
+func (p *Producer) load(r *userRecord) error {
+	if !r.deadline.IsZero() {
+		ctx, cancel := context.WithDeadline(context.Background(), r.deadline)
+		defer cancel()
+		r.done, r.ctx = ctx.Done(), ctx
+	}
+	if err := p.validate(r); err != nil {
+		return err
+	}
+	if p.spillable(r) {
+		return p.putOrSpill(r)
+	}
+	return p.add(r)
+}
+
+// snapshotted resolves the records aborted by `Snapshot`, and keeps their user records.
+func (p *Producer) snapshotted(records []*kinesisRecord) {
+	var out []*userRecord
+	for _, r := range records {
+		r.resolve("", ErrSnapshotted)
+		if r.tally != nil {
+			r.tally.complete(r, true)
+		}
+		out = append(out, r.userRecords()...)
+	}
+	p.snapshot.Lock()
+	p.snapshot.records = append(p.snapshot.records, out...)
+	p.snapshot.Unlock()
+}
+
+// snapshotHeaderSize is the size of the header of a snapshot record: the sizes of its
+// data, partition key, ordering key, route and content type, its flags, its compression,
+// and its deadline and timestamp.
+const snapshotHeaderSize = 5*4 + 2 + 2*8
+
+// snapshotDebug flags the records put with `PutWithDebug`.
+const snapshotDebug = 1 << 0
+
+// writeSnapshotRecord writes the record as its header, followed by its fields. The
+// compression is 0 if the record has none, or the `Compression` plus 1, and the deadline
+// and timestamp are in nanoseconds since the epoch, or 0 if the record has none.
+func writeSnapshotRecord(w io.Writer, r *userRecord) error {
+	fields := [][]byte{r.data, []byte(r.partitionKey), []byte(r.orderingKey), []byte(r.route), []byte(r.contentType)}
+	buf := make([]byte, snapshotHeaderSize)
+	size := len(buf)
+	for i, f := range fields {
+		binary.BigEndian.PutUint32(buf[i*4:], uint32(len(f)))
+		size += len(f)
+	}
+	if r.debug {
+		buf[20] |= snapshotDebug
+	}
+	if r.compression != nil {
+		buf[21] = byte(*r.compression) + 1
+	}
+	binary.BigEndian.PutUint64(buf[22:], uint64(unixNano(r.deadline)))
+	binary.BigEndian.PutUint64(buf[30:], uint64(unixNano(r.timestamp)))
+	for _, f := range fields {
+		buf = append(buf, f...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readSnapshotRecord reads a record written by writeSnapshotRecord, or returns io.EOF
+// at the end of the snapshot.
+func readSnapshotRecord(r io.Reader) (*userRecord, error) {
+	var header [snapshotHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	var sizes [5]int
+	var size int64
+	for i := range sizes {
+		sizes[i] = int(binary.BigEndian.Uint32(header[i*4:]))
+		size += int64(sizes[i])
+	}
+	if size > 2*maxRecordSize {
+		return nil, errors.New("kinesis: invalid snapshot")
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	var fields [5][]byte
+	for i, n := range sizes {
+		fields[i], buf = buf[:n], buf[n:]
+	}
+	u := &userRecord{
+		data:         fields[0],
+		partitionKey: string(fields[1]),
+		orderingKey:  string(fields[2]),
+		route:        string(fields[3]),
+		contentType:  string(fields[4]),
+		debug:        header[20]&snapshotDebug != 0,
+		deadline:     fromUnixNano(int64(binary.BigEndian.Uint64(header[22:]))),
+		timestamp:    fromUnixNano(int64(binary.BigEndian.Uint64(header[30:]))),
+	}
+	if c := header[21]; c != 0 {
+		compression := Compression(c - 1)
+		u.compression = &compression
+	}
+	return u, nil
+}
+
+// unixNano returns the nanoseconds of `t` since the epoch, or 0 for the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano returns the time of the nanoseconds since the epoch, or the zero time for 0.
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
@@ -0,0 +1,78 @@
+package producer
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	client := &failingClient{code: "ProvisionedThroughputExceededException"}
+	p := New(&Config{StreamName: "foo", FlushInterval: 10 * time.Millisecond, RecordTimestamps: true, Client: client})
+	p.Start()
+	future := p.PutAsync([]byte("retried"), "a")
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(5 * time.Millisecond) {
+		client.Lock()
+		requests := client.requests
+		client.Unlock()
+		if requests > 0 {
+			break
+		}
+	}
+	deadline := time.Now().Add(time.Hour).Round(0)
+	p.PutWithOrdering([]byte("ordered"), "b", "entity")
+	p.PutWithDeadline([]byte("deadline"), "c", deadline)
+	p.PutWithRoute([]byte("routed"), "d", "orders")
+	p.PutWithContentType([]byte("{}"), "e", "application/json")
+	p.PutWithCodec([]byte("compressed"), "f", CompressionGzip)
+	p.PutWithDebug([]byte("debug"), "g")
+	var buf bytes.Buffer
+	assert(t, p.Snapshot(&buf) == nil, "should snapshot the producer")
+	_, err := future.Wait(context.Background())
+	assert(t, err == ErrSnapshotted, "expect the future to be resolved with ErrSnapshotted")
+	assert(t, p.Snapshot(&bytes.Buffer{}) == ErrStoppedProducer, "expect a stopped producer not to be snapshotted again")
+
+	var records []*userRecord
+	r := bytes.NewReader(buf.Bytes()[len(snapshotMagic):])
+	for {
+		s, err := readSnapshotRecord(r)
+		if err != nil {
+			break
+		}
+		records = append(records, s)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].partitionKey < records[j].partitionKey })
+	assert(t, len(records) == 7, "expect the records left to be snapshotted")
+	assert(t, string(records[0].data) == "retried", "expect the retried record to be snapshotted")
+	assert(t, !records[0].timestamp.IsZero(), "expect the timestamp to be snapshotted")
+	assert(t, records[1].orderingKey == "entity", "expect the ordering key to be snapshotted")
+	assert(t, records[2].deadline.Equal(deadline), "expect the deadline to be snapshotted")
+	assert(t, records[3].route == "orders", "expect the route to be snapshotted")
+	assert(t, records[4].contentType == "application/json", "expect the content type to be snapshotted")
+	assert(t, string(records[5].data) == "compressed" && records[5].compression != nil &&
+		*records[5].compression == CompressionGzip, "expect the compression to be snapshotted")
+	assert(t, records[6].debug, "expect the debug flag to be snapshotted")
+
+	sent := &dataClient{}
+	p = New(&Config{StreamName: "foo", AggregateBatchCount: 1, Client: sent})
+	p.Start()
+	assert(t, p.Load(bytes.NewReader(buf.Bytes())) == nil, "should load the snapshot")
+	p.Stop()
+	var data []string
+	for _, e := range sent.records {
+		for _, u := range extractRecords(e) {
+			data = append(data, string(u.Data))
+		}
+		if !isAggregated(e) {
+			data = append(data, string(e.Data))
+		}
+	}
+	sort.Strings(data)
+	assert(t, len(data) == 7 && data[1] == "deadline" && data[4] == "retried", "expect the snapshotted records to be sent")
+
+	buf.Truncate(buf.Len() - 1)
+	p = New(&Config{StreamName: "foo", Client: &dataClient{}})
+	assert(t, p.Load(bytes.NewReader(buf.Bytes())) != nil, "expect a truncated snapshot to fail")
+}
@@ -0,0 +1,99 @@
+package producer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// StreamManager is the interface that wraps the KinesisAPI methods used for
+// managing the stream itself, rather than putting records into it.
+type StreamManager interface {
+	DescribeStreamSummary(*k.DescribeStreamSummaryInput) (*k.DescribeStreamSummaryOutput, error)
+	CreateStream(*k.CreateStreamInput) (*k.CreateStreamOutput, error)
+	WaitUntilStreamExists(*k.DescribeStreamInput) error
+}
+
+// createStreamIfNotExists creates the stream if it does not exist yet,
+// and then block until the stream is ACTIVE.
+func (p *Producer) createStreamIfNotExists() error {
+	client := p.client().(StreamManager)
+	out, err := client.DescribeStreamSummary(&k.DescribeStreamSummaryInput{
+		StreamName: &p.StreamName,
+	})
+	switch {
+	case err == nil:
+		if aws.StringValue(out.StreamDescriptionSummary.StreamStatus) == k.StreamStatusActive {
+			return nil
+		}
+	case errorCode(err) == k.ErrCodeResourceNotFoundException:
+		p.Logger.Info("creating stream", LogValue{"stream", p.StreamName}, LogValue{"shards", p.ShardCount})
+		_, err = client.CreateStream(&k.CreateStreamInput{
+			StreamName: &p.StreamName,
+			ShardCount: aws.Int64(int64(p.ShardCount)),
+		})
+		// someone else may have created it in the meantime
+		if err != nil && errorCode(err) != k.ErrCodeResourceInUseException {
+			return err
+		}
+	default:
+		return err
+	}
+	return client.WaitUntilStreamExists(&k.DescribeStreamInput{
+		StreamName: &p.StreamName,
+	})
+}
+
+// ErrStreamNotActive is logged on `Start` when `Config.VerifyStreamOnStart` is set, and
+// the stream is not ACTIVE.
+var ErrStreamNotActive = errors.New("Stream is not ACTIVE")
+
+// verifyStream checks that the stream exists and is ACTIVE.
+func (p *Producer) verifyStream() error {
+	out, err := p.client().(streamDescriber).DescribeStreamSummary(&k.DescribeStreamSummaryInput{
+		StreamName: &p.StreamName,
+	})
+	if err != nil {
+		return err
+	}
+	if aws.StringValue(out.StreamDescriptionSummary.StreamStatus) != k.StreamStatusActive {
+		return ErrStreamNotActive
+	}
+	return nil
+}
+
+// streamDescriber is the part of the `StreamManager` used for warming up the client.
+type streamDescriber interface {
+	DescribeStreamSummary(*k.DescribeStreamSummaryInput) (*k.DescribeStreamSummaryOutput, error)
+}
+
+// warmUp issues a DescribeStreamSummary request to set up the connections of the
+// client before the first PutRecords request, and logs how long it took.
+func (p *Producer) warmUp() {
+	client, ok := p.client().(streamDescriber)
+	if !ok {
+		p.Logger.Info("skipping warm up, client does not describe streams", LogValue{"stream", p.StreamName})
+		return
+	}
+	start := time.Now()
+	_, err := client.DescribeStreamSummary(&k.DescribeStreamSummaryInput{
+		StreamName: &p.StreamName,
+	})
+	if err != nil {
+		p.Logger.Error("warm up", err, LogValue{"stream", p.StreamName})
+		return
+	}
+	p.Logger.Info("warmed up", LogValue{"stream", p.StreamName}, LogValue{"duration", time.Since(start)})
+}
+
+// errorCode returns the AWS error code of `err`, or an empty string
+// if it is not an AWS error.
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package producer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+type streamClientMock struct {
+	clientMock
+	status  string
+	created *k.CreateStreamInput
+	waited  bool
+}
+
+func (c *streamClientMock) DescribeStreamSummary(*k.DescribeStreamSummaryInput) (*k.DescribeStreamSummaryOutput, error) {
+	if c.status == "" {
+		return nil, awserr.New(k.ErrCodeResourceNotFoundException, "stream not found", nil)
+	}
+	return &k.DescribeStreamSummaryOutput{
+		StreamDescriptionSummary: &k.StreamDescriptionSummary{StreamStatus: aws.String(c.status)},
+	}, nil
+}
+
+func (c *streamClientMock) CreateStream(input *k.CreateStreamInput) (*k.CreateStreamOutput, error) {
+	c.created = input
+	return &k.CreateStreamOutput{}, nil
+}
+
+func (c *streamClientMock) WaitUntilStreamExists(*k.DescribeStreamInput) error {
+	c.waited = true
+	return nil
+}
+
+func TestCreateStreamIfNotExists(t *testing.T) {
+	client := &streamClientMock{}
+	p := New(&Config{
+		StreamName:              "foo",
+		CreateStreamIfNotExists: true,
+		ShardCount:              2,
+		Client:                  client,
+	})
+	p.Start()
+	p.Stop()
+	assert(t, client.created != nil, "should create the missing stream")
+	assert(t, aws.Int64Value(client.created.ShardCount) == 2, "should create the stream with the configured shard count")
+	assert(t, client.waited, "should wait for the stream to become active")
+
+	client = &streamClientMock{status: k.StreamStatusActive}
+	p = New(&Config{
+		StreamName:              "foo",
+		CreateStreamIfNotExists: true,
+		Client:                  client,
+	})
+	p.Start()
+	p.Stop()
+	assert(t, client.created == nil && !client.waited, "should leave an active stream as is")
+}
+
+type describeClientMock struct {
+	clientMock
+	described int
+}
+
+func (c *describeClientMock) DescribeStreamSummary(*k.DescribeStreamSummaryInput) (*k.DescribeStreamSummaryOutput, error) {
+	c.described++
+	return &k.DescribeStreamSummaryOutput{}, nil
+}
+
+func TestWarmUp(t *testing.T) {
+	client := &describeClientMock{}
+	p := New(&Config{
+		StreamName: "foo",
+		WarmUp:     true,
+		Client:     client,
+	})
+	p.Start()
+	p.Stop()
+	assert(t, client.described == 1, "should describe the stream on start")
+}
+
+func TestStartAndWaitWarmUp(t *testing.T) {
+	p := New(&Config{
+		StreamName: "foo",
+		WarmUp:     true,
+		Client:     &describeClientMock{},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert(t, p.StartAndWait(ctx) == context.DeadlineExceeded, "expect the read-only warm up not to prove the producer can write")
+	p.Stop()
+}
+
+func TestVerifyStreamOnStart(t *testing.T) {
+	for _, test := range []struct {
+		status string
+		err    error
+	}{
+		{k.StreamStatusActive, nil},
+		{k.StreamStatusCreating, ErrStreamNotActive},
+	} {
+		p := New(&Config{
+			StreamName:          "foo",
+			VerifyStreamOnStart: true,
+			Client:              &streamClientMock{status: test.status},
+		})
+		assert(t, p.verifyStream() == test.err, "expect the stream to be verified: "+test.status)
+	}
+	p := New(&Config{StreamName: "foo", Client: &streamClientMock{}})
+	err := p.verifyStream()
+	assert(t, errorCode(err) == k.ErrCodeResourceNotFoundException, "expect a missing stream to be reported")
+}
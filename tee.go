@@ -0,0 +1,85 @@
+package producer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// teeRequest is a copy of a PutRecords request mirrored to the tee, of `size` bytes.
+type teeRequest struct {
+	input *kinesis.PutRecordsInput
+	size  int64
+}
+
+// startTee starts mirroring the PutRecords requests to `Config.Tee`.
+func (p *Producer) startTee() {
+	p.teed = make(chan *teeRequest, p.BacklogCount)
+	p.teeDone = make(chan struct{})
+	p.teeStop = make(chan struct{})
+	go p.teeLoop()
+}
+
+// tee hands a copy of the records over to the tee, dropping it if its queue is full,
+// so that a tee lagging behind doesn't stall the producer.
+func (p *Producer) tee(records []*kinesisRecord) {
+	r := &teeRequest{input: &kinesis.PutRecordsInput{
+		StreamName: &p.TeeStreamName,
+		Records:    make([]*kinesis.PutRecordsRequestEntry, len(records)),
+	}}
+	for i, record := range records {
+		entry := *record.PutRecordsRequestEntry
+		r.input.Records[i] = &entry
+		r.size += int64(len(entry.Data) + len(*entry.PartitionKey))
+	}
+	if atomic.AddInt64(&p.teeBytes, r.size) > int64(p.TeeMaxBufferedBytes) {
+		atomic.AddInt64(&p.teeBytes, -r.size)
+		p.metrics.teeDroppedCnt.WithLabelValues(p.MetricStreamLabel).Inc()
+		return
+	}
+	select {
+	case p.teed <- r:
+	default:
+		atomic.AddInt64(&p.teeBytes, -r.size)
+		p.metrics.teeDroppedCnt.WithLabelValues(p.MetricStreamLabel).Inc()
+	}
+}
+
+// teeLoop sends the requests mirrored to the tee, one at a time, until stopped, and
+// drops them once stopping timed out. Its failures are logged only.
+func (p *Producer) teeLoop() {
+	defer close(p.teeDone)
+	for r := range p.teed {
+		atomic.AddInt64(&p.teeBytes, -r.size)
+		select {
+		case <-p.teeStop:
+			p.metrics.teeDroppedCnt.WithLabelValues(p.MetricStreamLabel).Inc()
+			continue
+		default:
+		}
+		out, err := p.Tee.PutRecords(r.input)
+		if err != nil {
+			p.Logger.Error("tee", err, LogValue{"records", len(r.input.Records)})
+			continue
+		}
+		if failed := aws.Int64Value(out.FailedRecordCount); failed > 0 {
+			p.Logger.Info("tee failures", LogValue{"failures", failed})
+		}
+	}
+}
+
+// stopTee waits up to the tee stop timeout for the requests mirrored to the tee to be
+// sent, and then drops the ones left, leaving the one being sent in the background.
+func (p *Producer) stopTee() {
+	close(p.teed)
+	timer := time.NewTimer(p.TeeStopTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.teeDone:
+	case <-timer.C:
+		close(p.teeStop)
+		p.Logger.Info("tee stop timed out", LogValue{"timeout", p.TeeStopTimeout.String()})
+	}
+}
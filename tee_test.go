@@ -0,0 +1,121 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// erroringClient fails every request with its error.
+type erroringClient struct {
+	err error
+}
+
+func (c *erroringClient) PutRecords(input *k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	return nil, c.err
+}
+
+func TestTee(t *testing.T) {
+	client, tee := &orderClient{}, &dataClient{}
+	p := New(&Config{
+		StreamName:          "foo",
+		TeeStreamName:       "bar",
+		AggregateBatchCount: 1,
+		BatchCount:          1,
+		MaxConnections:      1,
+		Client:              client,
+		Tee:                 tee,
+	})
+	p.Start()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		p.Put([]byte("data-"+key), key)
+	}
+	p.Stop()
+	assert(t, client.requests == 5, "expect the throttled request to be retried")
+	assert(t, len(tee.records) == 4, "expect each request to be mirrored once, without its retries")
+	for _, r := range tee.records {
+		out, err := Deaggregate(r.Data, *r.PartitionKey)
+		assert(t, err == nil && string(out[0].Data) == "data-"+*r.PartitionKey, "expect a copy of the records")
+	}
+
+	// the failures of the tee are not failures of the records
+	var failures []*FailureRecord
+	p = New(&Config{
+		StreamName:  "foo",
+		Client:      &successClient{},
+		Tee:         &erroringClient{errors.New("tee unavailable")},
+		FailureSink: func(f []*FailureRecord) { failures = append(failures, f...) },
+	})
+	assert(t, p.TeeStreamName == "foo", "expect the tee to default to the stream")
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Stop()
+	assert(t, len(failures) == 0 && p.Stats().Produced == 1, "expect the records to be produced")
+}
+
+func TestTeeBackpressure(t *testing.T) {
+	tee := &hangingClient{release: make(chan struct{})}
+	p := New(&Config{
+		StreamName:          "foo",
+		BacklogCount:        1,
+		AggregateBatchCount: 1,
+		BatchCount:          1,
+		Client:              &successClient{},
+		Tee:                 tee,
+	})
+	p.Start()
+	for i := 0; i < 10; i++ {
+		p.Put([]byte("hello"), "hello")
+	}
+	_, err := p.Flush(context.Background())
+	assert(t, err == nil, "should not return an error")
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().Produced < 10 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert(t, p.Stats().Produced == 10, "expect a hanging tee not to stall the producer")
+	assert(t, testutil.ToFloat64(p.metrics.teeDroppedCnt.WithLabelValues("foo")) > 0, "expect the copies to be dropped")
+	close(tee.release)
+	p.Stop()
+}
+
+func TestTeeLimits(t *testing.T) {
+	config := func(tee Putter) *Config {
+		return &Config{
+			StreamName:          "foo",
+			AggregateBatchCount: 1,
+			BatchCount:          1,
+			MaxConnections:      1,
+			Client:              &successClient{},
+			Tee:                 tee,
+			TeeStopTimeout:      10 * time.Millisecond,
+		}
+	}
+	tee := &dataClient{}
+	c := config(tee)
+	c.TeeMaxBufferedBytes = 1
+	p := New(c)
+	p.Start()
+	p.Put([]byte("hello"), "hello")
+	p.Stop()
+	assert(t, len(tee.records) == 0, "expect the copies beyond the buffered bytes to be dropped")
+
+	hanging := &hangingClient{release: make(chan struct{})}
+	p = New(config(hanging))
+	assert(t, p.teed == nil, "expect the tee to start with the producer")
+	p.Start()
+	for i := 0; i < 5; i++ {
+		p.Put([]byte("hello"), "hello-"+strconv.Itoa(i))
+	}
+	start := time.Now()
+	p.Stop()
+	assert(t, time.Since(start) < time.Second, "expect Stop not to wait for a hanging tee")
+	close(hanging.release)
+	<-p.teeDone
+	assert(t, testutil.ToFloat64(p.metrics.teeDroppedCnt.WithLabelValues("foo")) > 0, "expect the copies left once stopped to be dropped")
+}
@@ -0,0 +1,60 @@
+package producer
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// errCodeTimeout is the error code of the PutRecords requests timed out by
+// `Config.RequestTimeout`.
+const errCodeTimeout = "Timeout"
+
+// contextPutter is the part of the KinesisAPI that sends a PutRecords request
+// with a context, implemented by the SDK clients.
+type contextPutter interface {
+	PutRecordsWithContext(aws.Context, *k.PutRecordsInput, ...request.Option) (*k.PutRecordsOutput, error)
+}
+
+// putRecords sends the PutRecords request, with the `Config.RequestOptions`, and given up
+// after `Config.RequestTimeout` if set. The request of a client that does not take a context
+// is left running in the background.
+func (p *Producer) putRecords(input *k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	if p.RequestTimeout <= 0 {
+		if len(p.RequestOptions) > 0 {
+			return p.client().(contextPutter).PutRecordsWithContext(context.Background(), input, p.RequestOptions...)
+		}
+		return p.client().PutRecords(input)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.RequestTimeout)
+	defer cancel()
+	var out *k.PutRecordsOutput
+	var err error
+	if client, ok := p.client().(contextPutter); ok {
+		out, err = client.PutRecordsWithContext(ctx, input, p.RequestOptions...)
+	} else {
+		type result struct {
+			out *k.PutRecordsOutput
+			err error
+		}
+		c := make(chan result, 1)
+		go func() {
+			out, err := p.client().PutRecords(input)
+			c <- result{out, err}
+		}()
+		select {
+		case r := <-c:
+			out, err = r.out, r.err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		p.metrics.errorsByCodeCnt.WithLabelValues(p.MetricStreamLabel, errCodeTimeout).Inc()
+		return nil, awserr.New(errCodeTimeout, "PutRecords timed out after "+p.RequestTimeout.String(), err)
+	}
+	return out, err
+}
@@ -0,0 +1,107 @@
+package producer
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// hangingClient hangs on its first PutRecords request, until released,
+// and succeeds on the next ones.
+type hangingClient struct {
+	successClient
+	once    sync.Once
+	release chan struct{}
+}
+
+func (c *hangingClient) PutRecords(input *k.PutRecordsInput) (*k.PutRecordsOutput, error) {
+	hang := false
+	c.once.Do(func() { hang = true })
+	if hang {
+		<-c.release
+	}
+	return c.successClient.PutRecords(input)
+}
+
+// hangingContextClient hangs on its first PutRecords request, until canceled.
+type hangingContextClient struct {
+	hangingClient
+}
+
+func (c *hangingContextClient) PutRecordsWithContext(ctx aws.Context, input *k.PutRecordsInput, _ ...request.Option) (*k.PutRecordsOutput, error) {
+	hang := false
+	c.once.Do(func() { hang = true })
+	if hang {
+		<-ctx.Done()
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+	}
+	return c.successClient.PutRecords(input)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	for _, client := range []Putter{
+		&hangingClient{release: release},
+		&hangingContextClient{},
+	} {
+		p := New(&Config{
+			StreamName:     "timeout",
+			FlushInterval:  10 * time.Millisecond,
+			RequestTimeout: 20 * time.Millisecond,
+			Client:         client,
+		})
+		timeouts := testutil.ToFloat64(p.metrics.errorsByCodeCnt.WithLabelValues("timeout", errCodeTimeout))
+		p.Start()
+		p.Put([]byte("hello"), "hello")
+		p.Stop()
+		assert(t, p.Stats().Produced == 1, "expect the timed out request to be retried")
+		assert(t, testutil.ToFloat64(p.metrics.errorsByCodeCnt.WithLabelValues("timeout", errCodeTimeout)) == timeouts+1, "expect the timeout to be counted")
+	}
+}
+
+// headersClient applies the request options to a request, keeping its headers.
+type headersClient struct {
+	successClient
+	headers []http.Header
+}
+
+func (c *headersClient) PutRecordsWithContext(ctx aws.Context, input *k.PutRecordsInput, opts ...request.Option) (*k.PutRecordsOutput, error) {
+	r := &request.Request{HTTPRequest: &http.Request{Header: make(http.Header)}}
+	r.ApplyOptions(opts...)
+	r.Handlers.Build.Run(r)
+	c.Lock()
+	c.headers = append(c.headers, r.HTTPRequest.Header)
+	c.Unlock()
+	return c.successClient.PutRecords(input)
+}
+
+func TestRequestOptions(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Second} {
+		client := &headersClient{}
+		p := New(&Config{
+			StreamName:     "foo",
+			Client:         client,
+			RequestTimeout: timeout,
+			RequestOptions: []request.Option{request.WithSetRequestHeaders(map[string]string{"X-Team": "ingest"})},
+		})
+		p.Start()
+		p.Put([]byte("hello"), "hello")
+		p.Stop()
+		assert(t, len(client.headers) == 1 && client.headers[0].Get("X-Team") == "ingest", "expect the request options to be applied")
+	}
+	assert(t, panicOf(func() {
+		New(&Config{
+			StreamName:     "foo",
+			Client:         &successClient{},
+			RequestOptions: []request.Option{request.WithAppendUserAgent("ingest")},
+		})
+	}) != nil, "expect a client without context to be rejected")
+}
@@ -0,0 +1,138 @@
+package producer
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// keySketchSize is the number of partition keys counted by `Config.TrackKeyDistribution`,
+// over keySketchShards shards, so that concurrent puts seldom contend on the same lock.
+const (
+	keySketchSize   = 1024
+	keySketchShards = 16
+)
+
+// KeyCount is the approximate number of user records put with a partition key.
+type KeyCount struct {
+	Key string
+	// Count may overestimate the records of the key by up to Error, the count of
+	// the key it took the place of in the sketch.
+	Count int64
+	Error int64
+}
+
+// keySketch counts the most frequent partition keys, with the Space-Saving algorithm run
+// on each of its shards, picked by the hash of the key: once a shard is full, a new key
+// takes the place of its least counted one, and its count.
+type keySketch [keySketchShards]*keyShard
+
+// keyShard is a shard of the key sketch, whose counters are kept in a min-heap, indexed
+// by key.
+type keyShard struct {
+	mu     sync.Mutex
+	counts keyHeap
+	byKey  map[string]*keyCounter
+}
+
+type keyCounter struct {
+	KeyCount
+	index int
+}
+
+// keyHeap implements heap.Interface, with the least counted key first.
+type keyHeap []*keyCounter
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h keyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *keyHeap) Push(x interface{}) {
+	c := x.(*keyCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+func newKeySketch() *keySketch {
+	s := new(keySketch)
+	for i := range s {
+		s[i] = &keyShard{byKey: make(map[string]*keyCounter, keySketchSize/keySketchShards)}
+	}
+	return s
+}
+
+// add a user record of the partition key to its shard, picked by the FNV-1a hash of the key.
+func (s *keySketch) add(key string) {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h = (h ^ uint32(key[i])) * 16777619
+	}
+	s[h%keySketchShards].add(key)
+}
+
+// add a user record of the partition key.
+func (s *keyShard) add(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.byKey[key]; ok {
+		c.Count++
+		heap.Fix(&s.counts, c.index)
+		return
+	}
+	if len(s.counts) < keySketchSize/keySketchShards {
+		c := &keyCounter{KeyCount: KeyCount{Key: key, Count: 1}}
+		heap.Push(&s.counts, c)
+		s.byKey[key] = c
+		return
+	}
+	min := s.counts[0]
+	delete(s.byKey, min.Key)
+	min.Key, min.Error = key, min.Count
+	min.Count++
+	heap.Fix(&s.counts, 0)
+	s.byKey[key] = min
+}
+
+// top returns the `n` most counted keys, most counted first, or nil if `n` is not positive.
+func (s *keySketch) top(n int) []KeyCount {
+	if n <= 0 {
+		return nil
+	}
+	var out []KeyCount
+	for _, shard := range s {
+		shard.mu.Lock()
+		for _, c := range shard.counts {
+			out = append(out, c.KeyCount)
+		}
+		shard.mu.Unlock()
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if n < len(out) {
+		out = out[:n]
+	}
+	return out
+}
+
+// TopKeys returns the `n` partition keys the most user records were put with, most first,
+// to diagnose hot shards, when `Config.TrackKeyDistribution` is set, or nil otherwise, or
+// if `n` is not positive. The counts are approximate, as only the 1024 most frequent keys
+// are counted.
+func (p *Producer) TopKeys(n int) []KeyCount {
+	if p.keys == nil {
+		return nil
+	}
+	return p.keys.top(n)
+}
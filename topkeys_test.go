@@ -0,0 +1,50 @@
+package producer
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTopKeys(t *testing.T) {
+	p := New(&Config{
+		StreamName:           "foo",
+		TrackKeyDistribution: true,
+		Client:               &clientMock{incoming: make(map[int][]string)},
+	})
+	// a few hot keys among many more cold keys than the sketch counts
+	for i := 0; i < 10*keySketchSize; i++ {
+		p.Put([]byte("hello"), "cold-"+strconv.Itoa(i))
+		if i%4 == 0 {
+			p.Put([]byte("hello"), "hot")
+		}
+		if i%8 == 0 {
+			p.Put([]byte("hello"), "warm")
+		}
+		p.drainIfNeed("explicit")
+	}
+	top := p.TopKeys(2)
+	assert(t, len(top) == 2, "expect the requested number of keys")
+	assert(t, top[0].Key == "hot" && top[1].Key == "warm", "expect the most frequent keys first")
+	assert(t, top[0].Count >= 10*keySketchSize/4, "expect the count not to underestimate")
+	counted := 0
+	for _, shard := range p.keys {
+		counted += len(shard.byKey)
+	}
+	assert(t, counted == keySketchSize, "expect the sketch to be bounded")
+	assert(t, p.TopKeys(0) == nil && p.TopKeys(-1) == nil, "expect no keys for a non-positive count")
+
+	p = New(&Config{StreamName: "foo", Client: &clientMock{incoming: make(map[int][]string)}})
+	assert(t, p.TopKeys(10) == nil, "expect no keys when not tracked")
+}
+
+func BenchmarkKeySketch(b *testing.B) {
+	s := newKeySketch()
+	keys := make([]string, 4*keySketchSize)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.add(keys[i%len(keys)])
+	}
+}
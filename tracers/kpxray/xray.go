@@ -0,0 +1,61 @@
+// Package kpxray traces the PutRecords requests of kinesis-producer with AWS X-Ray
+// subsegments, without depending on the X-Ray SDK. Wire it to the SDK with:
+//
+//	producer.Config{
+//		Tracer: &kpxray.Tracer{
+//			Context: func() context.Context { return ctx },
+//			BeginSubsegment: func(ctx context.Context, name string) kpxray.Segment {
+//				if _, seg := xray.BeginSubsegment(ctx, name); seg != nil {
+//					return seg
+//				}
+//				return nil
+//			},
+//		},
+//	}
+package kpxray
+
+import (
+	"context"
+
+	producer "github.com/ouzi-dev/kinesis-producer"
+)
+
+// Segment is the part of an X-Ray segment used by the tracer, implemented by `*xray.Segment`.
+type Segment interface {
+	AddMetadata(key string, value interface{}) error
+	Close(err error)
+}
+
+// Tracer implements producer.Tracer, creating a subsegment around each PutRecords request.
+type Tracer struct {
+	// Context returns the context holding the X-Ray segment the subsegments are created
+	// in. Default to the background context.
+	Context func() context.Context
+	// BeginSubsegment creates a subsegment named `name` in the segment of `ctx`, e.g.
+	// with `xray.BeginSubsegment`. It returns nil if there is no segment in `ctx`, and
+	// the request is then not traced. Default to none, not tracing the requests.
+	BeginSubsegment func(ctx context.Context, name string) Segment
+}
+
+// StartPutRecords begins the subsegment of a PutRecords request, recording the stream and
+// the number of records, and returns the function closing it with the request error.
+func (t *Tracer) StartPutRecords(info producer.BatchInfo) func(failed int, err error) {
+	if t.BeginSubsegment == nil {
+		return func(int, error) {}
+	}
+	ctx := context.Background()
+	if t.Context != nil {
+		ctx = t.Context()
+	}
+	seg := t.BeginSubsegment(ctx, "Kinesis.PutRecords")
+	if seg == nil {
+		return func(int, error) {}
+	}
+	seg.AddMetadata("stream", info.StreamName)
+	seg.AddMetadata("records", info.Records)
+	seg.AddMetadata("user_records", info.UserRecords)
+	return func(failed int, err error) {
+		seg.AddMetadata("failed_records", failed)
+		seg.Close(err)
+	}
+}
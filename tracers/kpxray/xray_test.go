@@ -0,0 +1,68 @@
+package kpxray
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	producer "github.com/ouzi-dev/kinesis-producer"
+)
+
+type fakeSegment struct {
+	name     string
+	metadata map[string]interface{}
+	closed   bool
+	err      error
+}
+
+func (s *fakeSegment) AddMetadata(key string, value interface{}) error {
+	s.metadata[key] = value
+	return nil
+}
+
+func (s *fakeSegment) Close(err error) {
+	s.closed = true
+	s.err = err
+}
+
+type ctxKey struct{}
+
+func TestTracer(t *testing.T) {
+	var seg *fakeSegment
+	tracer := &Tracer{
+		Context: func() context.Context { return context.WithValue(context.Background(), ctxKey{}, "parent") },
+		BeginSubsegment: func(ctx context.Context, name string) Segment {
+			if ctx.Value(ctxKey{}) != "parent" {
+				t.Error("expect the subsegment to begin in the context of the tracer")
+			}
+			seg = &fakeSegment{name: name, metadata: make(map[string]interface{})}
+			return seg
+		},
+	}
+	done := tracer.StartPutRecords(producer.BatchInfo{StreamName: "foo", Records: 2, UserRecords: 5})
+	if seg == nil || seg.name != "Kinesis.PutRecords" {
+		t.Fatal("expect a subsegment to begin for the request")
+	}
+	if seg.metadata["stream"] != "foo" || seg.metadata["records"] != 2 || seg.metadata["user_records"] != 5 {
+		t.Errorf("expect the batch to be recorded, got %v", seg.metadata)
+	}
+	if seg.closed {
+		t.Error("expect the subsegment to stay open until the request completes")
+	}
+	err := errors.New("throttled")
+	done(1, err)
+	if !seg.closed || seg.err != err || seg.metadata["failed_records"] != 1 {
+		t.Error("expect the subsegment to be closed with the request error and failures")
+	}
+}
+
+func TestTracerUntraced(t *testing.T) {
+	tracers := []*Tracer{
+		{},
+		{BeginSubsegment: func(context.Context, string) Segment { return nil }},
+	}
+	for _, tracer := range tracers {
+		done := tracer.StartPutRecords(producer.BatchInfo{StreamName: "foo"})
+		done(0, nil)
+	}
+}
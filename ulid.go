@@ -0,0 +1,65 @@
+package producer
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// crockford is the Crockford's Base32 alphabet ULIDs are encoded with.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULIDFunc returns a generator of monotonic ULIDs, the default `Config.AggregateIDFunc`:
+// 48 bits of milliseconds, followed by 80 random bits, incremented rather than drawn again
+// within the same millisecond, so that the IDs of a producer sort in the order generated.
+// See: https://github.com/ulid/spec
+func newULIDFunc() func() string {
+	var (
+		mu      sync.Mutex
+		last    uint64
+		entropy [10]byte
+	)
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+		if ms <= last {
+			// keep the IDs monotonic within the millisecond, and if the clock goes back
+			ms = last
+			for i := len(entropy) - 1; i >= 0; i-- {
+				entropy[i]++
+				if entropy[i] != 0 {
+					break
+				}
+			}
+		} else {
+			last = ms
+			rand.Read(entropy[:])
+		}
+		var id [16]byte
+		for i := 0; i < 6; i++ {
+			id[i] = byte(ms >> uint(40-8*i))
+		}
+		copy(id[6:], entropy[:])
+		return encodeULID(id)
+	}
+}
+
+// encodeULID encodes the 128 bits of the ULID into 26 characters, 5 bits each,
+// the first one holding the 3 most significant bits.
+func encodeULID(id [16]byte) string {
+	var out [26]byte
+	var acc uint
+	bits := uint(2) // 130 bits are encoded, the 2 highest being 0
+	j := 0
+	for _, b := range id {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[j] = crockford[(acc>>bits)&0x1f]
+			j++
+		}
+	}
+	return string(out[:])
+}
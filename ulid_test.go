@@ -0,0 +1,79 @@
+package producer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestULID(t *testing.T) {
+	assert(t, encodeULID([16]byte{}) == "00000000000000000000000000", "expect the zero ULID")
+	var max [16]byte
+	for i := range max {
+		max[i] = 0xff
+	}
+	assert(t, encodeULID(max) == "7ZZZZZZZZZZZZZZZZZZZZZZZZZ", "expect the maximum ULID")
+
+	next := newULIDFunc()
+	start := time.Now()
+	prev := next()
+	for i := 0; i < 1000; i++ {
+		id := next()
+		assert(t, len(id) == 26, "expect 26 characters")
+		assert(t, id > prev, "expect the IDs to be monotonic: "+prev+" "+id)
+		prev = id
+	}
+	end := time.Now()
+	// the first 10 characters encode the milliseconds
+	var ms int64
+	for _, c := range prev[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	assert(t, ms >= start.UnixNano()/int64(time.Millisecond) && ms <= end.UnixNano()/int64(time.Millisecond), "expect the IDs to start with the time")
+}
+
+func TestAggregateID(t *testing.T) {
+	ids := []string{"first", "second", "third"}
+	p := New(&Config{
+		StreamName: "foo",
+		Client:     &clientMock{incoming: make(map[int][]string)},
+		AggregateIDFunc: func() string {
+			id := ids[0]
+			ids = ids[1:]
+			return id
+		},
+	})
+	p.Put([]byte("hello"), "hello")
+	p.Put([]byte("world"), "world")
+	records := p.drainIfNeed("explicit")
+	assert(t, len(records) == 1 && records[0].aggregateID == "first", "expect the aggregated record to carry its ID")
+	out, err := Deaggregate(records[0].Data, *records[0].PartitionKey)
+	assert(t, err == nil, "should not return an error")
+	assert(t, len(out) == 2 && out[0].AggregateID == "first" && out[1].AggregateID == "first", "expect the user records to carry the ID")
+
+	p.Put([]byte("foo"), "foo")
+	records = p.drainIfNeed("explicit")
+	assert(t, records[0].aggregateID == "second", "expect a new ID per aggregated record")
+
+	// the ID stays with the aggregated record when its first record is sent unaggregated
+	p = New(&Config{
+		StreamName:             "foo",
+		AggregateMinKeyRecords: 2,
+		Client:                 &clientMock{incoming: make(map[int][]string)},
+		AggregateIDFunc:        func() string { return "kept" },
+	})
+	p.Put(bytes.Repeat([]byte("a"), 1000), "lonely")
+	p.Put([]byte("hello"), "shared")
+	p.Put([]byte("world"), "shared")
+	records = p.drainIfNeed("explicit")
+	for _, r := range records {
+		out, err := Deaggregate(r.Data, *r.PartitionKey)
+		assert(t, err == nil, "should not return an error")
+		if r.aggregated {
+			assert(t, len(out) == 2 && out[0].AggregateID == "kept" && r.aggregateID == "kept", "expect the aggregated record to keep its ID")
+		} else {
+			assert(t, out[0].AggregateID == "", "expect the unaggregated record to carry no ID")
+		}
+	}
+}
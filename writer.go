@@ -0,0 +1,25 @@
+package producer
+
+import "io"
+
+// Writer returns an `io.Writer` that puts each written buffer as a single
+// record, using the given `partitionKey`.
+func (p *Producer) Writer(partitionKey string) io.Writer {
+	return &writer{p, partitionKey}
+}
+
+type writer struct {
+	producer     *Producer
+	partitionKey string
+}
+
+// Write puts a copy of `b`, as callers are allowed to reuse it once Write
+// returns. A buffer larger than the record size limit is not written at all.
+func (w *writer) Write(b []byte) (int, error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+	if err := w.producer.Put(data, w.partitionKey); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,41 @@
+package producer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	k "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestWriter(t *testing.T) {
+	client := &clientMock{
+		incoming: make(map[int][]string),
+		responses: []responseMock{
+			{
+				Response: &k.PutRecordsOutput{
+					FailedRecordCount: aws.Int64(0),
+				},
+			},
+		},
+	}
+	p := New(&Config{
+		StreamName:          "foo",
+		MaxConnections:      1,
+		AggregateBatchCount: 1,
+		Client:              client,
+	})
+	p.Start()
+	w := p.Writer("bar")
+	for i := 0; i < 3; i++ {
+		_, err := fmt.Fprintf(w, "line %d", i)
+		assert(t, err == nil, "should not return an error")
+	}
+	n, err := w.Write(make([]byte, maxRecordSize+1))
+	assert(t, n == 0 && err == ErrRecordSizeExceeded, "should reject writes exceeding the record size")
+	p.Stop()
+
+	assert(t, len(client.incoming[0]) == 3, "should put each write as a record")
+	_, err = w.Write([]byte("late"))
+	assert(t, err == ErrStoppedProducer, "should fail writing to a stopped producer")
+}